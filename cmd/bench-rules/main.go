@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"git.gammaspectra.live/git/go-away/lib"
+	"git.gammaspectra.live/git/go-away/lib/policy"
+	"git.gammaspectra.live/git/go-away/lib/settings"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+)
+
+// generatePolicy Creates a policy with rules per host, rules per path prefix on any host, and unguarded rules
+// Matching rules pass, so the backend can report which rule matched
+func generatePolicy(hosts, rulesPerHost, pathRules, unguardedRules int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("rules:\n")
+	writeRule := func(name, condition string) {
+		_, _ = fmt.Fprintf(&buf, "  - name: %s\n    conditions: [%q]\n    action: pass\n", name, condition)
+	}
+	for i := range unguardedRules {
+		writeRule(fmt.Sprintf("unguarded-%d", i), fmt.Sprintf(`userAgent.contains("bot-%d")`, i))
+	}
+	for i := range pathRules {
+		writeRule(fmt.Sprintf("path-%d", i), fmt.Sprintf(`path.startsWith("/p%d/") && userAgent.contains("bot")`, i))
+	}
+	for h := range hosts {
+		for i := range rulesPerHost {
+			writeRule(fmt.Sprintf("host-%d-%d", h, i), fmt.Sprintf(`host == "h%d.example.com" && (path.startsWith("/r%d/") || userAgent.contains("bot-%d"))`, h, i, i))
+		}
+	}
+	return buf.Bytes()
+}
+
+func newState(policyData []byte, disableIndex bool) (*lib.State, error) {
+	p, err := policy.NewPolicy(bytes.NewReader(policyData))
+	if err != nil {
+		return nil, err
+	}
+	return lib.NewState(*p, settings.DefaultSettings, policy.StateSettings{
+		Backends: map[string]http.Handler{
+			"*": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Away-Rule", r.Header.Get("X-Away-Rule"))
+				w.WriteHeader(http.StatusOK)
+			}),
+		},
+		PrivateKeySeed:   make([]byte, 32),
+		DisableRuleIndex: disableIndex,
+	})
+}
+
+func main() {
+	hosts := flag.Int("hosts", 100, "number of hosts with their own rules")
+	rulesPerHost := flag.Int("rules-per-host", 40, "number of rules guarded by host equality and path prefix, per host")
+	pathRules := flag.Int("path-rules", 500, "number of rules guarded by path prefix on any host")
+	unguardedRules := flag.Int("unguarded-rules", 20, "number of rules without guards, always evaluated")
+	benchTime := flag.Duration("bench-time", time.Second*2, "duration to run each benchmark for")
+	flag.Parse()
+
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError})))
+
+	policyData := generatePolicy(*hosts, *rulesPerHost, *pathRules, *unguardedRules)
+	total := *hosts**rulesPerHost + *pathRules + *unguardedRules
+
+	requests := make([]*http.Request, 1024)
+	rng := rand.New(rand.NewPCG(0, 0))
+	for i := range requests {
+		host := fmt.Sprintf("h%d.example.com", rng.IntN(*hosts+1))
+		path := fmt.Sprintf("/x%d/y", rng.IntN(*pathRules+1))
+		userAgent := "Mozilla/5.0"
+		switch i % 4 {
+		case 0:
+			// matches a path rule, if in range
+			path = fmt.Sprintf("/p%d/y", rng.IntN(*pathRules+1))
+			userAgent = "bot/1.0"
+		case 1:
+			// matches a host rule, if in range
+			path = fmt.Sprintf("/r%d/y", rng.IntN(*rulesPerHost+1))
+		}
+		requests[i] = httptest.NewRequest(http.MethodGet, "http://"+host+path, nil)
+		requests[i].Header.Set("User-Agent", userAgent)
+	}
+
+	serve := func(state *lib.State, r *http.Request) (status int, rule string) {
+		w := httptest.NewRecorder()
+		state.ServeHTTP(w, r.Clone(r.Context()))
+		if w.Code != http.StatusOK {
+			panic(fmt.Errorf("unexpected status %d: %s", w.Code, strings.TrimSpace(w.Body.String())))
+		}
+		return w.Code, w.Header().Get("X-Away-Rule")
+	}
+
+	states := make(map[string]*lib.State)
+	for _, disableIndex := range []bool{true, false} {
+		name := "index"
+		if disableIndex {
+			name = "linear"
+		}
+
+		loadStart := time.Now()
+		state, err := newState(policyData, disableIndex)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("BENCH\t%d rules/%s/Load\t%d ns\n", total, name, time.Since(loadStart).Nanoseconds())
+		states[name] = state
+	}
+	defer func() {
+		for _, state := range states {
+			_ = state.Close()
+		}
+	}()
+
+	// skipping rules must not change outcomes
+	var matched int
+	for _, r := range requests {
+		linearStatus, linearRule := serve(states["linear"], r)
+		indexStatus, indexRule := serve(states["index"], r)
+		if linearStatus != indexStatus || linearRule != indexRule {
+			fmt.Printf("FAIL\t%s%s: linear %d %q, index %d %q\n", r.Host, r.URL.Path, linearStatus, linearRule, indexStatus, indexRule)
+			os.Exit(1)
+		}
+		if linearRule != "" {
+			matched++
+		}
+	}
+	if matched == 0 {
+		fmt.Printf("FAIL\tno generated request matched a rule\n")
+		os.Exit(1)
+	}
+	fmt.Printf("PASS\t%d requests, %d matched a rule, same outcome with and without index\n", len(requests), matched)
+
+	for _, name := range []string{"linear", "index"} {
+		state := states[name]
+
+		var ops int
+		start := time.Now()
+		for time.Since(start) < *benchTime {
+			serve(state, requests[ops%len(requests)])
+			ops++
+		}
+		duration := time.Since(start)
+		fmt.Printf("BENCH\t%d rules/%s/Request\t%d ops\t%d ns/op\t%.1f ops/s\n", total, name, ops, (duration / time.Duration(ops)).Nanoseconds(), float64(ops)/duration.Seconds())
+	}
+}
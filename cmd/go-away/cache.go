@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"git.gammaspectra.live/git/go-away/utils"
+	"io/fs"
+	"net/http"
+	"time"
+)
+
+type cacheEntry struct {
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// cacheHandler Allows listing cache entries via GET /cache/, and removing them via DELETE /cache/{key...}
+func cacheHandler(cache utils.Cache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.PathValue("key")
+		switch r.Method {
+		case http.MethodGet:
+			if key != "" {
+				info, err := cache.Stat(key)
+				if errors.Is(err, fs.ErrNotExist) {
+					http.Error(w, err.Error(), http.StatusNotFound)
+					return
+				} else if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(cacheEntry{Key: key, Size: info.Size, Modified: info.Modified})
+				return
+			}
+
+			entries := make([]cacheEntry, 0)
+			err := cache.Range(func(key string, info utils.CacheInfo) bool {
+				entries = append(entries, cacheEntry{Key: key, Size: info.Size, Modified: info.Modified})
+				return true
+			})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(entries)
+		case http.MethodDelete:
+			err := cache.Delete(key)
+			if errors.Is(err, fs.ErrNotExist) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+	})
+}
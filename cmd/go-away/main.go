@@ -62,6 +62,11 @@ func fatal(err error) {
 
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "sign-url" {
+		signUrl(os.Args[2:])
+		return
+	}
+
 	opt := settings.DefaultSettings
 
 	flag.StringVar(&opt.Bind.Address, "bind", opt.Bind.Address, "network address to bind HTTP/HTTP(s) to")
@@ -80,6 +85,13 @@ func main() {
 	backendIpHeader := flag.String("backend-ip-header", "", "Backend HTTP header to set the client IP address from, if empty defaults to leaving Client header alone (X-Real-Ip, X-Client-Ip, X-Forwarded-For, Cf-Connecting-Ip, etc.)")
 
 	cachePath := flag.String("cache", path.Join(os.TempDir(), "go_away_cache"), "path to temporary cache directory")
+	cacheMaxSize := flag.Int64("cache-max-size", 0, "maximum size in MiB of cache directory entries, oldest are evicted first. 0 for unlimited")
+	cacheMaxAge := flag.Duration("cache-max-age", 0, "cache directory entries not updated within this duration are evicted. 0 for unlimited")
+	cacheMemorySize := flag.Int64("cache-memory-size", 0, "size in MiB of recently used cache entries kept in memory, in front of the cache directory. 0 disables")
+
+	sharedStateUrl := flag.String("shared-state", "", "URL of state shared across replicas, or on GOAWAY_SHARED_STATE env. Keeps awaiters, counters and caches in sync (memory://, redis://[:password@]host:port[/db]). Defaults to process local state")
+
+	sessionStore := flag.String("session-store", "", "keep challenge state server-side and only a session id on the cookie (memory, disk). Disk sessions are kept on the cache directory. Defaults to state on cookie")
 
 	policyFile := flag.String("policy", "", "path to policy YAML file")
 	var policySnippets MultiVar
@@ -89,6 +101,8 @@ func main() {
 
 	flag.StringVar(&opt.ChallengeTemplate, "challenge-template", opt.ChallengeTemplate, "name or path of the challenge template to use (anubis, forgejo)")
 
+	flag.StringVar(&opt.ChallengeDirectory, "challenge-directory", opt.ChallengeDirectory, "path to a directory of custom challenge runtimes, each on a subdirectory with runtime and static folders. Runtimes are reloaded on change")
+
 	templateTheme := flag.String("challenge-template-theme", opt.ChallengeTemplateOverrides["Theme"], "override template theme to use (forgejo => [forgejo-auto, forgejo-dark, forgejo-light, gitea...])")
 	templateLogo := flag.String("challenge-template-logo", opt.ChallengeTemplateOverrides["Logo"], "override template logo to use")
 
@@ -96,6 +110,9 @@ func main() {
 
 	jwtPrivateKeySeed := flag.String("jwt-private-key-seed", "", "Seed for the jwt private key, or on JWT_PRIVATE_KEY_SEED env. One be generated by passing \"generate\" as a value, follows RFC 8032 private key definition. Defaults to random")
 
+	jwtPrivateKeyDirectory := flag.String("jwt-private-key-directory", "", "Directory of jwt private keys as PEM or seed files, or on GOAWAY_JWT_PRIVATE_KEY_DIRECTORY env. The last file by name is used to sign, others only to verify. Reloaded on change. Requires a jwt private key seed")
+	jwtPrivateKeyGrace := flag.Duration("jwt-private-key-grace", 0, "How long superseded jwt private keys are accepted for verification after a newer key is added. Zero keeps them while present")
+
 	var backends MultiVar
 	flag.Var(&backends, "backend", "backend definition in the form of an.example.com=http://backend:1234 (can be specified multiple times)")
 
@@ -186,6 +203,14 @@ func main() {
 
 	}
 
+	if kValue = os.Getenv("GOAWAY_JWT_PRIVATE_KEY_DIRECTORY"); kValue != "" {
+		*jwtPrivateKeyDirectory = kValue
+	}
+
+	if kValue = os.Getenv("GOAWAY_SHARED_STATE"); kValue != "" {
+		*sharedStateUrl = kValue
+	}
+
 	createdBackends := make(map[string]http.Handler)
 	for _, backend := range backends {
 		if backend == "" {
@@ -230,14 +255,14 @@ func main() {
 		if err != nil {
 			fatal(fmt.Errorf("failed to create cache directory: %w", err))
 		}
-		for _, n := range []string{"networks", "acme"} {
+		for _, n := range []string{"networks", "acme", "sessions"} {
 			err = os.MkdirAll(path.Join(*cachePath, n), 0755)
 			if err != nil {
 				fatal(fmt.Errorf("failed to create cache sub directory %s: %w", n, err))
 			}
 		}
 
-		cache, err = utils.CacheDirectory(*cachePath)
+		cache, err = utils.CacheDirectory(*cachePath, *cacheMaxSize*1024*1024, *cacheMaxAge)
 		if err != nil {
 			fatal(fmt.Errorf("failed to open cache directory: %w", err))
 		}
@@ -245,6 +270,36 @@ func main() {
 		acmeCache = path.Join(*cachePath, "acme")
 	}
 
+	if *cacheMemorySize > 0 {
+		cache = utils.CacheMemory(cache, *cacheMemorySize*1024*1024)
+	}
+
+	var sessions utils.SessionStore
+	switch *sessionStore {
+	case "":
+	case "memory":
+		sessions = utils.NewMemorySessionStore()
+	case "disk":
+		if *cachePath == "" {
+			fatal(errors.New("disk session store requires a cache directory"))
+		}
+		sessions, err = utils.NewDirectorySessionStore(path.Join(*cachePath, "sessions"))
+		if err != nil {
+			fatal(fmt.Errorf("failed to open session store: %w", err))
+		}
+	default:
+		fatal(fmt.Errorf("unknown session store %s", *sessionStore))
+	}
+
+	var sharedState utils.SharedState
+	if *sharedStateUrl != "" {
+		sharedState, err = utils.NewSharedState(*sharedStateUrl)
+		if err != nil {
+			fatal(fmt.Errorf("failed to connect to shared state: %w", err))
+		}
+		defer sharedState.Close()
+	}
+
 	loadPolicyState := func() (*lib.State, error) {
 		policyData, err := os.ReadFile(*policyFile)
 		if err != nil {
@@ -263,9 +318,15 @@ func main() {
 			MainVersion:           internalMainVersion,
 			BasePath:              *basePath,
 			PrivateKeySeed:        seed,
+			PrivateKeyDirectory:   *jwtPrivateKeyDirectory,
+			PrivateKeyGrace:       *jwtPrivateKeyGrace,
 			ClientIpHeader:        *clientIpHeader,
 			BackendIpHeader:       *backendIpHeader,
 			ChallengeResponseCode: opt.ChallengeHttpCode,
+			ChallengeDirectory:    opt.ChallengeDirectory,
+			Cookie:                opt.Cookie,
+			Sessions:              sessions,
+			SharedState:           sharedState,
 		}
 
 		state, err := lib.NewState(*p, opt, stateSettings)
@@ -339,6 +400,12 @@ func main() {
 			mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 			mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 			mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+			if sessions != nil {
+				mux.Handle("/sessions/{id}", sessionHandler(sessions))
+			}
+			if cache != nil {
+				mux.Handle("/cache/{key...}", cacheHandler(cache))
+			}
 			debugServer := http.Server{
 				Addr:     opt.BindDebug,
 				Handler:  mux,
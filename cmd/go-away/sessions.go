@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"git.gammaspectra.live/git/go-away/utils"
+	"net/http"
+)
+
+// sessionHandler Allows inspecting and revoking sessions by id, as sent to backends via X-Away-Session
+func sessionHandler(sessions utils.SessionStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		switch r.Method {
+		case http.MethodGet:
+			data, err := sessions.Get(id)
+			if errors.Is(err, utils.ErrSessionNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write(data)
+		case http.MethodDelete:
+			err := sessions.Delete(id)
+			if errors.Is(err, utils.ErrSessionNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"os"
+	"time"
+
+	signed_url "git.gammaspectra.live/git/go-away/lib/challenge/signed-url"
+	"git.gammaspectra.live/git/go-away/lib/policy"
+)
+
+// signUrl Implements the sign-url subcommand, which mints links accepted by signed-url challenges
+func signUrl(args []string) {
+	fs := flag.NewFlagSet("sign-url", flag.ExitOnError)
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(fs.Output(), "Usage: %s sign-url [flags] <url>...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	policyFile := fs.String("policy", "", "path to policy YAML file")
+	var policySnippets MultiVar
+	fs.Var(&policySnippets, "policy-snippets", "path to YAML snippets folder (can be specified multiple times)")
+	challengeName := fs.String("challenge", "", "name of the signed-url challenge on the policy")
+	validFor := fs.Duration("expiry", time.Hour*24, "how long the signed url is valid for")
+	network := fs.String("network", "", "if set, only clients within this network prefix can use the signed url")
+	jwtPrivateKeySeed := fs.String("jwt-private-key-seed", "", "Seed for the jwt private key, or on JWT_PRIVATE_KEY_SEED env. Used when the challenge has no hmac-key, keys in --jwt-private-key-directory are not used to sign urls")
+
+	_ = fs.Parse(args)
+
+	if *policyFile == "" || *challengeName == "" || fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	policyData, err := os.ReadFile(*policyFile)
+	if err != nil {
+		fatal(fmt.Errorf("failed to read policy file: %w", err))
+	}
+
+	p, err := policy.NewPolicy(bytes.NewReader(policyData), policySnippets...)
+	if err != nil {
+		fatal(fmt.Errorf("failed to parse policy file: %w", err))
+	}
+
+	c, ok := p.Challenges[*challengeName]
+	if !ok {
+		fatal(fmt.Errorf("challenge %s not found", *challengeName))
+	}
+	if c.Runtime != signed_url.Key {
+		fatal(fmt.Errorf("challenge %s has runtime %s, expected %s", *challengeName, c.Runtime, signed_url.Key))
+	}
+
+	params, err := signed_url.ParseParameters(c.Parameters)
+	if err != nil {
+		fatal(fmt.Errorf("failed to parse challenge parameters: %w", err))
+	}
+
+	var privateKey ed25519.PrivateKey
+	if params.HMACKey == "" {
+		var kValue string
+		if kValue = os.Getenv("GOAWAY_JWT_PRIVATE_KEY_SEED"); kValue != "" {
+			// prefer first
+		} else if kValue = os.Getenv("JWT_PRIVATE_KEY_SEED"); kValue != "" {
+
+		} else {
+			kValue = *jwtPrivateKeySeed
+		}
+		if kValue == "" {
+			fatal(errors.New("challenge has no hmac-key, a private key seed is required"))
+		}
+
+		seed, err := hex.DecodeString(kValue)
+		if err != nil {
+			fatal(fmt.Errorf("failed to decode seed: %w", err))
+		}
+		if len(seed) != ed25519.SeedSize {
+			fatal(fmt.Errorf("invalid seed length: %d, expected %d", len(seed), ed25519.SeedSize))
+		}
+		privateKey = ed25519.NewKeyFromSeed(seed)
+	}
+
+	var publicKey ed25519.PublicKey
+	if privateKey != nil {
+		publicKey = privateKey.Public().(ed25519.PublicKey)
+	}
+
+	key, err := params.SigningKey(publicKey)
+	if err != nil {
+		fatal(err)
+	}
+	if key.PublicKey != nil {
+		if !key.PublicKey.Equal(privateKey.Public()) {
+			fatal(errors.New("private key seed does not match challenge public-key"))
+		}
+		key.PrivateKey = privateKey
+	}
+
+	var prefix netip.Prefix
+	if *network != "" {
+		prefix, err = netip.ParsePrefix(*network)
+		if err != nil {
+			fatal(fmt.Errorf("invalid network: %w", err))
+		}
+	}
+
+	expires := time.Now().Add(*validFor)
+	for _, arg := range fs.Args() {
+		u, err := url.Parse(arg)
+		if err != nil {
+			fatal(fmt.Errorf("invalid url %s: %w", arg, err))
+		}
+		err = key.Sign(u, expires, prefix)
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Println(u.String())
+	}
+}
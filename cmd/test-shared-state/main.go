@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"git.gammaspectra.live/git/go-away/utils"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Check A check run against two connections to the same shared state, as two replicas would hold
+type Check struct {
+	Name string
+	Run  func(a, b utils.SharedState, prefix string) error
+}
+
+var Checks = []Check{
+	{Name: "set-get-delete", Run: checkSetGetDelete},
+	{Name: "expiry", Run: checkExpiry},
+	{Name: "incr-concurrent", Run: checkIncrConcurrent},
+	{Name: "incr-expiry", Run: checkIncrExpiry},
+	{Name: "publish-subscribe", Run: checkPublishSubscribe},
+	{Name: "counter", Run: checkCounter},
+}
+
+func main() {
+	stateUrl := flag.String("url", "", "URL of an additional shared state to test, such as redis://127.0.0.1:6379/15. Keys are written under a random prefix")
+	concurrency := flag.Int("concurrency", 32, "number of concurrent increments in incr and counter checks")
+	flag.Parse()
+
+	checkConcurrency = *concurrency
+
+	standIn, err := NewStandIn("password")
+	if err != nil {
+		panic(err)
+	}
+	defer standIn.Close()
+
+	targets := []struct {
+		Name string
+		Url  string
+	}{
+		{Name: "memory", Url: "memory://"},
+		{Name: "standin", Url: "redis://:password@" + standIn.Address() + "/1"},
+	}
+	if *stateUrl != "" {
+		targets = append(targets, struct {
+			Name string
+			Url  string
+		}{Name: "url", Url: *stateUrl})
+	}
+
+	prefix := fmt.Sprintf("go-away-test-%d:", time.Now().UnixNano())
+
+	var failed int
+	for _, target := range targets {
+		a, err := utils.NewSharedState(target.Url)
+		if err != nil {
+			fmt.Printf("FAIL\t%s: %s\n", target.Name, err)
+			failed++
+			continue
+		}
+		b := a
+		if target.Name != "memory" {
+			// memory state is process local, replicas are separate connections
+			if b, err = utils.NewSharedState(target.Url); err != nil {
+				fmt.Printf("FAIL\t%s: %s\n", target.Name, err)
+				failed++
+				_ = a.Close()
+				continue
+			}
+		}
+
+		for _, check := range Checks {
+			if err = check.Run(a, b, prefix+check.Name+":"); err != nil {
+				fmt.Printf("FAIL\t%s/%s: %s\n", target.Name, check.Name, err)
+				failed++
+			} else {
+				fmt.Printf("PASS\t%s/%s\n", target.Name, check.Name)
+			}
+		}
+
+		_ = a.Close()
+		if b != a {
+			_ = b.Close()
+		}
+	}
+
+	if failed > 0 {
+		fmt.Printf("FAIL\t%d failures\n", failed)
+		os.Exit(1)
+	}
+	fmt.Println("ok")
+}
+
+var checkConcurrency int
+
+func checkSetGetDelete(a, b utils.SharedState, prefix string) error {
+	ctx := context.Background()
+	key := prefix + "key"
+
+	if _, err := b.Get(ctx, key); !errors.Is(err, utils.ErrStateNotFound) {
+		return fmt.Errorf("missing key: expected %v, got %v", utils.ErrStateNotFound, err)
+	}
+	if err := a.Set(ctx, key, []byte("value\r\n\x00"), time.Minute); err != nil {
+		return err
+	}
+	value, err := b.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if string(value) != "value\r\n\x00" {
+		return fmt.Errorf("expected %q, got %q", "value\r\n\x00", value)
+	}
+	if err = b.Delete(ctx, key); err != nil {
+		return err
+	}
+	if _, err = a.Get(ctx, key); !errors.Is(err, utils.ErrStateNotFound) {
+		return fmt.Errorf("deleted key: expected %v, got %v", utils.ErrStateNotFound, err)
+	}
+	return nil
+}
+
+func checkExpiry(a, b utils.SharedState, prefix string) error {
+	ctx := context.Background()
+	key := prefix + "key"
+
+	if err := a.Set(ctx, key, []byte("value"), time.Millisecond*200); err != nil {
+		return err
+	}
+	if _, err := b.Get(ctx, key); err != nil {
+		return fmt.Errorf("before expiry: %w", err)
+	}
+	time.Sleep(time.Millisecond * 400)
+	if _, err := b.Get(ctx, key); !errors.Is(err, utils.ErrStateNotFound) {
+		return fmt.Errorf("after expiry: expected %v, got %v", utils.ErrStateNotFound, err)
+	}
+	return nil
+}
+
+func checkIncrConcurrent(a, b utils.SharedState, prefix string) error {
+	ctx := context.Background()
+	key := prefix + "counter"
+
+	var wg sync.WaitGroup
+	results := make([]int64, checkConcurrency)
+	errs := make([]error, checkConcurrency)
+	for i := range results {
+		state := a
+		if i%2 == 1 {
+			state = b
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = state.Incr(ctx, key, 1, time.Minute)
+		}()
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	seen := make(map[int64]bool)
+	for _, n := range results {
+		if n < 1 || n > int64(checkConcurrency) || seen[n] {
+			return fmt.Errorf("increments returned %v, expected each of 1 to %d once", results, checkConcurrency)
+		}
+		seen[n] = true
+	}
+
+	value, err := b.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if string(value) != strconv.Itoa(checkConcurrency) {
+		return fmt.Errorf("expected total %d, got %s", checkConcurrency, value)
+	}
+	return nil
+}
+
+func checkIncrExpiry(a, b utils.SharedState, prefix string) error {
+	ctx := context.Background()
+	key := prefix + "counter"
+
+	if n, err := a.Incr(ctx, key, 2, time.Millisecond*400); err != nil {
+		return err
+	} else if n != 2 {
+		return fmt.Errorf("expected 2, got %d", n)
+	}
+	time.Sleep(time.Millisecond * 250)
+	// must not extend the expiry of the existing counter
+	if n, err := b.Incr(ctx, key, 3, time.Millisecond*400); err != nil {
+		return err
+	} else if n != 5 {
+		return fmt.Errorf("expected 5, got %d", n)
+	}
+	time.Sleep(time.Millisecond * 300)
+	if _, err := a.Get(ctx, key); !errors.Is(err, utils.ErrStateNotFound) {
+		return fmt.Errorf("after expiry: expected %v, got %v", utils.ErrStateNotFound, err)
+	}
+	if n, err := b.Incr(ctx, key, 1, time.Minute); err != nil {
+		return err
+	} else if n != 1 {
+		return fmt.Errorf("expected counter to restart at 1, got %d", n)
+	}
+	return nil
+}
+
+func checkPublishSubscribe(a, b utils.SharedState, prefix string) error {
+	ctx := context.Background()
+	channel := prefix + "channel"
+
+	received := make(chan []byte, 16)
+	unsubscribe, err := b.Subscribe(channel, func(message []byte) {
+		received <- message
+	})
+	if err != nil {
+		return err
+	}
+	defer unsubscribe()
+
+	// subscriptions on other connections are established asynchronously, publish until received
+	deadline := time.After(time.Second * 5)
+	for {
+		if err = a.Publish(ctx, channel, []byte("message")); err != nil {
+			return err
+		}
+		select {
+		case message := <-received:
+			if string(message) != "message" {
+				return fmt.Errorf("expected %q, got %q", "message", message)
+			}
+			return nil
+		case <-time.After(time.Millisecond * 100):
+		case <-deadline:
+			return errors.New("message not received")
+		}
+	}
+}
+
+func checkCounter(a, b utils.SharedState, prefix string) error {
+	counters := map[string]*utils.StateCounter[string]{
+		"local":  utils.NewStateCounter[string](nil, prefix),
+		"shared": utils.NewStateCounter[string](a, prefix),
+	}
+
+	for name, counter := range counters {
+		var wg sync.WaitGroup
+		for range checkConcurrency {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				counter.Incr(name, time.Minute)
+			}()
+		}
+		wg.Wait()
+
+		if n := counter.Get(name); n != int64(checkConcurrency) {
+			return fmt.Errorf("%s: expected %d, got %d", name, checkConcurrency, n)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// standInEntry Value kept on the stand-in, with optional expiry
+type standInEntry struct {
+	value  []byte
+	expiry time.Time
+}
+
+// StandIn Minimal server speaking the Redis protocol, implementing the commands used by utils.NewRedisSharedState
+// Commands within MULTI/EXEC run under one lock, and see the same time, as on Redis 7
+type StandIn struct {
+	listener net.Listener
+	password string
+
+	lock    sync.Mutex
+	entries map[string]standInEntry
+
+	subscribersLock sync.Mutex
+	subscribers     map[string]map[*standInConn]struct{}
+}
+
+type standInConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// writeLock Held while writing replies, as published messages are written concurrently
+	writeLock sync.Mutex
+	writer    *bufio.Writer
+
+	authenticated bool
+	queued        [][][]byte
+	inMulti       bool
+}
+
+// NewStandIn Listens on a random local port. If password is set, clients must AUTH first
+func NewStandIn(password string) (*StandIn, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &StandIn{
+		listener:    listener,
+		password:    password,
+		entries:     make(map[string]standInEntry),
+		subscribers: make(map[string]map[*standInConn]struct{}),
+	}
+	go s.serve()
+	return s, nil
+}
+
+func (s *StandIn) Address() string {
+	return s.listener.Addr().String()
+}
+
+func (s *StandIn) Close() error {
+	return s.listener.Close()
+}
+
+func (s *StandIn) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &standInConn{
+			conn:          conn,
+			reader:        bufio.NewReader(conn),
+			writer:        bufio.NewWriter(conn),
+			authenticated: s.password == "",
+		}
+		go s.handle(c)
+	}
+}
+
+func (c *standInConn) readCommand() ([][]byte, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if !strings.HasPrefix(line, "*") {
+		return nil, errors.New("expected array")
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+	args := make([][]byte, n)
+	for i := range args {
+		line, err = c.reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		if !strings.HasPrefix(line, "$") {
+			return nil, errors.New("expected bulk string")
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(c.reader, buf); err != nil {
+			return nil, err
+		}
+		args[i] = buf[:size]
+	}
+	return args, nil
+}
+
+// encode Writes a reply: string (simple), []byte (bulk), int64, []any, nil or error
+func (c *standInConn) encode(reply any) {
+	switch v := reply.(type) {
+	case string:
+		_, _ = fmt.Fprintf(c.writer, "+%s\r\n", v)
+	case error:
+		_, _ = fmt.Fprintf(c.writer, "-%s\r\n", v.Error())
+	case int64:
+		_, _ = fmt.Fprintf(c.writer, ":%d\r\n", v)
+	case []byte:
+		_, _ = fmt.Fprintf(c.writer, "$%d\r\n", len(v))
+		_, _ = c.writer.Write(v)
+		_, _ = c.writer.WriteString("\r\n")
+	case []any:
+		_, _ = fmt.Fprintf(c.writer, "*%d\r\n", len(v))
+		for _, e := range v {
+			c.encode(e)
+		}
+	case nil:
+		_, _ = c.writer.WriteString("$-1\r\n")
+	}
+}
+
+func (c *standInConn) reply(replies ...any) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	for _, reply := range replies {
+		c.encode(reply)
+	}
+	_ = c.writer.Flush()
+}
+
+func (s *StandIn) handle(c *standInConn) {
+	defer c.conn.Close()
+	defer s.unsubscribe(c)
+
+	for {
+		args, err := c.readCommand()
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		name := strings.ToUpper(string(args[0]))
+
+		if !c.authenticated && name != "AUTH" {
+			c.reply(errors.New("NOAUTH Authentication required."))
+			continue
+		}
+
+		switch name {
+		case "AUTH":
+			if len(args) != 2 || string(args[1]) != s.password {
+				c.reply(errors.New("WRONGPASS invalid password"))
+				continue
+			}
+			c.authenticated = true
+			c.reply("OK")
+		case "MULTI":
+			c.inMulti = true
+			c.queued = nil
+			c.reply("OK")
+		case "EXEC":
+			if !c.inMulti {
+				c.reply(errors.New("ERR EXEC without MULTI"))
+				continue
+			}
+			c.inMulti = false
+			s.lock.Lock()
+			now := time.Now()
+			results := make([]any, 0, len(c.queued))
+			for _, queued := range c.queued {
+				results = append(results, s.execute(now, queued))
+			}
+			s.lock.Unlock()
+			c.queued = nil
+			c.reply(results)
+		case "SUBSCRIBE", "UNSUBSCRIBE":
+			for _, channel := range args[1:] {
+				n := s.subscribe(c, string(channel), name == "SUBSCRIBE")
+				c.reply([]any{[]byte(strings.ToLower(name)), channel, n})
+			}
+		case "PUBLISH":
+			if len(args) != 3 {
+				c.reply(errors.New("ERR wrong number of arguments"))
+				continue
+			}
+			c.reply(s.publish(string(args[1]), args[2]))
+		default:
+			if c.inMulti {
+				c.queued = append(c.queued, args)
+				c.reply("QUEUED")
+				continue
+			}
+			s.lock.Lock()
+			reply := s.execute(time.Now(), args)
+			s.lock.Unlock()
+			c.reply(reply)
+		}
+	}
+}
+
+// get Returns the entry at key if it has not expired at now. Must be called with lock held
+func (s *StandIn) get(now time.Time, key string) (standInEntry, bool) {
+	e, ok := s.entries[key]
+	if ok && !e.expiry.IsZero() && !now.Before(e.expiry) {
+		delete(s.entries, key)
+		return standInEntry{}, false
+	}
+	return e, ok
+}
+
+// execute Runs a key command. Must be called with lock held
+func (s *StandIn) execute(now time.Time, args [][]byte) any {
+	name := strings.ToUpper(string(args[0]))
+	switch name {
+	case "PING":
+		return "PONG"
+	case "SELECT":
+		return "OK"
+	case "GET":
+		if len(args) != 2 {
+			break
+		}
+		if e, ok := s.get(now, string(args[1])); ok {
+			return e.value
+		}
+		return nil
+	case "SET":
+		if len(args) < 3 {
+			break
+		}
+		key := string(args[1])
+		e := standInEntry{value: args[2]}
+		var nx bool
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(string(args[i])) {
+			case "NX":
+				nx = true
+			case "PX":
+				if i+1 >= len(args) {
+					return errors.New("ERR syntax error")
+				}
+				ms, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+				if err != nil || ms <= 0 {
+					return errors.New("ERR invalid expire time in 'set' command")
+				}
+				e.expiry = now.Add(time.Duration(ms) * time.Millisecond)
+				i++
+			default:
+				return errors.New("ERR syntax error")
+			}
+		}
+		if _, ok := s.get(now, key); ok && nx {
+			return nil
+		}
+		s.entries[key] = e
+		return "OK"
+	case "DEL":
+		var n int64
+		for _, key := range args[1:] {
+			if _, ok := s.get(now, string(key)); ok {
+				delete(s.entries, string(key))
+				n++
+			}
+		}
+		return n
+	case "INCRBY":
+		if len(args) != 3 {
+			break
+		}
+		delta, err := strconv.ParseInt(string(args[2]), 10, 64)
+		if err != nil {
+			return errors.New("ERR value is not an integer or out of range")
+		}
+		key := string(args[1])
+		e, _ := s.get(now, key)
+		var n int64
+		if e.value != nil {
+			if n, err = strconv.ParseInt(string(e.value), 10, 64); err != nil {
+				return errors.New("ERR value is not an integer or out of range")
+			}
+		}
+		n += delta
+		e.value = []byte(strconv.FormatInt(n, 10))
+		s.entries[key] = e
+		return n
+	case "PTTL":
+		if len(args) != 2 {
+			break
+		}
+		e, ok := s.get(now, string(args[1]))
+		if !ok {
+			return int64(-2)
+		}
+		if e.expiry.IsZero() {
+			return int64(-1)
+		}
+		return e.expiry.Sub(now).Milliseconds()
+	case "PEXPIRE":
+		if len(args) != 3 {
+			break
+		}
+		ms, err := strconv.ParseInt(string(args[2]), 10, 64)
+		if err != nil {
+			return errors.New("ERR value is not an integer or out of range")
+		}
+		key := string(args[1])
+		e, ok := s.get(now, key)
+		if !ok {
+			return int64(0)
+		}
+		e.expiry = now.Add(time.Duration(ms) * time.Millisecond)
+		s.entries[key] = e
+		return int64(1)
+	default:
+		return fmt.Errorf("ERR unknown command '%s'", name)
+	}
+	return fmt.Errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(name))
+}
+
+// subscribe Adds or removes c as subscriber of channel, and returns the number of channels c is subscribed to
+func (s *StandIn) subscribe(c *standInConn, channel string, subscribe bool) int64 {
+	s.subscribersLock.Lock()
+	defer s.subscribersLock.Unlock()
+	if subscribe {
+		if s.subscribers[channel] == nil {
+			s.subscribers[channel] = make(map[*standInConn]struct{})
+		}
+		s.subscribers[channel][c] = struct{}{}
+	} else {
+		delete(s.subscribers[channel], c)
+	}
+	var n int64
+	for _, conns := range s.subscribers {
+		if _, ok := conns[c]; ok {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *StandIn) unsubscribe(c *standInConn) {
+	s.subscribersLock.Lock()
+	defer s.subscribersLock.Unlock()
+	for _, conns := range s.subscribers {
+		delete(conns, c)
+	}
+}
+
+func (s *StandIn) publish(channel string, message []byte) int64 {
+	s.subscribersLock.Lock()
+	conns := make([]*standInConn, 0, len(s.subscribers[channel]))
+	for c := range s.subscribers[channel] {
+		conns = append(conns, c)
+	}
+	s.subscribersLock.Unlock()
+
+	for _, c := range conns {
+		c.reply([]any{[]byte("message"), []byte(channel), message})
+	}
+	return int64(len(conns))
+}
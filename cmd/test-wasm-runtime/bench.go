@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"git.gammaspectra.live/git/go-away/lib/challenge/wasm"
+	"git.gammaspectra.live/git/go-away/lib/challenge/wasm/interface"
+	"github.com/tetratelabs/wazero/api"
+	"time"
+)
+
+type benchResult struct {
+	Name     string
+	Ops      int
+	Duration time.Duration
+}
+
+func (r benchResult) String() string {
+	perOp := r.Duration / time.Duration(max(r.Ops, 1))
+	return fmt.Sprintf("BENCH\t%s\t%d ops\t%d ns/op\t%.1f ops/s", r.Name, r.Ops, perOp.Nanoseconds(), float64(r.Ops)/r.Duration.Seconds())
+}
+
+func benchCall(name string, duration time.Duration, f func() error) (benchResult, error) {
+	result := benchResult{
+		Name: name,
+	}
+	start := time.Now()
+	for time.Since(start) < duration {
+		if err := f(); err != nil {
+			return result, err
+		}
+		result.Ops++
+	}
+	result.Duration = time.Since(start)
+	return result, nil
+}
+
+// RunBenchmark Measures MakeChallenge and VerifyChallenge throughput for wasmData with both the native compiler and the interpreter
+// Inputs are taken from the first make and verify cases available
+func RunBenchmark(name string, wasmData []byte, cases []TestCase, duration time.Duration) error {
+	var makeIn *_interface.MakeChallengeInput
+	var verifyIn *_interface.VerifyChallengeInput
+	for _, c := range cases {
+		if makeIn == nil && c.MakeInput != nil {
+			makeIn = c.MakeInput
+		}
+		if verifyIn == nil && c.VerifyInput != nil && c.VerifyOutput == _interface.VerifyChallengeOutputOK {
+			verifyIn = c.VerifyInput
+		}
+	}
+
+	if makeIn == nil && verifyIn == nil {
+		return errors.New("no make or verify test cases to benchmark with")
+	}
+
+	for _, nativeCompiler := range []bool{true, false} {
+		compilerName := "interpreter"
+		if nativeCompiler {
+			compilerName = "compiler"
+		}
+
+		err := func() error {
+			runner := wasm.NewRunner(nativeCompiler)
+			defer runner.Close()
+
+			compileStart := time.Now()
+			err := runner.Compile(name, wasmData)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("BENCH\t%s/%s/Compile\t%d ns\n", name, compilerName, time.Since(compileStart).Nanoseconds())
+
+			if makeIn != nil {
+				result, err := benchCall(fmt.Sprintf("%s/%s/MakeChallenge", name, compilerName), duration, func() error {
+					return runner.Instantiate(name, func(ctx context.Context, mod api.Module) error {
+						_, err := wasm.MakeChallengeCall(ctx, mod, *makeIn)
+						return err
+					})
+				})
+				if err != nil {
+					return err
+				}
+				fmt.Println(result.String())
+			}
+
+			if verifyIn != nil {
+				result, err := benchCall(fmt.Sprintf("%s/%s/VerifyChallenge", name, compilerName), duration, func() error {
+					return runner.Instantiate(name, func(ctx context.Context, mod api.Module) error {
+						out, err := wasm.VerifyChallengeCall(ctx, mod, *verifyIn)
+						if err != nil {
+							return err
+						}
+						if out != _interface.VerifyChallengeOutputOK {
+							return fmt.Errorf("unexpected verify output %d", out)
+						}
+						return nil
+					})
+				})
+				if err != nil {
+					return err
+				}
+				fmt.Println(result.String())
+			}
+			return nil
+		}()
+		if err != nil {
+			return fmt.Errorf("%s/%s: %w", name, compilerName, err)
+		}
+	}
+
+	return nil
+}
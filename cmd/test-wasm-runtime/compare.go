@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"git.gammaspectra.live/git/go-away/lib/challenge/wasm"
+	"git.gammaspectra.live/git/go-away/lib/challenge/wasm/interface"
+	"maps"
+	"math/rand/v2"
+	"reflect"
+	"strconv"
+)
+
+// mutateParameters Returns a copy of parameters with some values replaced by small numbers or random strings
+func (f *fuzzer) mutateParameters(parameters map[string]string) map[string]string {
+	out := maps.Clone(parameters)
+	if out == nil {
+		out = make(map[string]string)
+	}
+	for k := range out {
+		switch f.rng.IntN(4) {
+		case 0:
+			out[k] = f.randomString()
+		case 1:
+			out[k] = strconv.FormatUint(f.rng.Uint64N(16), 10)
+		}
+	}
+	return out
+}
+
+func (f *fuzzer) mutateBytes(data []byte) []byte {
+	data = append([]byte(nil), data...)
+	switch f.rng.IntN(4) {
+	case 0:
+		return data
+	case 1:
+		return data[:f.rng.IntN(len(data)+1)]
+	default:
+		for range f.rng.IntN(4) + 1 {
+			if len(data) == 0 {
+				break
+			}
+			data[f.rng.IntN(len(data))] ^= byte(1 << f.rng.UintN(8))
+		}
+		return data
+	}
+}
+
+// RunCompare Checks that native produces identical results to the WASM runtime, for all test cases and for inputs derived from them
+// Calls where both return an error are considered identical
+func RunCompare(runtime, native wasm.Backend, key string, cases []TestCase, iterations int, seed uint64) (failed int) {
+	f := &fuzzer{
+		rng: rand.New(rand.NewPCG(seed, seed^0x9e3779b97f4a7c15)),
+	}
+
+	var makeInputs []_interface.MakeChallengeInput
+	var verifyInputs []_interface.VerifyChallengeInput
+	for _, c := range cases {
+		if c.MakeInput != nil {
+			makeInputs = append(makeInputs, *c.MakeInput)
+		}
+		if c.VerifyInput != nil {
+			verifyInputs = append(verifyInputs, *c.VerifyInput)
+		}
+	}
+
+	compareMake := func(name string, in _interface.MakeChallengeInput) {
+		expected, expectedErr := runtime.MakeChallenge(in)
+		out, err := native.MakeChallenge(in)
+		if (expectedErr != nil) != (err != nil) {
+			failed++
+			fmt.Printf("FAIL\t%s/compare/%s: error mismatch, wasm %v, native %v\n", key, name, expectedErr, err)
+		} else if err == nil && !reflect.DeepEqual(*expected, *out) {
+			failed++
+			fmt.Printf("FAIL\t%s/compare/%s: make output mismatch, wasm %v, native %v\n", key, name, *expected, *out)
+		}
+	}
+
+	compareVerify := func(name string, in _interface.VerifyChallengeInput) {
+		expected, expectedErr := runtime.VerifyChallenge(in)
+		out, err := native.VerifyChallenge(in)
+		if (expectedErr != nil) != (err != nil) {
+			failed++
+			fmt.Printf("FAIL\t%s/compare/%s: error mismatch, wasm %v, native %v\n", key, name, expectedErr, err)
+		} else if err == nil && expected != out {
+			failed++
+			fmt.Printf("FAIL\t%s/compare/%s: verify output mismatch, wasm %d, native %d\n", key, name, expected, out)
+		}
+	}
+
+	for _, c := range cases {
+		if c.MakeInput != nil {
+			compareMake(c.Name, *c.MakeInput)
+		}
+		if c.VerifyInput != nil {
+			compareVerify(c.Name, *c.VerifyInput)
+		}
+	}
+
+	for i := range iterations {
+		if len(makeInputs) > 0 {
+			in := makeInputs[f.rng.IntN(len(makeInputs))]
+			in.Key = f.mutateBytes(in.Key)
+			in.Parameters = f.mutateParameters(in.Parameters)
+			compareMake(fmt.Sprintf("make/%d", i), in)
+		}
+
+		if len(verifyInputs) > 0 {
+			in := verifyInputs[f.rng.IntN(len(verifyInputs))]
+			switch f.rng.IntN(3) {
+			case 0:
+				in.Key = f.mutateBytes(in.Key)
+			case 1:
+				in.Parameters = f.mutateParameters(in.Parameters)
+			default:
+				in.Result = f.mutateBytes(in.Result)
+			}
+			compareVerify(fmt.Sprintf("verify/%d", i), in)
+		}
+	}
+
+	if failed == 0 {
+		fmt.Printf("PASS\t%s/compare: seed %d, %d iterations\n", key, seed, iterations)
+	}
+	return failed
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"git.gammaspectra.live/git/go-away/lib/challenge/wasm"
+	"git.gammaspectra.live/git/go-away/lib/challenge/wasm/interface"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+const (
+	makeChallengePrefix   = "make-challenge"
+	verifyChallengePrefix = "verify-challenge"
+	outputSuffix          = "-out"
+)
+
+// TestCase A single fixture, either a MakeChallenge or VerifyChallenge call with its expected output
+//
+// Fixtures are discovered under the test folder of a runtime directory, named as follows:
+//   - make-challenge[-name].json with expected output on make-challenge[-name]-out.json
+//   - verify-challenge[-name].json with expected output on verify-challenge[-name]-out.json as a number.
+//     If no output file exists, names containing "fail" expect VerifyChallengeOutputFailed,
+//     names containing "error" expect VerifyChallengeOutputError, otherwise VerifyChallengeOutputOK is expected
+type TestCase struct {
+	Name string
+
+	MakeInput  *_interface.MakeChallengeInput
+	MakeOutput *_interface.MakeChallengeOutput
+
+	VerifyInput  *_interface.VerifyChallengeInput
+	VerifyOutput _interface.VerifyChallengeOutput
+}
+
+func (c TestCase) Run(backend wasm.Backend) error {
+	if c.MakeInput != nil {
+		out, err := backend.MakeChallenge(*c.MakeInput)
+		if err != nil {
+			return err
+		}
+
+		if !reflect.DeepEqual(*out, *c.MakeOutput) {
+			return fmt.Errorf("challenge output did not match expected output, got %v, expected %v", *out, *c.MakeOutput)
+		}
+		return nil
+	} else if c.VerifyInput != nil {
+		out, err := backend.VerifyChallenge(*c.VerifyInput)
+		if err != nil {
+			return err
+		}
+
+		if out != c.VerifyOutput {
+			return fmt.Errorf("verify output did not match expected output, got %d expected %d", out, c.VerifyOutput)
+		}
+		return nil
+	}
+	return errors.New("empty test case")
+}
+
+func readJSON[T any](fileName string) (*T, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var v T
+	err = json.Unmarshal(data, &v)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	return &v, nil
+}
+
+func LoadMakeTestCase(inputPath, outputPath string) (c TestCase, err error) {
+	c.Name = strings.TrimSuffix(filepath.Base(inputPath), ".json")
+	c.MakeInput, err = readJSON[_interface.MakeChallengeInput](inputPath)
+	if err != nil {
+		return TestCase{}, err
+	}
+	c.MakeOutput, err = readJSON[_interface.MakeChallengeOutput](outputPath)
+	if err != nil {
+		return TestCase{}, err
+	}
+	return c, nil
+}
+
+func LoadVerifyTestCase(inputPath string, output _interface.VerifyChallengeOutput) (c TestCase, err error) {
+	c.Name = strings.TrimSuffix(filepath.Base(inputPath), ".json")
+	c.VerifyInput, err = readJSON[_interface.VerifyChallengeInput](inputPath)
+	if err != nil {
+		return TestCase{}, err
+	}
+	c.VerifyOutput = output
+	return c, nil
+}
+
+// DiscoverTestCases Finds all fixtures under testPath
+func DiscoverTestCases(testPath string) (cases []TestCase, err error) {
+	matches, err := filepath.Glob(filepath.Join(testPath, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(matches)
+
+	for _, fileName := range matches {
+		name := strings.TrimSuffix(filepath.Base(fileName), ".json")
+		if strings.HasSuffix(name, outputSuffix) {
+			// expected outputs are loaded alongside inputs
+			continue
+		}
+		outputPath := filepath.Join(testPath, name+outputSuffix+".json")
+
+		switch {
+		case strings.HasPrefix(name, makeChallengePrefix):
+			c, err := LoadMakeTestCase(fileName, outputPath)
+			if err != nil {
+				return nil, err
+			}
+			cases = append(cases, c)
+		case strings.HasPrefix(name, verifyChallengePrefix):
+			expected := _interface.VerifyChallengeOutputOK
+			if out, err := readJSON[_interface.VerifyChallengeOutput](outputPath); err == nil {
+				expected = *out
+			} else if !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			} else if strings.Contains(name, "fail") {
+				expected = _interface.VerifyChallengeOutputFailed
+			} else if strings.Contains(name, "error") {
+				expected = _interface.VerifyChallengeOutputError
+			}
+			c, err := LoadVerifyTestCase(fileName, expected)
+			if err != nil {
+				return nil, err
+			}
+			cases = append(cases, c)
+		}
+	}
+
+	return cases, nil
+}
+
+// RunConformance Runs all test cases against backend, and reports pass or fail for each
+func RunConformance(backend wasm.Backend, key string, cases []TestCase) (failed int) {
+	for _, c := range cases {
+		if err := c.Run(backend); err != nil {
+			failed++
+			fmt.Printf("FAIL\t%s/%s: %s\n", key, c.Name, err)
+		} else {
+			fmt.Printf("PASS\t%s/%s\n", key, c.Name)
+		}
+	}
+	return failed
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"git.gammaspectra.live/git/go-away/lib/challenge/wasm"
+	"git.gammaspectra.live/git/go-away/lib/challenge/wasm/interface"
+	"github.com/tetratelabs/wazero/api"
+	"math/rand/v2"
+	"strconv"
+	"time"
+)
+
+type FuzzSettings struct {
+	Iterations int
+	Seed       uint64
+
+	// Timeout maximum time a single call is allowed to take before being considered hung
+	Timeout time.Duration
+
+	// MemoryLimit maximum allowed growth of module memory by a single call, in bytes
+	// Also bounds growth across malloc/free pairs after warm-up, for runtimes that reuse freed memory
+	MemoryLimit uint32
+}
+
+var errFuzzHang = errors.New("call did not return before timeout, runtime hung")
+
+type fuzzer struct {
+	rng *rand.Rand
+
+	// valid inputs to mutate from
+	seeds [][]byte
+}
+
+func (f *fuzzer) randomBytes(n int) []byte {
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i] = byte(f.rng.UintN(256))
+	}
+	return buf
+}
+
+func (f *fuzzer) randomString() string {
+	switch f.rng.IntN(6) {
+	case 0:
+		return ""
+	case 1:
+		return strconv.FormatInt(f.rng.Int64(), 10)
+	case 2:
+		return strconv.FormatUint(f.rng.Uint64N(512), 10)
+	case 3:
+		return "-" + strconv.FormatUint(f.rng.Uint64N(512), 10)
+	case 4:
+		return hex.EncodeToString(f.randomBytes(f.rng.IntN(64)))
+	default:
+		return string(f.randomBytes(f.rng.IntN(32)))
+	}
+}
+
+// Next Returns the next payload to send as VerifyChallengeInput
+func (f *fuzzer) Next() []byte {
+	switch f.rng.IntN(6) {
+	case 0:
+		// random bytes, likely invalid JSON
+		return f.randomBytes(f.rng.IntN(1024))
+	case 1:
+		// truncated seed
+		if len(f.seeds) > 0 {
+			seed := f.seeds[f.rng.IntN(len(f.seeds))]
+			return seed[:f.rng.IntN(len(seed)+1)]
+		}
+		fallthrough
+	case 2:
+		// seed with random bit flips
+		if len(f.seeds) > 0 {
+			seed := append([]byte(nil), f.seeds[f.rng.IntN(len(f.seeds))]...)
+			for range f.rng.IntN(8) + 1 {
+				if len(seed) == 0 {
+					break
+				}
+				seed[f.rng.IntN(len(seed))] ^= byte(1 << f.rng.UintN(8))
+			}
+			return seed
+		}
+		fallthrough
+	case 3:
+		// wrongly typed fields
+		values := []string{"null", "0", "-1", "true", "[]", "{}", "\"\"", "\"AAAA\"", "1e309"}
+		return []byte(fmt.Sprintf("{\"Key\":%s,\"Parameters\":%s,\"Result\":%s}",
+			values[f.rng.IntN(len(values))],
+			values[f.rng.IntN(len(values))],
+			values[f.rng.IntN(len(values))],
+		))
+	default:
+		// structurally valid input with random contents
+		in := _interface.VerifyChallengeInput{
+			Key:        f.randomBytes(f.rng.IntN(65)),
+			Parameters: make(map[string]string),
+		}
+		for range f.rng.IntN(4) {
+			in.Parameters[f.randomString()] = f.randomString()
+		}
+		if f.rng.IntN(2) == 0 {
+			in.Parameters["difficulty"] = f.randomString()
+		}
+		if f.rng.IntN(2) == 0 {
+			in.Result = []byte(hex.EncodeToString(f.randomBytes(f.rng.IntN(128))))
+		} else {
+			in.Result = f.randomBytes(f.rng.IntN(128))
+		}
+		data, err := json.Marshal(in)
+		if err != nil {
+			panic(err)
+		}
+		return data
+	}
+}
+
+func callWithTimeout[T any](timeout time.Duration, f func() (T, error)) (T, error) {
+	type result struct {
+		v   T
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		v, err := f()
+		done <- result{v: v, err: err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.v, r.err
+	case <-timer.C:
+		var zero T
+		return zero, errFuzzHang
+	}
+}
+
+// RunFuzz Sends random and malformed VerifyChallengeInput payloads to the runtime
+// Checks that it never traps or panics, never hangs, always returns a known output,
+// that no single call grows memory past the limit, and that malloc/free pairs do not leak
+// Runtimes built with a leaking garbage collector never reuse freed memory, their leak check is skipped
+func RunFuzz(runner *wasm.Runner, key string, cases []TestCase, settings FuzzSettings) (failed int, err error) {
+	f := &fuzzer{
+		rng: rand.New(rand.NewPCG(settings.Seed, settings.Seed^0x9e3779b97f4a7c15)),
+	}
+	for _, c := range cases {
+		if c.VerifyInput != nil {
+			data, err := json.Marshal(*c.VerifyInput)
+			if err != nil {
+				return 0, err
+			}
+			f.seeds = append(f.seeds, data)
+		}
+	}
+
+	fmt.Printf("FUZZ\t%s: seed %d, %d iterations\n", key, settings.Seed, settings.Iterations)
+
+	fuzzFailed := failed
+	var iteration int
+	for iteration < settings.Iterations {
+		// instances are reused for many calls, and replaced once grown, as leaking runtimes would run out of memory
+		err = runner.Instantiate(key, func(ctx context.Context, mod api.Module) error {
+			initialSize := mod.Memory().Size()
+
+			for ; iteration < settings.Iterations; iteration++ {
+				payload := f.Next()
+				sizeBefore := mod.Memory().Size()
+				out, err := callWithTimeout(settings.Timeout, func() (_interface.VerifyChallengeOutput, error) {
+					return wasm.VerifyChallengeCallRaw(ctx, mod, payload)
+				})
+				if errors.Is(err, errFuzzHang) {
+					fmt.Printf("FAIL\t%s/fuzz/%d: %s, payload %q\n", key, iteration, err, payload)
+					return err
+				} else if err != nil {
+					failed++
+					fmt.Printf("FAIL\t%s/fuzz/%d: runtime error %s, payload %q\n", key, iteration, err, payload)
+					// module state is unknown after a trap, instantiate a new one
+					iteration++
+					return nil
+				}
+
+				switch out {
+				case _interface.VerifyChallengeOutputOK, _interface.VerifyChallengeOutputFailed, _interface.VerifyChallengeOutputError:
+				default:
+					failed++
+					fmt.Printf("FAIL\t%s/fuzz/%d: unknown verify output %d, payload %q\n", key, iteration, out, payload)
+				}
+
+				if growth := mod.Memory().Size() - sizeBefore; growth > settings.MemoryLimit {
+					failed++
+					fmt.Printf("FAIL\t%s/fuzz/%d: memory grew by %d bytes in a single call, payload %q\n", key, iteration, growth, payload)
+				}
+
+				if mod.Memory().Size()-initialSize > settings.MemoryLimit {
+					iteration++
+					return nil
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return failed + 1, err
+		}
+	}
+	if failed == fuzzFailed {
+		fmt.Printf("PASS\t%s/fuzz\n", key)
+	}
+
+	// check allocations through exports are returned
+	err = runner.Instantiate(key, func(ctx context.Context, mod api.Module) error {
+		malloc := mod.ExportedFunction("malloc")
+		free := mod.ExportedFunction("free")
+
+		warmup := max(settings.Iterations/10, 1)
+		initialSize := mod.Memory().Size()
+		warmSize := initialSize
+		var allocated uint64
+		for i := range settings.Iterations {
+			size := f.rng.Uint64N(64*1024) + 1
+			_, err := callWithTimeout(settings.Timeout, func() (any, error) {
+				ptr, err := malloc.Call(ctx, size)
+				if err != nil {
+					return nil, err
+				}
+				_, err = free.Call(ctx, ptr[0])
+				return nil, err
+			})
+			if err != nil {
+				failed++
+				fmt.Printf("FAIL\t%s/malloc/%d: %s\n", key, i, err)
+				return err
+			}
+			allocated += size
+
+			if i+1 == warmup {
+				if growth := mod.Memory().Size() - initialSize; uint64(growth) >= allocated/2 {
+					fmt.Printf("SKIP\t%s/malloc: freed memory is not reused, memory grew by %d bytes for %d bytes allocated. Runtime likely built with a leaking garbage collector\n", key, growth, allocated)
+					return nil
+				}
+				warmSize = mod.Memory().Size()
+			} else if growth := mod.Memory().Size() - warmSize; i >= warmup && growth > settings.MemoryLimit {
+				failed++
+				fmt.Printf("FAIL\t%s/malloc/%d: memory grew by %d bytes after warm-up, allocations are not freed\n", key, i, growth)
+				return nil
+			}
+		}
+		fmt.Printf("PASS\t%s/malloc: memory grew by %d bytes after warm-up\n", key, mod.Memory().Size()-warmSize)
+		return nil
+	})
+	if err != nil {
+		return failed, err
+	}
+
+	return failed, nil
+}
@@ -1,108 +1,177 @@
 package main
 
 import (
-	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
+	"git.gammaspectra.live/git/go-away/lib/challenge/native"
 	"git.gammaspectra.live/git/go-away/lib/challenge/wasm"
 	"git.gammaspectra.live/git/go-away/lib/challenge/wasm/interface"
-	"github.com/tetratelabs/wazero/api"
 	"os"
-	"reflect"
+	"path/filepath"
 	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	ModeTest  = "test"
+	ModeBench = "bench"
+	ModeFuzz  = "fuzz"
+
+	ModeCompare = "compare"
 )
 
 func main() {
 
-	pathToTest := flag.String("wasm", "", "Path to test file")
+	mode := flag.String("mode", ModeTest, "comma separated modes to run: test (conformance against fixtures), bench (throughput on compiler and interpreter), fuzz (random and malformed inputs), compare (native Go runtime against WASM)")
+	runtimeDirectory := flag.String("runtime-dir", "", "Path to a challenge directory, containing runtime/*.wasm and test/*.json fixtures")
+
+	pathToTest := flag.String("wasm", "", "Path to test file. If set with -runtime-dir, only this runtime is tested")
 	makeChallenge := flag.String("make-challenge", "", "Path to contents for MakeChallenge input")
 	makeChallengeOutput := flag.String("make-challenge-out", "", "Path to contents for expected MakeChallenge output")
 	verifyChallenge := flag.String("verify-challenge", "", "Path to contents for VerifyChallenge input")
 	verifyChallengeOutput := flag.Uint64("verify-challenge-out", uint64(_interface.VerifyChallengeOutputOK), "Path to contents for expected VerifyChallenge output")
 
-	flag.Parse()
+	nativeCompiler := flag.Bool("native-compiler", true, "use native compiler for test and fuzz modes, otherwise interpreter")
+	benchTime := flag.Duration("bench-time", time.Second*2, "duration to run each benchmark for")
 
-	if *pathToTest == "" || *makeChallenge == "" || *makeChallengeOutput == "" || *verifyChallenge == "" {
-		flag.PrintDefaults()
-		os.Exit(1)
-	}
+	fuzzIterations := flag.Int("fuzz-iterations", 10000, "number of fuzz inputs to send")
+	fuzzSeed := flag.Uint64("fuzz-seed", uint64(time.Now().UnixNano()), "seed for random fuzz inputs")
+	fuzzTimeout := flag.Duration("fuzz-timeout", time.Second*5, "maximum duration for a single call before the runtime is considered hung")
+	fuzzMemoryLimit := flag.Uint("fuzz-memory-limit", 16, "maximum module memory growth in MiB of a single call, and of malloc/free pairs after warm-up, during fuzzing")
 
-	wasmData, err := os.ReadFile(*pathToTest)
-	if err != nil {
-		panic(err)
-	}
+	nativeRuntime := flag.String("native-runtime", "", "Name of native runtime for compare mode. Defaults to the name of -runtime-dir")
 
-	runner := wasm.NewRunner(true)
-	defer runner.Close()
+	flag.Parse()
 
-	err = runner.Compile("test", wasmData)
-	if err != nil {
-		panic(err)
-	}
+	var wasmFiles []string
+	var cases []TestCase
+
+	if *runtimeDirectory != "" {
+		if *pathToTest != "" {
+			wasmFiles = append(wasmFiles, *pathToTest)
+		} else {
+			matches, err := filepath.Glob(filepath.Join(*runtimeDirectory, "runtime", "*.wasm"))
+			if err != nil {
+				panic(err)
+			}
+			wasmFiles = append(wasmFiles, matches...)
+		}
 
-	makeData, err := os.ReadFile(*makeChallenge)
-	if err != nil {
-		panic(err)
-	}
-	var makeIn _interface.MakeChallengeInput
-	err = json.Unmarshal(makeData, &makeIn)
-	if err != nil {
-		panic(err)
-	}
+		var err error
+		cases, err = DiscoverTestCases(filepath.Join(*runtimeDirectory, "test"))
+		if err != nil {
+			panic(err)
+		}
+	} else if *pathToTest != "" && *makeChallenge != "" && *makeChallengeOutput != "" && *verifyChallenge != "" {
+		// single fixture set
+		wasmFiles = append(wasmFiles, *pathToTest)
 
-	makeOutData, err := os.ReadFile(*makeChallengeOutput)
-	if err != nil {
-		panic(err)
-	}
-	var makeOut _interface.MakeChallengeOutput
-	err = json.Unmarshal(makeOutData, &makeOut)
-	if err != nil {
-		panic(err)
-	}
+		makeCase, err := LoadMakeTestCase(*makeChallenge, *makeChallengeOutput)
+		if err != nil {
+			panic(err)
+		}
+		verifyCase, err := LoadVerifyTestCase(*verifyChallenge, _interface.VerifyChallengeOutput(*verifyChallengeOutput))
+		if err != nil {
+			panic(err)
+		}
 
-	verifyData, err := os.ReadFile(*verifyChallenge)
-	if err != nil {
-		panic(err)
-	}
-	var verifyIn _interface.VerifyChallengeInput
-	err = json.Unmarshal(verifyData, &verifyIn)
-	if err != nil {
-		panic(err)
+		if slices.Compare(makeCase.MakeInput.Key, verifyCase.VerifyInput.Key) != 0 {
+			panic("challenge keys do not match")
+		}
+		cases = append(cases, makeCase, verifyCase)
+	} else {
+		flag.PrintDefaults()
+		os.Exit(1)
 	}
 
-	if slices.Compare(makeIn.Key, verifyIn.Key) != 0 {
-		panic("challenge keys do not match")
+	if len(wasmFiles) == 0 {
+		panic("no runtimes found")
 	}
 
-	err = runner.Instantiate("test", func(ctx context.Context, mod api.Module) error {
-		out, err := wasm.MakeChallengeCall(ctx, mod, makeIn)
-		if err != nil {
-			return err
-		}
+	modes := strings.Split(*mode, ",")
 
-		if !reflect.DeepEqual(*out, makeOut) {
-			return fmt.Errorf("challenge output did not match expected output, got %v, expected %v", *out, makeOut)
-		}
-		return nil
-	})
-	if err != nil {
-		panic(err)
+	if *nativeRuntime == "" && *runtimeDirectory != "" {
+		*nativeRuntime = filepath.Base(filepath.Clean(*runtimeDirectory))
 	}
 
-	err = runner.Instantiate("test", func(ctx context.Context, mod api.Module) error {
-		out, err := wasm.VerifyChallengeCall(ctx, mod, verifyIn)
+	var failed int
+	for _, wasmFile := range wasmFiles {
+		wasmData, err := os.ReadFile(wasmFile)
 		if err != nil {
-			return err
+			panic(err)
 		}
-
-		if out != _interface.VerifyChallengeOutput(*verifyChallengeOutput) {
-			return fmt.Errorf("verify output did not match expected output, got %d expected %d", out, _interface.VerifyChallengeOutput(*verifyChallengeOutput))
+		name := strings.TrimSuffix(filepath.Base(wasmFile), ".wasm")
+
+		for _, m := range modes {
+			switch m {
+			case ModeTest:
+				if len(cases) == 0 {
+					panic("no test cases found")
+				}
+				func() {
+					runner := wasm.NewRunner(*nativeCompiler)
+					defer runner.Close()
+
+					err = runner.Compile(name, wasmData)
+					if err != nil {
+						panic(err)
+					}
+					failed += RunConformance(wasm.RunnerBackend{Runner: runner, Key: name}, name, cases)
+				}()
+			case ModeBench:
+				err = RunBenchmark(name, wasmData, cases, *benchTime)
+				if err != nil {
+					fmt.Printf("FAIL\t%s/bench: %s\n", name, err)
+					failed++
+				}
+			case ModeFuzz:
+				func() {
+					runner := wasm.NewRunner(*nativeCompiler)
+					defer runner.Close()
+
+					err = runner.Compile(name, wasmData)
+					if err != nil {
+						panic(err)
+					}
+					n, err := RunFuzz(runner, name, cases, FuzzSettings{
+						Iterations:  *fuzzIterations,
+						Seed:        *fuzzSeed,
+						Timeout:     *fuzzTimeout,
+						MemoryLimit: uint32(*fuzzMemoryLimit) * 1024 * 1024,
+					})
+					failed += n
+					if err != nil {
+						fmt.Printf("FAIL\t%s/fuzz: %s\n", name, err)
+						// calls may still be running, cannot continue
+						os.Exit(1)
+					}
+				}()
+			case ModeCompare:
+				nativeBackend, ok := native.Runtimes[*nativeRuntime]
+				if !ok {
+					panic(fmt.Errorf("unknown native runtime %s", *nativeRuntime))
+				}
+				func() {
+					runner := wasm.NewRunner(*nativeCompiler)
+					defer runner.Close()
+
+					err = runner.Compile(name, wasmData)
+					if err != nil {
+						panic(err)
+					}
+					failed += RunConformance(nativeBackend, name+"/native", cases)
+					failed += RunCompare(wasm.RunnerBackend{Runner: runner, Key: name}, nativeBackend, name, cases, *fuzzIterations, *fuzzSeed)
+				}()
+			default:
+				panic(fmt.Errorf("unknown mode %s", m))
+			}
 		}
-		return nil
-	})
-	if err != nil {
-		panic(err)
 	}
 
+	if failed > 0 {
+		fmt.Printf("FAIL\t%d failures\n", failed)
+		os.Exit(1)
+	}
+	fmt.Println("ok")
 }
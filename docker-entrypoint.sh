@@ -12,6 +12,7 @@ if [ $# -eq 0 ] || [ "${1#-}" != "$1" ]; then
                 --challenge-template "${GOAWAY_CHALLENGE_TEMPLATE}" \
                 --challenge-template-logo "${GOAWAY_CHALLENGE_TEMPLATE_LOGO}" \
                 --challenge-template-theme "${GOAWAY_CHALLENGE_TEMPLATE_THEME}" \
+                --challenge-directory "${GOAWAY_CHALLENGE_DIRECTORY}" \
                 --slog-level "${GOAWAY_SLOG_LEVEL}" \
                 --acme-autocert "${GOAWAY_ACME_AUTOCERT}" \
                 --backend "${GOAWAY_BACKEND}" \
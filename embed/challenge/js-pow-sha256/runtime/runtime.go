@@ -15,25 +15,31 @@ func main() {
 
 }
 
-func getChallenge(key []byte, params map[string]string) ([]byte, uint64) {
+func getChallenge(key []byte, params map[string]string) ([]byte, uint64, error) {
 	difficulty := uint64(20)
 	var err error
 	if diffStr, ok := params["difficulty"]; ok {
+		// panics trap the module, return errors instead
 		difficulty, err = strconv.ParseUint(diffStr, 10, 64)
 		if err != nil {
-			panic(err)
+			return nil, 0, err
 		}
 	}
 	hasher := sha256.New()
 	hasher.Write(binary.LittleEndian.AppendUint64(nil, difficulty))
 	hasher.Write(key)
-	return hasher.Sum(nil), difficulty
+	return hasher.Sum(nil), difficulty, nil
 }
 
 //go:wasmexport MakeChallenge
 func MakeChallenge(in _interface.Allocation) (out _interface.Allocation) {
 	return _interface.MakeChallengeDecode(func(in _interface.MakeChallengeInput, out *_interface.MakeChallengeOutput) {
-		c, difficulty := getChallenge(in.Key, in.Parameters)
+		c, difficulty, err := getChallenge(in.Key, in.Parameters)
+		if err != nil {
+			out.Code = 500
+			out.Error = err.Error()
+			return
+		}
 
 		// create target
 		target := make([]byte, len(c))
@@ -65,7 +71,10 @@ func MakeChallenge(in _interface.Allocation) (out _interface.Allocation) {
 //go:wasmexport VerifyChallenge
 func VerifyChallenge(in _interface.Allocation) (out _interface.VerifyChallengeOutput) {
 	return _interface.VerifyChallengeDecode(func(in _interface.VerifyChallengeInput) _interface.VerifyChallengeOutput {
-		c, difficulty := getChallenge(in.Key, in.Parameters)
+		c, difficulty, err := getChallenge(in.Key, in.Parameters)
+		if err != nil {
+			return _interface.VerifyChallengeOutputError
+		}
 
 		result := make([]byte, inline.DecodedLen(len(in.Result)))
 		n, err := inline.Decode(result, in.Result)
@@ -132,8 +132,7 @@ func (a Challenge) Handle(logger *slog.Logger, w http.ResponseWriter, r *http.Re
 	}
 	// none matched, issue challenges in sequential priority
 	for _, reg := range a.Challenges {
-		result := data.ChallengeVerify[reg.Id()]
-		state := data.ChallengeState[reg.Id()]
+		result, state := data.ChallengeResult(reg)
 		if result.Ok() || result == challenge.VerifyResultSkip || state == challenge.VerifyStatePass {
 			// skip already ok'd challenges for some reason (TODO: why)
 			// also skip skipped challenges due to preconditions
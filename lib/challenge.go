@@ -1,13 +1,22 @@
 package lib
 
 import (
+	_ "git.gammaspectra.live/git/go-away/lib/challenge/api-key"
+	_ "git.gammaspectra.live/git/go-away/lib/challenge/composite"
 	_ "git.gammaspectra.live/git/go-away/lib/challenge/cookie"
 	_ "git.gammaspectra.live/git/go-away/lib/challenge/dnsbl"
 	_ "git.gammaspectra.live/git/go-away/lib/challenge/http"
+	_ "git.gammaspectra.live/git/go-away/lib/challenge/interactive"
+	_ "git.gammaspectra.live/git/go-away/lib/challenge/native"
+	_ "git.gammaspectra.live/git/go-away/lib/challenge/oidc"
 	_ "git.gammaspectra.live/git/go-away/lib/challenge/preload-link"
+	_ "git.gammaspectra.live/git/go-away/lib/challenge/privacy-pass"
 	_ "git.gammaspectra.live/git/go-away/lib/challenge/refresh"
 	_ "git.gammaspectra.live/git/go-away/lib/challenge/resource-load"
+	_ "git.gammaspectra.live/git/go-away/lib/challenge/signed-url"
+	_ "git.gammaspectra.live/git/go-away/lib/challenge/tls-client-cert"
 	_ "git.gammaspectra.live/git/go-away/lib/challenge/wasm"
+	_ "git.gammaspectra.live/git/go-away/lib/challenge/web-bot-auth"
 )
 
 // This file loads embedded challenge runtimes so their init() is called
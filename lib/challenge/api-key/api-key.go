@@ -0,0 +1,183 @@
+package api_key
+
+import (
+	"crypto/subtle"
+	"errors"
+	"git.gammaspectra.live/git/go-away/lib/challenge"
+	"git.gammaspectra.live/git/go-away/utils"
+	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/ast"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	challenge.Runtimes[Key] = FillRegistration
+}
+
+const Key = "api-key"
+
+type Parameters struct {
+	// KeysFile Path to YAML file with a list of hashed keys, reloaded on change
+	KeysFile string `yaml:"keys-file"`
+
+	// Header Request header the key is read from. Empty to disable
+	Header string `yaml:"header"`
+
+	// HeaderScheme If set, scheme that is required and removed from the header value, for example Bearer
+	HeaderScheme string `yaml:"header-scheme"`
+
+	// QueryArg Query argument the key is read from. Empty to disable
+	// Arguments prefixed with __goaway_ are not forwarded to the backend
+	QueryArg string `yaml:"query-arg"`
+
+	// BackendHeader Request header the key name is forwarded to the backend as. Empty to disable
+	BackendHeader string `yaml:"backend-header"`
+}
+
+var DefaultParameters = Parameters{
+	Header:        "Authorization",
+	HeaderScheme:  "Bearer",
+	BackendHeader: "X-Away-Api-Key",
+}
+
+func FillRegistration(state challenge.StateInterface, reg *challenge.Registration, parameters ast.Node) error {
+	params := DefaultParameters
+
+	if parameters != nil {
+		ymlData, err := parameters.MarshalYAML()
+		if err != nil {
+			return err
+		}
+		err = yaml.Unmarshal(ymlData, &params)
+		if err != nil {
+			return err
+		}
+	}
+
+	if params.KeysFile == "" {
+		return errors.New("no keys-file")
+	}
+	if params.Header == "" && params.QueryArg == "" {
+		return errors.New("one of header or query-arg is required")
+	}
+
+	var keys atomic.Pointer[keySet]
+	if k, err := loadKeys(params.KeysFile); err != nil {
+		return err
+	} else {
+		keys.Store(&k)
+	}
+
+	watcher, err := utils.NewFileWatcher(time.Second*5, func() {
+		k, err := loadKeys(params.KeysFile)
+		if err != nil {
+			slog.Error("error reloading api keys", "challenge", reg.Name, "path", params.KeysFile, "error", err)
+			return
+		}
+		keys.Store(&k)
+		slog.Info("reloaded api keys", "challenge", reg.Name, "path", params.KeysFile, "keys", len(k))
+	}, params.KeysFile)
+	if err != nil {
+		return err
+	}
+	reg.Object = watcher
+
+	reg.Class = challenge.ClassTransparent
+
+	if params.BackendHeader != "" {
+		reg.BackendHeaders = map[string]string{
+			params.BackendHeader: "name",
+		}
+	}
+
+	// keys are not forwarded to the backend
+	reg.StripCredentials = func(r *http.Request) {
+		if params.Header != "" {
+			if params.HeaderScheme == "" {
+				r.Header.Del(params.Header)
+			} else if scheme, _, ok := strings.Cut(r.Header.Get(params.Header), " "); ok && strings.EqualFold(scheme, params.HeaderScheme) {
+				// other schemes might be meant for the backend
+				r.Header.Del(params.Header)
+			}
+		}
+		if params.QueryArg != "" {
+			if rawQ, err := utils.ParseRawQuery(r.URL.RawQuery); err == nil && rawQ.Has(params.QueryArg) {
+				rawQ.Del(params.QueryArg)
+				r.URL.RawQuery = utils.EncodeRawQuery(rawQ)
+			}
+		}
+	}
+
+	getKey := func(r *http.Request) string {
+		if params.Header != "" {
+			if v := r.Header.Get(params.Header); v != "" {
+				if params.HeaderScheme == "" {
+					return v
+				}
+				scheme, value, ok := strings.Cut(v, " ")
+				if ok && strings.EqualFold(scheme, params.HeaderScheme) {
+					return strings.TrimSpace(value)
+				}
+			}
+		}
+		if params.QueryArg != "" {
+			if v := r.URL.Query().Get(params.QueryArg); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+
+	// lookup Finds a valid key entry for the request
+	lookup := func(r *http.Request) (entry KeyEntry, hash []byte, ok bool) {
+		k := getKey(r)
+		if k == "" {
+			return KeyEntry{}, nil, false
+		}
+		entry, sum, ok := (*keys.Load()).Get(k)
+		if !ok || !entry.InScope(r.Host, r.URL.Path, time.Now()) {
+			return KeyEntry{}, nil, false
+		}
+		return entry, sum[:], true
+	}
+
+	// keys can expire or be removed, and can be scoped, always check against the current request
+	reg.VerifyProbability = 1
+	reg.Verify = func(key challenge.Key, token []byte, r *http.Request) (challenge.VerifyResult, error) {
+		_, hash, ok := lookup(r)
+		if !ok || subtle.ConstantTimeCompare(hash, token) != 1 {
+			return challenge.VerifyResultFail, nil
+		}
+		return challenge.VerifyResultOK, nil
+	}
+
+	reg.IssueChallenge = func(w http.ResponseWriter, r *http.Request, key challenge.Key, expiry time.Time) challenge.VerifyResult {
+		if getKey(r) == "" {
+			// skip requests without key
+			return challenge.VerifyResultSkip
+		}
+
+		entry, hash, ok := lookup(r)
+		if !ok {
+			state.Logger(r).Debug("invalid api key", "challenge", reg.Name)
+			return challenge.VerifyResultFail
+		}
+
+		if !entry.Expiry.IsZero() && entry.Expiry.Before(expiry) {
+			expiry = entry.Expiry
+		}
+
+		data := challenge.RequestDataFromContext(r.Context())
+		data.IssueChallengeToken(reg, key, hash, expiry, true)
+		_ = data.SetChallengeData(reg, map[string]any{
+			"name": entry.Name,
+		})
+		return challenge.VerifyResultOK
+	}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package api_key
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/goccy/go-yaml"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// KeyEntry An API key as configured on the keys file
+type KeyEntry struct {
+	// Name Identity of the key holder, exposed to conditions and backend
+	Name string `yaml:"name"`
+
+	// Hash Hex encoded SHA-256 of the key
+	Hash string `yaml:"hash"`
+
+	// Expiry Key is not valid after this time. Zero value never expires
+	Expiry time.Time `yaml:"expiry"`
+
+	// Hosts If set, key is only valid for these hosts
+	Hosts []string `yaml:"hosts"`
+
+	// Paths If set, key is only valid for paths with these prefixes
+	Paths []string `yaml:"paths"`
+}
+
+// InScope Checks whether the entry is valid for the given host and path at this time
+func (e KeyEntry) InScope(host, path string, now time.Time) bool {
+	if !e.Expiry.IsZero() && now.After(e.Expiry) {
+		return false
+	}
+	if len(e.Hosts) > 0 && !slices.Contains(e.Hosts, host) {
+		return false
+	}
+	if len(e.Paths) > 0 && !slices.ContainsFunc(e.Paths, func(prefix string) bool {
+		return strings.HasPrefix(path, prefix)
+	}) {
+		return false
+	}
+	return true
+}
+
+type keySet map[[sha256.Size]byte]KeyEntry
+
+func (s keySet) Get(key string) (KeyEntry, [sha256.Size]byte, bool) {
+	sum := HashKey(key)
+	e, ok := s[sum]
+	return e, sum, ok
+}
+
+func HashKey(key string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(key))
+}
+
+func loadKeys(path string) (keySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []KeyEntry
+	err = yaml.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(keySet, len(entries))
+	for i, e := range entries {
+		if e.Name == "" {
+			return nil, fmt.Errorf("key %d: missing name", i)
+		}
+		hash, err := hex.DecodeString(e.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", e.Name, err)
+		}
+		if len(hash) != sha256.Size {
+			return nil, fmt.Errorf("key %s: %w", e.Name, errors.New("invalid hash length"))
+		}
+		keys[[sha256.Size]byte(hash)] = e
+	}
+	return keys, nil
+}
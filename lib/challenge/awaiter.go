@@ -2,16 +2,51 @@ package challenge
 
 import (
 	"context"
+	"fmt"
+	"git.gammaspectra.live/git/go-away/utils"
 	"github.com/alphadose/haxmap"
 	"sync/atomic"
 )
 
 type awaiterCallback func(result VerifyResult)
 
-type Awaiter[K ~string | ~int64 | ~uint64] haxmap.Map[K, awaiterCallback]
+// Awaiter Allows waiting for a result solved elsewhere, such as a separate request
+// If shared state is used, results solved on other replicas are received as well
+type Awaiter[K ~string | ~int64 | ~uint64] struct {
+	m *haxmap.Map[string, awaiterCallback]
+
+	shared      utils.SharedState
+	channel     string
+	unsubscribe func()
+}
 
 func NewAwaiter[T ~string | ~int64 | ~uint64]() *Awaiter[T] {
-	return (*Awaiter[T])(haxmap.New[T, awaiterCallback]())
+	return &Awaiter[T]{
+		m: haxmap.New[string, awaiterCallback](),
+	}
+}
+
+// NewSharedAwaiter Results are published on channel of shared state. If shared is nil, same as NewAwaiter
+func NewSharedAwaiter[T ~string | ~int64 | ~uint64](shared utils.SharedState, channel string) (*Awaiter[T], error) {
+	a := NewAwaiter[T]()
+	if shared == nil {
+		return a, nil
+	}
+	a.shared = shared
+	a.channel = channel
+
+	var err error
+	a.unsubscribe, err = shared.Subscribe(channel, func(message []byte) {
+		// result, followed by key
+		if len(message) < 1 {
+			return
+		}
+		a.solve(string(message[1:]), VerifyResult(message[0]))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
 }
 
 func (a *Awaiter[T]) Await(key T, ctx context.Context) VerifyResult {
@@ -20,12 +55,13 @@ func (a *Awaiter[T]) Await(key T, ctx context.Context) VerifyResult {
 
 	var result atomic.Int64
 
-	a.m().Set(key, func(receivedResult VerifyResult) {
+	k := fmt.Sprint(key)
+	a.m.Set(k, func(receivedResult VerifyResult) {
 		result.Store(int64(receivedResult))
 		cancel()
 	})
 	// cleanup
-	defer a.m().Del(key)
+	defer a.m.Del(k)
 
 	<-ctx.Done()
 
@@ -33,15 +69,27 @@ func (a *Awaiter[T]) Await(key T, ctx context.Context) VerifyResult {
 }
 
 func (a *Awaiter[T]) Solve(key T, result VerifyResult) {
-	if f, ok := a.m().GetAndDel(key); ok && f != nil {
-		f(result)
+	k := fmt.Sprint(key)
+	if a.shared != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), utils.DefaultSharedStateTimeout)
+		defer cancel()
+		if err := a.shared.Publish(ctx, a.channel, append([]byte{byte(result)}, k...)); err == nil {
+			// received via subscription
+			return
+		}
 	}
+	a.solve(k, result)
 }
 
-func (a *Awaiter[T]) m() *haxmap.Map[T, awaiterCallback] {
-	return (*haxmap.Map[T, awaiterCallback])(a)
+func (a *Awaiter[T]) solve(key string, result VerifyResult) {
+	if f, ok := a.m.GetAndDel(key); ok && f != nil {
+		f(result)
+	}
 }
 
 func (a *Awaiter[T]) Close() error {
+	if a.unsubscribe != nil {
+		a.unsubscribe()
+	}
 	return nil
 }
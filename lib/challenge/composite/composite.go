@@ -0,0 +1,163 @@
+package composite
+
+import (
+	"errors"
+	"fmt"
+	"git.gammaspectra.live/git/go-away/lib/challenge"
+	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/ast"
+	"net/http"
+	"slices"
+	"time"
+)
+
+func init() {
+	challenge.Runtimes[Key] = FillRegistration
+}
+
+const Key = "composite"
+
+const (
+	ModeAll  = "all"
+	ModeAny  = "any"
+	ModeKOfN = "k-of-n"
+)
+
+type Parameters struct {
+	// Challenges Names of member challenges
+	Challenges []string `yaml:"challenges"`
+
+	// Mode One of all, any or k-of-n
+	Mode string `yaml:"mode"`
+
+	// Required Number of member challenges that must pass on k-of-n mode
+	Required int `yaml:"required"`
+}
+
+var DefaultParameters = Parameters{
+	Mode: ModeAll,
+}
+
+func FillRegistration(state challenge.StateInterface, reg *challenge.Registration, parameters ast.Node) error {
+	params := DefaultParameters
+
+	if parameters != nil {
+		ymlData, err := parameters.MarshalYAML()
+		if err != nil {
+			return err
+		}
+		err = yaml.Unmarshal(ymlData, &params)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(params.Challenges) == 0 {
+		return errors.New("no challenges")
+	}
+	if slices.Contains(params.Challenges, reg.Name) {
+		return errors.New("challenge cannot include itself")
+	}
+
+	switch params.Mode {
+	case ModeAll:
+		params.Required = len(params.Challenges)
+	case ModeAny:
+		params.Required = 1
+	case ModeKOfN:
+		if params.Required < 1 || params.Required > len(params.Challenges) {
+			return fmt.Errorf("required must be between 1 and %d", len(params.Challenges))
+		}
+	default:
+		return fmt.Errorf("unknown mode %s", params.Mode)
+	}
+
+	// members might serve a challenge page, transparent results are never Fail so rules can continue
+	reg.Class = challenge.ClassBlocking
+
+	// members are resolved once all challenges are registered, as these are registered in no particular order
+	reg.Members = params.Challenges
+	var members []*challenge.Registration
+	reg.Resolve = func() error {
+		members = members[:0]
+		for _, name := range params.Challenges {
+			m, ok := state.GetChallengeByName(name)
+			if !ok {
+				return fmt.Errorf("member challenge %s not found", name)
+			}
+			members = append(members, m)
+		}
+		// try transparent members first, blocking ones can only be issued one at a time
+		slices.SortStableFunc(members, func(a, b *challenge.Registration) int {
+			return int(a.Class) - int(b.Class)
+		})
+		return nil
+	}
+
+	reg.IssueChallenge = func(w http.ResponseWriter, r *http.Request, key challenge.Key, expiry time.Time) challenge.VerifyResult {
+		data := challenge.RequestDataFromContext(r.Context())
+		logger := state.Logger(r)
+
+		var passed int
+		var pending []*challenge.Registration
+		for _, m := range members {
+			result, verifyState := data.ChallengeResult(m)
+			if result.Ok() {
+				passed++
+			} else if result != challenge.VerifyResultSkip && verifyState != challenge.VerifyStatePass {
+				// not skipped due to preconditions, or issued already on this request
+				pending = append(pending, m)
+			}
+		}
+
+		for _, m := range pending {
+			if passed >= params.Required {
+				break
+			}
+
+			if m.Class != challenge.ClassTransparent {
+				// blocking members are issued only if enough can still pass
+				var blocking int
+				for _, p := range pending {
+					if p.Class != challenge.ClassTransparent && data.ChallengeState[p.Id()] != challenge.VerifyStatePass {
+						blocking++
+					}
+				}
+				if passed+blocking < params.Required {
+					break
+				}
+			}
+
+			memberExpiry := data.Expiration(m.Duration)
+			memberKey := challenge.GetChallengeKeyForRequest(state, m, memberExpiry, r)
+			result := m.IssueChallenge(w, r, memberKey, memberExpiry)
+			if result != challenge.VerifyResultSkip {
+				state.ChallengeIssued(r, m, r.URL.String(), logger)
+			}
+			data.ChallengeVerify[m.Id()] = result
+			data.ChallengeState[m.Id()] = challenge.VerifyStatePass
+
+			switch result {
+			case challenge.VerifyResultOK:
+				state.ChallengePassed(r, m, r.URL.String(), logger)
+				passed++
+			case challenge.VerifyResultFail:
+				state.ChallengeFailed(r, m, fmt.Errorf("challenge %s failed on issuance", m.Name), r.URL.String(), logger)
+			case challenge.VerifyResultNone:
+				if m.Class != challenge.ClassTransparent {
+					// member challenge was served, composite is checked again once it is passed
+					return challenge.VerifyResultNone
+				}
+			}
+		}
+
+		if passed < params.Required {
+			return challenge.VerifyResultNotOK
+		}
+
+		data.IssueChallengeToken(reg, key, nil, expiry, true)
+		return challenge.VerifyResultOK
+	}
+
+	return nil
+}
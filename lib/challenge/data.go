@@ -7,6 +7,7 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"git.gammaspectra.live/git/go-away/utils"
@@ -54,8 +55,17 @@ type RequestData struct {
 	cookieName      string
 	issuedChallenge string
 
+	// sessionId Current session, if using a session store
+	sessionId string
+
+	// tokenSharedCount Highest number of distinct clients presenting the same token, across presented tokens
+	tokenSharedCount int64
+
 	ExtraHeaders http.Header
 
+	// challengeData Values exposed by challenges to conditions, by challenge name
+	challengeData map[string]map[string]any
+
 	r *http.Request
 
 	fp     map[string]string
@@ -77,6 +87,7 @@ func CreateRequestData(r *http.Request, state StateInterface) (*http.Request, *R
 	data.State = state
 
 	data.ExtraHeaders = make(http.Header)
+	data.challengeData = make(map[string]map[string]any)
 
 	data.fp = make(map[string]string, 2)
 
@@ -135,6 +146,14 @@ func (d *RequestData) ResolveName(name string) (any, bool) {
 		return d.header, true
 	case "fp":
 		return d.fp, true
+	case "challengeData":
+		d.EvaluateChallenges()
+		return d.challengeData, true
+	case "token":
+		d.EvaluateChallenges()
+		return map[string]int64{
+			"sharedCount": d.tokenSharedCount,
+		}, true
 	default:
 		return nil, false
 	}
@@ -144,19 +163,32 @@ func (d *RequestData) Parent() cel.Activation {
 	return nil
 }
 
+// NetworkPrefix Client network, as a /24 for IPv4 or a /64 for IPv6
 func (d *RequestData) NetworkPrefix() netip.Addr {
+	return d.networkPrefix(DefaultKeyIPv4Prefix, DefaultKeyIPv6Prefix)
+}
+
+// networkPrefix Client network with the given prefix lengths.
+// If both are zero, the unspecified address is returned so IPv4 and IPv6 clients share the same one
+func (d *RequestData) networkPrefix(ipv4, ipv6 int) netip.Addr {
+	if ipv4 == 0 && ipv6 == 0 {
+		return netip.Addr{}
+	}
 	address := d.RemoteAddress.Addr().Unmap()
 	if address.Is4() {
-		// Take a /24 for IPv4
-		prefix, _ := address.Prefix(24)
+		prefix, _ := address.Prefix(ipv4)
 		return prefix.Addr()
 	} else {
-		// Take a /64 for IPv6
-		prefix, _ := address.Prefix(64)
+		prefix, _ := address.Prefix(ipv6)
 		return prefix.Addr()
 	}
 }
 
+// stateNetworkPrefix Client network the state cookie is bound to, loosest across all challenges
+func (d *RequestData) stateNetworkPrefix() netip.Addr {
+	return d.networkPrefix(d.State.GetChallenges().KeyPrefixes())
+}
+
 const (
 	RequestOptBackendHost       = "backend-host"
 	RequestOptProxyMetaTags     = "proxy-meta-tags"
@@ -201,21 +233,79 @@ func (d *RequestData) BackendHost() (http.Handler, string) {
 }
 
 func (d *RequestData) ClearChallengeToken(reg *Registration) {
-	delete(d.ChallengeMap, reg.Name)
+	delete(d.loadChallengeMap(), reg.Name)
+	delete(d.challengeData, reg.Name)
 	d.challengeMapModified = true
 }
 
 func (d *RequestData) IssueChallengeToken(reg *Registration, key Key, result []byte, until time.Time, ok bool) {
-	d.ChallengeMap[reg.Name] = TokenChallenge{
+	d.loadChallengeMap()[reg.Name] = TokenChallenge{
 		Key:      key[:],
 		Result:   result,
 		Ok:       ok,
 		Expiry:   jwt.NumericDate(until.Unix()),
 		IssuedAt: jwt.NumericDate(time.Now().UTC().Unix()),
+		Id:       rand.Text(),
 	}
 	d.challengeMapModified = true
 }
 
+// renewChallengeToken Reissues token with a later expiry if within the renewal window of reg,
+// keeping the key and result it was issued for
+func (d *RequestData) renewChallengeToken(reg *Registration, token TokenChallenge) {
+	if reg.RenewWindow <= 0 || token.Expiry.Time().Sub(d.Time) > time.Duration(float64(reg.Duration)*reg.RenewWindow) {
+		return
+	}
+
+	until := d.Time.Add(reg.Duration)
+	if reg.MaxLifetime > 0 {
+		if maxUntil := token.originIssuedAt().Add(reg.MaxLifetime); maxUntil.Before(until) {
+			until = maxUntil
+		}
+	}
+	if !until.After(token.Expiry.Time()) {
+		// reached max lifetime
+		return
+	}
+
+	d.IssueChallengeToken(reg, Key(token.Key), token.Result, until, token.Ok)
+	renewed := d.ChallengeMap[reg.Name]
+	renewed.Data = token.Data
+	renewed.Id = token.Id
+	renewed.KeyExpiry = jwt.NumericDate(token.keyExpiry().Unix())
+	renewed.OriginIssuedAt = jwt.NumericDate(token.originIssuedAt().Unix())
+	d.ChallengeMap[reg.Name] = renewed
+}
+
+// SetChallengeData Exposes values to conditions under challengeData[reg.Name]
+// Values are kept along the challenge token if one has been issued before via IssueChallengeToken, so should be small
+func (d *RequestData) SetChallengeData(reg *Registration, values map[string]any) error {
+	// normalize types so they match the ones decoded from token
+	buf, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	var normalized map[string]any
+	if err = json.Unmarshal(buf, &normalized); err != nil {
+		return err
+	}
+
+	d.challengeData[reg.Name] = normalized
+	if token, ok := d.loadChallengeMap()[reg.Name]; ok {
+		token.Data = normalized
+		d.ChallengeMap[reg.Name] = token
+		d.challengeMapModified = true
+	}
+	return nil
+}
+
+// ChallengeData Values exposed by challenge reg, if any
+func (d *RequestData) ChallengeData(reg *Registration) (map[string]any, bool) {
+	d.ChallengeResult(reg)
+	values, ok := d.challengeData[reg.Name]
+	return values, ok
+}
+
 var ErrVerifyKeyMismatch = errors.New("verify: key mismatch")
 var ErrVerifyVerifyMismatch = errors.New("verify: verification mismatch")
 var ErrTokenExpired = errors.New("token: expired")
@@ -227,11 +317,22 @@ func (d *RequestData) VerifyChallengeToken(reg *Registration, token TokenChallen
 	if token.NotBefore.Time().Compare(time.Now()) > 0 {
 		return VerifyResultFail, VerifyStateNone, errors.New("token not valid yet")
 	}
+	if reg.MaxLifetime > 0 && token.originIssuedAt().Add(reg.MaxLifetime).Compare(time.Now()) < 0 {
+		return VerifyResultFail, VerifyStateNone, ErrTokenExpired
+	}
 
 	if bytes.Compare(expectedKey[:], token.Key) != 0 {
 		return VerifyResultFail, VerifyStateNone, ErrVerifyKeyMismatch
 	}
 
+	if reg.Reuse != nil {
+		sharedCount, revoked := reg.Reuse.Observe(d, token)
+		d.tokenSharedCount = max(d.tokenSharedCount, sharedCount)
+		if revoked {
+			return VerifyResultFail, VerifyStateFull, ErrTokenReused
+		}
+	}
+
 	if reg.Verify != nil {
 		if unsaferand.Float64() < reg.VerifyProbability {
 			// random spot check
@@ -260,10 +361,16 @@ func (d *RequestData) verifyChallenge(reg *Registration, key Key) (verifyResult
 		verifyResult = VerifyResultFail
 		verifyState = VerifyStateNone
 	} else {
+		if reg.RenewWindow > 0 {
+			// renewable tokens are bound to the key of their own period, not the current one
+			key = GetChallengeKeyForRequest(d.State, reg, token.keyExpiry(), d.r)
+		}
 		verifyResult, verifyState, err = d.VerifyChallengeToken(reg, token, key)
 		if err != nil && !errors.Is(err, http.ErrNoCookie) {
 			// clear invalid state
 			d.ClearChallengeToken(reg)
+		} else if (verifyResult.Ok() || verifyResult == VerifyResultNotOK) && token.Data != nil {
+			d.challengeData[reg.Name] = token.Data
 		}
 
 		// prevent evaluating the challenge if not solved
@@ -290,7 +397,11 @@ func (d *RequestData) verifyChallenge(reg *Registration, key Key) (verifyResult
 	return verifyResult, verifyState, err
 }
 
-func (d *RequestData) EvaluateChallenges(w http.ResponseWriter, r *http.Request) {
+// loadChallengeMap Verifies the challenge state sent by the client, once per request
+func (d *RequestData) loadChallengeMap() TokenChallengeMap {
+	if d.ChallengeMap != nil {
+		return d.ChallengeMap
+	}
 
 	challengeMap, err := d.verifyChallengeState()
 	if err != nil {
@@ -301,18 +412,56 @@ func (d *RequestData) EvaluateChallenges(w http.ResponseWriter, r *http.Request)
 		challengeMap = make(TokenChallengeMap)
 	}
 	d.ChallengeMap = challengeMap
+	return d.ChallengeMap
+}
 
-	for _, reg := range d.State.GetChallenges() {
+// ChallengeResult Verifies challenge reg for this request, on first use
+// Results are kept for the rest of the request, including the ones set on issuance
+func (d *RequestData) ChallengeResult(reg *Registration) (VerifyResult, VerifyState) {
+	if result, ok := d.ChallengeVerify[reg.Id()]; ok {
+		return result, d.ChallengeState[reg.Id()]
+	}
+	// reg.Condition might refer back to this challenge via challengeData
+	d.ChallengeVerify[reg.Id()] = VerifyResultNone
+	d.ChallengeState[reg.Id()] = VerifyStateNone
 
-		key := GetChallengeKeyForRequest(d.State, reg, d.Expiration(reg.Duration), r)
-		verifyResult, verifyState, err := d.verifyChallenge(reg, key)
-		if err != nil {
-			// clear invalid state
-			d.ClearChallengeToken(reg)
+	d.loadChallengeMap()
+
+	key := GetChallengeKeyForRequest(d.State, reg, d.Expiration(reg.Duration), d.r)
+	verifyResult, verifyState, err := d.verifyChallenge(reg, key)
+	token, ok := d.ChallengeMap[reg.Name]
+	if err != nil {
+		// clear invalid state
+		d.ClearChallengeToken(reg)
+	} else if ok && verifyState == VerifyStateFull && (verifyResult.Ok() || verifyResult == VerifyResultNotOK) && verifyResult.Ok() != token.Ok {
+		// full verification disagrees with token, so the challenge is issued again with current values
+		d.ClearChallengeToken(reg)
+	} else if ok && verifyResult.Ok() {
+		d.renewChallengeToken(reg, token)
+	}
+
+	d.ChallengeVerify[reg.Id()] = verifyResult
+	d.ChallengeState[reg.Id()] = verifyState
+	return verifyResult, verifyState
+}
+
+// EvaluateBackendChallenges Verifies challenges that set backend headers, if the client sent challenge state.
+// Their headers are then forwarded on requests that pass without verifying them, such as allowed ones
+func (d *RequestData) EvaluateBackendChallenges() {
+	if _, err := d.r.Cookie(d.cookieName); err != nil {
+		return
+	}
+	for _, reg := range d.State.GetChallenges() {
+		if len(reg.BackendHeaders) > 0 {
+			d.ChallengeResult(reg)
 		}
+	}
+}
 
-		d.ChallengeVerify[reg.Id()] = verifyResult
-		d.ChallengeState[reg.Id()] = verifyState
+// EvaluateChallenges Verifies all challenges not yet verified on this request
+func (d *RequestData) EvaluateChallenges() {
+	for _, reg := range d.State.GetChallenges() {
+		d.ChallengeResult(reg)
 	}
 }
 
@@ -321,7 +470,12 @@ func (d *RequestData) Expiration(duration time.Duration) time.Time {
 }
 
 func (d *RequestData) HasValidChallenge(id Id) bool {
-	return d.ChallengeVerify[id].Ok()
+	reg, ok := d.State.GetChallenge(id)
+	if !ok {
+		return false
+	}
+	result, _ := d.ChallengeResult(reg)
+	return result.Ok()
 }
 
 func (d *RequestData) ResponseHeaders(w http.ResponseWriter) {
@@ -338,8 +492,14 @@ func (d *RequestData) ResponseHeaders(w http.ResponseWriter) {
 
 	if d.challengeMapModified {
 		expiration := d.Expiration(DefaultDuration)
-		if token, err := d.issueChallengeState(expiration); err == nil {
-			utils.SetCookie(d.cookieName, token, expiration, w, d.r)
+		if d.State.Settings().Sessions != nil {
+			if err := d.issueChallengeStateSession(expiration); err == nil {
+				d.State.Settings().Cookie.Set(d.cookieName, d.sessionId, expiration, w, d.r)
+			} else {
+				d.State.Logger(d.r).Error("error while storing session", "error", err)
+			}
+		} else if token, err := d.issueChallengeState(expiration); err == nil {
+			d.State.Settings().Cookie.Set(d.cookieName, token, expiration, w, d.r)
 		} else {
 			d.State.Logger(d.r).Error("error while issuing cookie", "error", err)
 		}
@@ -347,8 +507,28 @@ func (d *RequestData) ResponseHeaders(w http.ResponseWriter) {
 }
 
 func (d *RequestData) RequestHeaders(headers http.Header) {
+	// never trust client sent values of headers set by challenges
+	for _, reg := range d.State.GetChallenges() {
+		values := d.challengeData[reg.Name]
+		passed := d.ChallengeVerify[reg.Id()].Ok()
+		// challenges might not have been verified on this request
+		headers.Del(fmt.Sprintf("X-Away-Challenge-%s-Result", reg.Name))
+		headers.Del(fmt.Sprintf("X-Away-Challenge-%s-State", reg.Name))
+		for header, name := range reg.BackendHeaders {
+			headers.Del(header)
+			if v, ok := values[name]; ok && passed {
+				headers.Set(header, headerValue(v))
+			}
+		}
+	}
+
 	headers.Set("X-Away-Id", d.Id.String())
 
+	headers.Del("X-Away-Session")
+	if d.sessionId != "" {
+		headers.Set("X-Away-Session", d.sessionId)
+	}
+
 	if d.State.Settings().BackendIpHeader != "" {
 		if d.State.Settings().ClientIpHeader != "" {
 			headers.Del(d.State.Settings().ClientIpHeader)
@@ -379,6 +559,33 @@ func (d *RequestData) RequestHeaders(headers http.Header) {
 	maps.Copy(headers, d.ExtraHeaders)
 }
 
+// headerValue Formats a challengeData value as a header value, lists are joined by commas
+func headerValue(v any) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case []any:
+		values := make([]string, 0, len(t))
+		for _, e := range t {
+			values = append(values, fmt.Sprintf("%v", e))
+		}
+		return strings.Join(values, ",")
+	case nil:
+		return ""
+	default:
+		return fmt.Sprintf("%v", t)
+	}
+}
+
+// StripCredentials Removes credentials read by challenges from a request towards the backend
+func (d *RequestData) StripCredentials(r *http.Request) {
+	for _, reg := range d.State.GetChallenges() {
+		if reg.StripCredentials != nil {
+			reg.StripCredentials(r)
+		}
+	}
+}
+
 type Token struct {
 	State TokenChallengeMap `json:"state"`
 
@@ -394,13 +601,40 @@ type TokenChallenge struct {
 	Result []byte `json:"result,omitempty"`
 	Ok     bool   `json:"ok"`
 
+	// Data Values exposed to conditions, see RequestData.SetChallengeData
+	Data map[string]any `json:"data,omitempty"`
+
 	Expiry    jwt.NumericDate `json:"exp,omitempty"`
 	NotBefore jwt.NumericDate `json:"nbf,omitempty"`
 	IssuedAt  jwt.NumericDate `json:"iat,omitempty"`
+
+	// Id Random value set on issuance and kept on renewal, so tokens for the same key and result differ
+	Id string `json:"jti,omitempty"`
+
+	// KeyExpiry Expiry Key was generated for, if the token has been renewed past it
+	KeyExpiry jwt.NumericDate `json:"kexp,omitempty"`
+	// OriginIssuedAt When the token was first issued, if it has been renewed
+	OriginIssuedAt jwt.NumericDate `json:"oat,omitempty"`
+}
+
+// keyExpiry Expiry Key was generated for
+func (t TokenChallenge) keyExpiry() time.Time {
+	if t.KeyExpiry != 0 {
+		return t.KeyExpiry.Time()
+	}
+	return t.Expiry.Time()
+}
+
+// originIssuedAt When the token was first issued, before any renewals
+func (t TokenChallenge) originIssuedAt() time.Time {
+	if t.OriginIssuedAt != 0 {
+		return t.OriginIssuedAt.Time()
+	}
+	return t.IssuedAt.Time()
 }
 
 func (d *RequestData) verifyChallengeStateCookie(cookie *http.Cookie) (TokenChallengeMap, error) {
-	cookie, err := d.r.Cookie(d.cookieName)
+	cookie, err := d.r.Cookie(d.State.Settings().Cookie.Name(d.cookieName))
 	if err != nil {
 		return nil, err
 	}
@@ -415,12 +649,36 @@ func (d *RequestData) verifyChallengeStateCookie(cookie *http.Cookie) (TokenChal
 	if err != nil {
 		return nil, err
 	}
-	signedToken, err := encryptedToken.Decrypt(d.cookieKey())
-	if err != nil {
-		return nil, err
+
+	now := time.Now()
+	keys := d.State.SigningKeys()
+
+	// select key via kid, or try all keys for state issued without one
+	var candidates []*utils.SigningKey
+	if len(encryptedToken.Headers) > 0 && encryptedToken.Headers[0].KeyID != "" {
+		if k := keys.Get(encryptedToken.Headers[0].KeyID); k != nil {
+			candidates = append(candidates, k)
+		}
+	} else {
+		candidates = keys.Keys
 	}
+
 	var i Token
-	err = signedToken.Claims(d.State.PublicKey(), &i)
+	err = errors.New("no valid key found")
+	for _, k := range candidates {
+		if !k.Valid(now) {
+			continue
+		}
+		var signedToken *jwt.JSONWebToken
+		signedToken, err = encryptedToken.Decrypt(d.cookieKey(k))
+		if err != nil {
+			continue
+		}
+		err = signedToken.Claims(k.PublicKey, &i)
+		if err == nil {
+			break
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -435,11 +693,37 @@ func (d *RequestData) verifyChallengeStateCookie(cookie *http.Cookie) (TokenChal
 	return i.State, nil
 }
 
+// verifyChallengeStateSession Loads state from the session store, by the session id held in cookie
+func (d *RequestData) verifyChallengeStateSession(cookie *http.Cookie) (TokenChallengeMap, error) {
+	if !utils.ValidSessionId(cookie.Value) {
+		return nil, utils.ErrSessionNotFound
+	}
+	data, err := d.State.Settings().Sessions.Get(cookie.Value)
+	if err != nil {
+		return nil, err
+	}
+	var state TokenChallengeMap
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	d.sessionId = cookie.Value
+	return state, nil
+}
+
 func (d *RequestData) verifyChallengeState() (state TokenChallengeMap, err error) {
-	cookies := d.r.CookiesNamed(d.cookieName)
+	cookies := d.r.CookiesNamed(d.State.Settings().Cookie.Name(d.cookieName))
 	if len(cookies) == 0 {
 		return nil, http.ErrNoCookie
 	}
+	if d.State.Settings().Sessions != nil {
+		for _, cookie := range cookies {
+			state, err = d.verifyChallengeStateSession(cookie)
+			if err == nil {
+				return state, nil
+			}
+		}
+		return state, err
+	}
 	for _, cookie := range cookies {
 		state, err = d.verifyChallengeStateCookie(cookie)
 		if err == nil {
@@ -449,18 +733,33 @@ func (d *RequestData) verifyChallengeState() (state TokenChallengeMap, err error
 	return state, err
 }
 
+// issueChallengeStateSession Stores state on the session store, under a new session if none was loaded
+func (d *RequestData) issueChallengeStateSession(until time.Time) error {
+	data, err := json.Marshal(d.ChallengeMap)
+	if err != nil {
+		return err
+	}
+	if d.sessionId == "" {
+		d.sessionId = utils.NewSessionId()
+	}
+	return d.State.Settings().Sessions.Set(d.sessionId, data, until)
+}
+
 func (d *RequestData) issueChallengeState(until time.Time) (string, error) {
+	key := d.State.SigningKeys().Active()
+
 	signer, err := jose.NewSigner(jose.SigningKey{
 		Algorithm: jose.EdDSA,
-		Key:       d.State.PrivateKey(),
-	}, nil)
+		Key:       key.PrivateKey,
+	}, (&jose.SignerOptions{}).WithHeader(jose.HeaderKey("kid"), key.Id))
 	if err != nil {
 		return "", err
 	}
 
 	encrypter, err := jose.NewEncrypter(jose.A256GCM, jose.Recipient{
 		Algorithm: jose.DIRECT,
-		Key:       d.cookieKey(),
+		Key:       d.cookieKey(key),
+		KeyID:     key.Id,
 	}, (&jose.EncrypterOptions{
 		Compression: jose.DEFLATE,
 	}).WithContentType("JWT"))
@@ -476,13 +775,14 @@ func (d *RequestData) issueChallengeState(until time.Time) (string, error) {
 	}).Serialize()
 }
 
-func (d *RequestData) cookieKey() []byte {
+func (d *RequestData) cookieKey(key *utils.SigningKey) []byte {
 	sum := sha256.New()
-	sum.Write([]byte(d.r.Host))
+	// shared across subdomains of challenge domains
+	sum.Write([]byte(d.State.Settings().Cookie.Domain(d.r.Host)))
 	sum.Write([]byte{0})
-	sum.Write(d.NetworkPrefix().AsSlice())
+	sum.Write(d.stateNetworkPrefix().AsSlice())
 	sum.Write([]byte{0})
-	sum.Write(d.State.PrivateKey())
+	sum.Write(key.PrivateKey)
 	sum.Write([]byte{0})
 	// version/compressor
 	sum.Write([]byte("1.0/DEFLATE"))
@@ -493,9 +793,10 @@ func (d *RequestData) cookieKey() []byte {
 
 func (d *RequestData) cookieHostKey() []byte {
 	sum := sha256.New()
-	sum.Write([]byte(d.r.Host))
+	// shared across subdomains of challenge domains
+	sum.Write([]byte(d.State.Settings().Cookie.Domain(d.r.Host)))
 	sum.Write([]byte{0})
-	sum.Write(d.NetworkPrefix().AsSlice())
+	sum.Write(d.stateNetworkPrefix().AsSlice())
 	sum.Write([]byte{0})
 
 	return sum.Sum(nil)[:6]
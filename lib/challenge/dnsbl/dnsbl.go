@@ -7,8 +7,11 @@ import (
 	"git.gammaspectra.live/git/go-away/utils"
 	"github.com/goccy/go-yaml"
 	"github.com/goccy/go-yaml/ast"
+	"log/slog"
 	"net"
 	"net/http"
+	"slices"
+	"sync"
 	"time"
 )
 
@@ -18,11 +21,31 @@ func init() {
 
 const Key = "dnsbl"
 
+type ListParameters struct {
+	Host string `yaml:"host"`
+
+	// ZoneFile Path to a local rbldnsd ip4set or ip6trie zone file, used instead of host. Reloaded on change
+	ZoneFile string `yaml:"zone-file"`
+
+	// Weight Added to score when the list returns a mapped code
+	Weight float64 `yaml:"weight"`
+
+	// Codes Maps last octet of returned A records to their meaning.
+	// If empty, any listed code counts as a hit
+	Codes map[uint8]string `yaml:"codes"`
+}
+
 type Parameters struct {
 	VerifyProbability float64       `yaml:"verify-probability"`
 	Host              string        `yaml:"dnsbl-host"`
 	Timeout           time.Duration `yaml:"dnsbl-timeout"`
 	Decay             time.Duration `yaml:"dnsbl-decay"`
+
+	// Lists Lists to query in parallel. If empty, dnsbl-host is used with weight 1
+	Lists []ListParameters `yaml:"dnsbl-lists"`
+
+	// Threshold Challenge fails when the aggregate score of hits reaches this value
+	Threshold float64 `yaml:"dnsbl-threshold"`
 }
 
 var DefaultParameters = Parameters{
@@ -30,26 +53,93 @@ var DefaultParameters = Parameters{
 	Timeout:           time.Second * 1,
 	Decay:             time.Hour * 1,
 	Host:              "dnsbl.dronebl.org",
+	Threshold:         1,
+}
+
+type lookuper interface {
+	LookupAll(ctx context.Context, ip net.IP) ([]utils.DNSBLResponse, error)
+}
+
+type list struct {
+	ListParameters
+	dnsbl lookuper
 }
 
-func lookup(ctx context.Context, decay, timeout time.Duration, dnsbl *utils.DNSBL, decayMap *utils.DecayMap[[net.IPv6len]byte, utils.DNSBLResponse], ip net.IP) (utils.DNSBLResponse, error) {
+// Name Host or zone file identifying the list
+func (l list) Name() string {
+	if l.ZoneFile != "" {
+		return l.ZoneFile
+	}
+	return l.Host
+}
+
+// result Aggregate of all list lookups
+type result struct {
+	Score float64
+	// Hits Meanings of matched codes per list
+	Hits map[string][]string
+	// Messages TXT messages of matched zone file entries per list
+	Messages map[string]string
+}
+
+func lookup(ctx context.Context, decay, timeout time.Duration, lists []list, decayMap *utils.StateMap[[net.IPv6len]byte, result], ip net.IP) (result, error) {
 	var key [net.IPv6len]byte
 	copy(key[:], ip.To16())
 
-	result, ok := decayMap.Get(key)
+	res, ok := decayMap.Get(key)
 	if ok {
-		return result, nil
+		return res, nil
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
-	result, err := dnsbl.Lookup(ctx, ip)
-	if err != nil {
 
+	responses := make([][]utils.DNSBLResponse, len(lists))
+	errs := make([]error, len(lists))
+	var wg sync.WaitGroup
+	for i, l := range lists {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i], errs[i] = l.dnsbl.LookupAll(ctx, ip)
+		}()
+	}
+	wg.Wait()
+
+	res.Hits = make(map[string][]string)
+	res.Messages = make(map[string]string)
+	for i, l := range lists {
+		var meanings []string
+		for _, code := range responses[i] {
+			if len(l.Codes) == 0 {
+				if code.Bad() {
+					meanings = append(meanings, "listed")
+				}
+			} else if meaning, ok := l.Codes[uint8(code)]; ok && !slices.Contains(meanings, meaning) {
+				meanings = append(meanings, meaning)
+			}
+		}
+		if len(meanings) > 0 {
+			res.Hits[l.Name()] = meanings
+			res.Score += l.Weight
+			if zone, ok := l.dnsbl.(*utils.DNSBLZone); ok {
+				if _, text, ok := zone.LookupEntry(ip); ok && text != "" {
+					res.Messages[l.Name()] = text
+				}
+			}
+		}
 	}
-	decayMap.Set(key, result, decay)
 
-	return result, err
+	decayMap.Set(key, res, decay)
+
+	var dnsErr *net.DNSError
+	for _, err := range errs {
+		// not listed is reported as not found
+		if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+			return res, err
+		}
+	}
+	return res, nil
 }
 
 type closer chan struct{}
@@ -77,8 +167,59 @@ func FillRegistration(state challenge.StateInterface, reg *challenge.Registratio
 		}
 	}
 
-	if params.Host == "" {
-		return errors.New("empty host")
+	if len(params.Lists) == 0 {
+		if params.Host == "" {
+			return errors.New("empty host")
+		}
+		params.Lists = []ListParameters{{Host: params.Host, Weight: 1}}
+	}
+
+	resolver := &net.Resolver{
+		PreferGo: true,
+	}
+
+	ob := make(closer)
+
+	var lists []list
+	for _, l := range params.Lists {
+		if l.Weight == 0 {
+			l.Weight = 1
+		}
+		switch {
+		case l.ZoneFile != "":
+			zone, err := utils.NewDNSBLZone(l.ZoneFile)
+			if err != nil {
+				_ = ob.Close()
+				return err
+			}
+			watcher, err := utils.NewFileWatcher(time.Second*5, func() {
+				if err := zone.Load(); err != nil {
+					slog.Error("error reloading dnsbl zone", "challenge", reg.Name, "path", l.ZoneFile, "error", err)
+					return
+				}
+				slog.Info("reloaded dnsbl zone", "challenge", reg.Name, "path", l.ZoneFile)
+			}, l.ZoneFile)
+			if err != nil {
+				_ = ob.Close()
+				return err
+			}
+			go func() {
+				<-ob
+				_ = watcher.Close()
+			}()
+			lists = append(lists, list{
+				ListParameters: l,
+				dnsbl:          zone,
+			})
+		case l.Host != "":
+			lists = append(lists, list{
+				ListParameters: l,
+				dnsbl:          utils.NewDNSBL(l.Host, resolver),
+			})
+		default:
+			_ = ob.Close()
+			return errors.New("empty host")
+		}
 	}
 
 	reg.Class = challenge.ClassTransparent
@@ -91,13 +232,7 @@ func FillRegistration(state challenge.StateInterface, reg *challenge.Registratio
 	}
 	reg.VerifyProbability = params.VerifyProbability
 
-	decayMap := utils.NewDecayMap[[net.IPv6len]byte, utils.DNSBLResponse]()
-
-	dnsbl := utils.NewDNSBL(params.Host, &net.Resolver{
-		PreferGo: true,
-	})
-
-	ob := make(closer)
+	decayMap := utils.NewStateMap[[net.IPv6len]byte, result](state.Settings().SharedState, "go-away:dnsbl:"+reg.Name+":")
 
 	go func() {
 		ticker := time.NewTicker(params.Timeout / 3)
@@ -119,16 +254,22 @@ func FillRegistration(state challenge.StateInterface, reg *challenge.Registratio
 
 		data := challenge.RequestDataFromContext(r.Context())
 
-		result, err := lookup(r.Context(), params.Decay, params.Timeout, dnsbl, decayMap, data.RemoteAddress.Addr().Unmap().AsSlice())
+		res, err := lookup(r.Context(), params.Decay, params.Timeout, lists, decayMap, data.RemoteAddress.Addr().Unmap().AsSlice())
 		if err != nil {
-			data.State.Logger(r).Debug("dnsbl lookup failed", "address", data.RemoteAddress.Addr().String(), "result", result, "err", err)
+			data.State.Logger(r).Debug("dnsbl lookup failed", "address", data.RemoteAddress.Addr().String(), "result", res, "err", err)
 		}
 
-		if result.Bad() {
-			data.IssueChallengeToken(reg, key, nil, expiry, false)
+		ok := res.Score < params.Threshold
+		data.IssueChallengeToken(reg, key, nil, expiry, ok)
+		_ = data.SetChallengeData(reg, map[string]any{
+			"score":    res.Score,
+			"hits":     res.Hits,
+			"messages": res.Messages,
+		})
+
+		if !ok {
 			return challenge.VerifyResultNotOK
 		} else {
-			data.IssueChallengeToken(reg, key, nil, expiry, true)
 			return challenge.VerifyResultOK
 		}
 	}
@@ -5,9 +5,12 @@ import (
 	"crypto/subtle"
 	"errors"
 	"git.gammaspectra.live/git/go-away/lib/challenge"
+	"git.gammaspectra.live/git/go-away/utils"
 	"github.com/goccy/go-yaml"
 	"github.com/goccy/go-yaml/ast"
 	"io"
+	"maps"
+	unsaferand "math/rand/v2"
 	"net/http"
 	"slices"
 	"time"
@@ -26,6 +29,30 @@ type Parameters struct {
 	HttpCode   int    `yaml:"http-code"`
 	HttpCookie string `yaml:"http-cookie"`
 	Url        string `yaml:"http-url"`
+
+	// HttpCookies If set, only these cookies are forwarded. Challenge is skipped if none are present
+	HttpCookies []string `yaml:"http-cookies"`
+
+	// HttpHeaders If set, only these headers are forwarded, instead of all client headers.
+	// Tokens are bound to the values of forwarded cookies and headers, as with http-cookie
+	HttpHeaders []string `yaml:"http-headers"`
+
+	// PassCodes Response status codes that pass the challenge. Defaults to http-code
+	PassCodes []int `yaml:"pass-codes"`
+
+	// FailCodes Response status codes that fail the challenge.
+	// If empty, any code not in pass-codes or skip-codes fails, otherwise other codes are treated as errors and retried
+	FailCodes []int `yaml:"fail-codes"`
+
+	// SkipCodes Response status codes that skip the challenge, for example when no credentials were given
+	SkipCodes []int `yaml:"skip-codes"`
+
+	// ResponseHeaders Headers from the response to set towards the backend, and names they are exposed to conditions as.
+	// Tokens are issued again when values change on a verification
+	ResponseHeaders map[string]string `yaml:"response-headers"`
+
+	// CacheDuration How long results are cached for per client key and credentials. Zero disables caching
+	CacheDuration time.Duration `yaml:"cache-duration"`
 }
 
 var DefaultParameters = Parameters{
@@ -34,6 +61,26 @@ var DefaultParameters = Parameters{
 	HttpCode:          http.StatusOK,
 }
 
+var ErrCredentialsChanged = errors.New("credentials changed")
+var ErrResponseHeadersChanged = errors.New("response headers changed")
+
+// result Outcome of a subrequest
+type result struct {
+	Result  challenge.VerifyResult
+	Headers map[string]string
+}
+
+type closer chan struct{}
+
+func (c closer) Close() error {
+	select {
+	case <-c:
+	default:
+		close(c)
+	}
+	return nil
+}
+
 func FillRegistration(state challenge.StateInterface, reg *challenge.Registration, parameters ast.Node) error {
 	params := DefaultParameters
 
@@ -52,6 +99,10 @@ func FillRegistration(state challenge.StateInterface, reg *challenge.Registratio
 		return errors.New("empty url")
 	}
 
+	if len(params.PassCodes) == 0 {
+		params.PassCodes = []int{params.HttpCode}
+	}
+
 	reg.Class = challenge.ClassTransparent
 
 	bindAuthValue := func(key challenge.Key, r *http.Request) ([]byte, error) {
@@ -77,55 +128,125 @@ func FillRegistration(state challenge.StateInterface, reg *challenge.Registratio
 	} else if params.VerifyProbability > 1.0 {
 		params.VerifyProbability = 1.0
 	}
-	reg.VerifyProbability = params.VerifyProbability
 
-	if params.HttpCookie != "" {
-		// re-verify the cookie value
-		// TODO: configure to verify with backend
-		reg.Verify = func(key challenge.Key, token []byte, r *http.Request) (challenge.VerifyResult, error) {
-			sum, err := bindAuthValue(key, r)
-			if err != nil {
-				return challenge.VerifyResultFail, err
+	var cache *utils.StateMap[[sha256.Size]byte, result]
+	if params.CacheDuration > 0 {
+		cache = utils.NewStateMap[[sha256.Size]byte, result](state.Settings().SharedState, "go-away:http:"+reg.Name+":")
+
+		ob := make(closer)
+		go func() {
+			ticker := time.NewTicker(params.CacheDuration)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					cache.Decay()
+				case <-ob:
+					return
+				}
 			}
-			if subtle.ConstantTimeCompare(sum, token) == 1 {
-				return challenge.VerifyResultOK, nil
+		}()
+
+		// allow freeing the ticker/decay map
+		reg.Object = ob
+	}
+
+	var excludeHeaders = []string{"Host", "Content-Length", "Upgrade", "Accept-Encoding", "Range"}
+
+	// buildRequest Creates the subrequest, and returns a key identifying the client and forwarded credentials
+	buildRequest := func(key challenge.Key, r *http.Request) (request *http.Request, cacheKey [sha256.Size]byte, err error) {
+		request, err = http.NewRequest(params.HttpMethod, params.Url, nil)
+		if err != nil {
+			return nil, cacheKey, err
+		}
+
+		if len(params.HttpHeaders) > 0 {
+			for _, k := range params.HttpHeaders {
+				k = http.CanonicalHeaderKey(k)
+				if v, ok := r.Header[k]; ok && !slices.Contains(excludeHeaders, k) && (k != "Cookie" || len(params.HttpCookies) == 0) {
+					request.Header[k] = v
+				}
+			}
+		} else {
+			for k, v := range r.Header {
+				if slices.Contains(excludeHeaders, k) || (k == "Cookie" && len(params.HttpCookies) > 0) {
+					// skip these parameters
+					continue
+				}
+				request.Header[k] = v
 			}
-			return challenge.VerifyResultFail, errors.New("invalid cookie value")
 		}
-	}
 
-	reg.IssueChallenge = func(w http.ResponseWriter, r *http.Request, key challenge.Key, expiry time.Time) challenge.VerifyResult {
-		var sum []byte
-		if params.HttpCookie != "" {
-			if c, err := r.Cookie(params.HttpCookie); err != nil || c == nil {
-				// skip check if we don't have cookie or it's expired
-				return challenge.VerifyResultSkip
-			} else {
-				sum, err = bindAuthValue(key, r)
-				if err != nil {
-					return challenge.VerifyResultFail
+		if len(params.HttpCookies) > 0 {
+			for _, name := range params.HttpCookies {
+				if c, err := r.Cookie(name); err == nil && c != nil {
+					request.AddCookie(c)
 				}
 			}
 		}
 
-		data := challenge.RequestDataFromContext(r.Context())
+		hasher := sha256.New()
+		hasher.Write(key[:])
+		hasher.Write([]byte{0})
+		identityHeaders := params.HttpHeaders
+		if len(identityHeaders) == 0 {
+			identityHeaders = []string{"Authorization"}
+		}
+		for _, k := range append([]string{"Cookie"}, identityHeaders...) {
+			values := request.Header.Values(k)
+			if http.CanonicalHeaderKey(k) == "Cookie" {
+				// go-away cookies change as tokens are issued, and must not change the key
+				values = nil
+				for _, c := range request.Cookies() {
+					if !state.Settings().Cookie.IsOwn(c.Name) {
+						values = append(values, c.String())
+					}
+				}
+			}
+			hasher.Write([]byte(k))
+			hasher.Write([]byte{0})
+			for _, v := range values {
+				hasher.Write([]byte(v))
+				hasher.Write([]byte{1})
+			}
+			hasher.Write([]byte{0})
+		}
+		cacheKey = [sha256.Size]byte(hasher.Sum(nil))
 
-		request, err := http.NewRequest(params.HttpMethod, params.Url, nil)
+		return request, cacheKey, nil
+	}
+
+	// bindValue Returns the value tokens are bound to, the hash of the checked credentials. Nil if not bound
+	bindValue := func(key challenge.Key, r *http.Request) ([]byte, error) {
+		if params.HttpCookie != "" {
+			return bindAuthValue(key, r)
+		}
+		if len(params.HttpCookies) > 0 || len(params.HttpHeaders) > 0 {
+			// bind hash of forwarded cookies and headers
+			_, cacheKey, err := buildRequest(key, r)
+			if err != nil {
+				return nil, err
+			}
+			return cacheKey[:], nil
+		}
+		return nil, nil
+	}
+
+	// check Does the subrequest, or returns a cached result
+	check := func(key challenge.Key, r *http.Request) (result, error) {
+		request, cacheKey, err := buildRequest(key, r)
 		if err != nil {
-			return challenge.VerifyResultFail
+			return result{Result: challenge.VerifyResultFail}, err
 		}
 
-		var excludeHeaders = []string{"Host", "Content-Length", "Upgrade", "Accept-Encoding", "Range"}
-		for k, v := range r.Header {
-			if slices.Contains(excludeHeaders, k) {
-				// skip these parameters
-				continue
+		if cache != nil {
+			if res, ok := cache.Get(cacheKey); ok {
+				return res, nil
 			}
-			request.Header[k] = v
 		}
 
 		// set id, ip, and other headers
-		data.RequestHeaders(request.Header)
+		challenge.RequestDataFromContext(r.Context()).RequestHeaders(request.Header)
 
 		// set request info in X headers
 		request.Header.Set("X-Away-Method", r.Method)
@@ -135,17 +256,126 @@ func FillRegistration(state challenge.StateInterface, reg *challenge.Registratio
 
 		response, err := state.Client().Do(request)
 		if err != nil {
-			return challenge.VerifyResultFail
+			return result{Result: challenge.VerifyResultFail}, err
 		}
 		defer response.Body.Close()
 		defer io.Copy(io.Discard, response.Body)
 
-		if response.StatusCode != params.HttpCode {
-			data.IssueChallengeToken(reg, key, sum, expiry, false)
-			return challenge.VerifyResultNotOK
-		} else {
+		var res result
+		switch {
+		case slices.Contains(params.PassCodes, response.StatusCode):
+			res.Result = challenge.VerifyResultOK
+			res.Headers = make(map[string]string, len(params.ResponseHeaders))
+			for header := range params.ResponseHeaders {
+				if v := response.Header.Get(header); v != "" {
+					res.Headers[header] = v
+				}
+			}
+		case slices.Contains(params.SkipCodes, response.StatusCode):
+			res.Result = challenge.VerifyResultSkip
+		case len(params.FailCodes) == 0 || slices.Contains(params.FailCodes, response.StatusCode):
+			res.Result = challenge.VerifyResultNotOK
+		default:
+			// unexpected status, do not cache
+			return result{Result: challenge.VerifyResultFail}, errors.New("unexpected status code")
+		}
+
+		if cache != nil {
+			cache.Set(cacheKey, res, params.CacheDuration)
+		}
+		return res, nil
+	}
+
+	// mapped response headers are forwarded from the token, see challenge.RequestData.RequestHeaders
+	reg.BackendHeaders = params.ResponseHeaders
+
+	challengeData := func(res result) map[string]any {
+		values := make(map[string]any, len(res.Headers))
+		for header, v := range res.Headers {
+			values[params.ResponseHeaders[header]] = v
+		}
+		return values
+	}
+
+	// Verify checks the bound cookie on every request, and verifies against backend at verify-probability
+	reg.VerifyProbability = 1
+	reg.Verify = func(key challenge.Key, token []byte, r *http.Request) (challenge.VerifyResult, error) {
+		data := challenge.RequestDataFromContext(r.Context())
+
+		// re-verify the cookie value or credentials
+		sum, err := bindValue(key, r)
+		if err != nil {
+			return challenge.VerifyResultFail, err
+		}
+		if sum != nil && subtle.ConstantTimeCompare(sum, token) != 1 {
+			return challenge.VerifyResultFail, ErrCredentialsChanged
+		}
+
+		if unsaferand.Float64() >= params.VerifyProbability {
+			if !data.ChallengeMap[reg.Name].Ok {
+				return challenge.VerifyResultNotOK, nil
+			}
+			return challenge.VerifyResultOK, nil
+		}
+
+		// random spot check with backend, a token that no longer passes is marked by the caller
+		res, err := check(key, r)
+		if err != nil {
+			return challenge.VerifyResultFail, err
+		}
+		switch res.Result {
+		case challenge.VerifyResultOK:
+			if !maps.Equal(data.ChallengeMap[reg.Name].Data, challengeData(res)) {
+				// token is issued again with current response headers
+				return challenge.VerifyResultFail, ErrResponseHeadersChanged
+			}
+			return res.Result, nil
+		case challenge.VerifyResultNotOK:
+			return res.Result, nil
+		default:
+			return challenge.VerifyResultFail, nil
+		}
+	}
+
+	reg.IssueChallenge = func(w http.ResponseWriter, r *http.Request, key challenge.Key, expiry time.Time) challenge.VerifyResult {
+		if params.HttpCookie != "" {
+			if c, err := r.Cookie(params.HttpCookie); err != nil || c == nil {
+				// skip check if we don't have cookie or it's expired
+				return challenge.VerifyResultSkip
+			}
+		}
+
+		if len(params.HttpCookies) > 0 && !slices.ContainsFunc(params.HttpCookies, func(name string) bool {
+			c, err := r.Cookie(name)
+			return err == nil && c != nil
+		}) {
+			// skip check if we don't have any cookie
+			return challenge.VerifyResultSkip
+		}
+
+		sum, err := bindValue(key, r)
+		if err != nil {
+			return challenge.VerifyResultFail
+		}
+
+		data := challenge.RequestDataFromContext(r.Context())
+
+		res, err := check(key, r)
+		if err != nil {
+			state.Logger(r).Debug("http challenge subrequest failed", "challenge", reg.Name, "error", err)
+			return challenge.VerifyResultFail
+		}
+
+		switch res.Result {
+		case challenge.VerifyResultOK:
 			data.IssueChallengeToken(reg, key, sum, expiry, true)
+			_ = data.SetChallengeData(reg, challengeData(res))
 			return challenge.VerifyResultOK
+		case challenge.VerifyResultSkip:
+			return challenge.VerifyResultSkip
+		default:
+			data.IssueChallengeToken(reg, key, sum, expiry, false)
+			return challenge.VerifyResultNotOK
 		}
 	}
 
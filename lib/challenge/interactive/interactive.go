@@ -0,0 +1,179 @@
+package interactive
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"git.gammaspectra.live/git/go-away/lib/challenge"
+	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/ast"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+func init() {
+	challenge.Runtimes["interactive"] = FillRegistration
+}
+
+type Parameters struct {
+	// MinimumDwellTime Minimum time between the challenge page being issued and the form being submitted
+	MinimumDwellTime time.Duration `yaml:"min-dwell-time"`
+
+	// MaximumAge Maximum time between the challenge page being issued and the form being submitted
+	MaximumAge time.Duration `yaml:"max-age"`
+
+	// HoneypotField Name of a hidden form field that must be left empty
+	HoneypotField string `yaml:"honeypot-field"`
+}
+
+var DefaultParameters = Parameters{
+	MinimumDwellTime: time.Second * 2,
+	MaximumAge:       time.Minute * 30,
+	HoneypotField:    "email",
+}
+
+var ErrInvalidNonce = errors.New("invalid nonce")
+var ErrNonceExpired = errors.New("nonce expired, reload the page")
+var ErrNotInteractive = errors.New("challenge was not submitted via the form")
+
+const nonceSize = 8 + sha256.Size
+
+// signNonce Returns a nonce of issue time followed by its signature with key
+// The key is derived from the private key and is never exposed for this challenge
+func signNonce(key challenge.Key, issued time.Time) []byte {
+	nonce := binary.BigEndian.AppendUint64(make([]byte, 0, nonceSize), uint64(issued.UTC().UnixMilli()))
+
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte("interactive\x00"))
+	mac.Write(nonce)
+	return mac.Sum(nonce)
+}
+
+func verifyNonce(key challenge.Key, token []byte) (issued time.Time, err error) {
+	nonce := make([]byte, hex.DecodedLen(len(token)))
+	n, err := hex.Decode(nonce, token)
+	if err != nil {
+		return time.Time{}, err
+	}
+	nonce = nonce[:n]
+	if len(nonce) != nonceSize {
+		return time.Time{}, ErrInvalidNonce
+	}
+
+	issued = time.UnixMilli(int64(binary.BigEndian.Uint64(nonce)))
+	if !hmac.Equal(nonce, signNonce(key, issued)) {
+		return time.Time{}, ErrInvalidNonce
+	}
+	return issued, nil
+}
+
+var formTemplate = template.Must(template.New("form").Parse(`
+<form method="post" action="{{ .Action }}">
+	<input type="hidden" name="{{ .TokenField }}" value="{{ .Nonce }}"/>
+	<div style="position: absolute; left: -10000px; top: auto; width: 1px; height: 1px; overflow: hidden;" aria-hidden="true">
+		<label>{{ .HoneypotField }} <input type="text" name="{{ .HoneypotField }}" value="" tabindex="-1" autocomplete="off"/></label>
+	</div>
+	<button type="submit" role="button" class="ui small primary button">{{ .Button }}</button>
+</form>
+`))
+
+func FillRegistration(state challenge.StateInterface, reg *challenge.Registration, parameters ast.Node) error {
+	params := DefaultParameters
+
+	if parameters != nil {
+		ymlData, err := parameters.MarshalYAML()
+		if err != nil {
+			return err
+		}
+		err = yaml.Unmarshal(ymlData, &params)
+		if err != nil {
+			return err
+		}
+	}
+
+	reg.Class = challenge.ClassBlocking
+
+	// Verify is also used to spot check issued tokens, so only signature and dwell time are checked here
+	reg.Verify = func(key challenge.Key, token []byte, r *http.Request) (challenge.VerifyResult, error) {
+		issued, err := verifyNonce(key, token)
+		if err != nil {
+			return challenge.VerifyResultFail, err
+		}
+		if issued.Add(params.MinimumDwellTime).After(time.Now()) {
+			// submitted too quickly
+			return challenge.VerifyResultFail, nil
+		}
+		return challenge.VerifyResultOK, nil
+	}
+
+	reg.IssueChallenge = func(w http.ResponseWriter, r *http.Request, key challenge.Key, expiry time.Time) challenge.VerifyResult {
+		// token is sent via form instead
+		uri, err := challenge.VerifyUrl(r, reg, "")
+		if err != nil {
+			return challenge.VerifyResultFail
+		}
+
+		buf := bytes.NewBuffer(make([]byte, 0, 1024))
+		err = formTemplate.Execute(buf, map[string]any{
+			"Action":        uri.String(),
+			"TokenField":    challenge.QueryArgToken,
+			"Nonce":         hex.EncodeToString(signNonce(key, time.Now())),
+			"HoneypotField": params.HoneypotField,
+			"Button":        state.Strings().Get("button_continue"),
+		})
+		if err != nil {
+			return challenge.VerifyResultFail
+		}
+
+		state.ChallengePage(w, r, state.Settings().ChallengeResponseCode, reg, map[string]any{
+			"Status": state.Strings().Get("status_interactive_challenge"),
+			"BodyTags": []template.HTML{
+				template.HTML(buf.String()),
+			},
+		})
+		return challenge.VerifyResultNone
+	}
+
+	verifyHandler := challenge.VerifyHandlerFunc(state, reg, func(key challenge.Key, token []byte, r *http.Request) (challenge.VerifyResult, error) {
+		if r.PostFormValue(params.HoneypotField) != "" {
+			return challenge.VerifyResultFail, nil
+		}
+
+		issued, err := verifyNonce(key, token)
+		if err != nil {
+			return challenge.VerifyResultFail, err
+		}
+		if issued.Add(params.MaximumAge).Before(time.Now()) {
+			return challenge.VerifyResultFail, ErrNonceExpired
+		}
+
+		return reg.Verify(key, token, r)
+	}, nil)
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("POST "+reg.Path+challenge.VerifyChallengeUrlSuffix, func(w http.ResponseWriter, r *http.Request) {
+		// move token from form into query, where VerifyHandlerFunc reads it
+		token := r.PostFormValue(challenge.QueryArgToken)
+		if token == "" {
+			state.ErrorPage(w, r, http.StatusBadRequest, ErrNotInteractive, "")
+			return
+		}
+		q := r.URL.Query()
+		q.Set(challenge.QueryArgToken, token)
+		uri := *r.URL
+		uri.RawQuery = q.Encode()
+
+		r = r.Clone(r.Context())
+		r.URL = &uri
+		verifyHandler(w, r)
+	})
+
+	reg.Handler = mux
+
+	return nil
+}
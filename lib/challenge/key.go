@@ -5,7 +5,9 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"maps"
 	"net/http"
+	"slices"
 	"time"
 )
 
@@ -47,7 +49,7 @@ func GetChallengeKeyForRequest(state StateInterface, reg *Registration, until ti
 	hasher.Write([]byte("challenge\x00"))
 	hasher.Write([]byte(reg.Name))
 	hasher.Write([]byte{0})
-	keyAddr := data.NetworkPrefix().As16()
+	keyAddr := data.networkPrefix(reg.KeyIPv4Prefix, reg.KeyIPv6Prefix).As16()
 	hasher.Write(keyAddr[:])
 	hasher.Write([]byte{0})
 
@@ -71,9 +73,31 @@ func GetChallengeKeyForRequest(state StateInterface, reg *Registration, until ti
 
 	sum[0] = 0
 
-	if data.RemoteAddress.Addr().Unmap().Is4() {
+	if data.RemoteAddress.Addr().Unmap().Is4() && (reg.KeyIPv4Prefix != 0 || reg.KeyIPv6Prefix != 0) {
 		// Is IPv4, mark
 		sum.Set(KeyFlagIsIPv4)
 	}
 	return Key(sum)
 }
+
+// BindKeyParameters Derives a key from an existing one that is also bound to the given parameters
+// Used when challenge parameters are decided per request, so these cannot be altered by the client on verification
+func BindKeyParameters(key Key, parameters map[string]string) Key {
+	hasher := sha256.New()
+	hasher.Write([]byte("parameters\x00"))
+	hasher.Write(key[:])
+	hasher.Write([]byte{0})
+	for _, k := range slices.Sorted(maps.Keys(parameters)) {
+		hasher.Write([]byte(k))
+		hasher.Write([]byte{0})
+		hasher.Write([]byte(parameters[k]))
+		hasher.Write([]byte{0})
+	}
+	hasher.Write([]byte{0})
+
+	sum := Key(hasher.Sum(nil))
+
+	// keep flags from original key
+	sum[0] = key[0]
+	return sum
+}
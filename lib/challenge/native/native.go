@@ -0,0 +1,71 @@
+package native
+
+import (
+	"fmt"
+	"git.gammaspectra.live/git/go-away/lib/challenge"
+	"git.gammaspectra.live/git/go-away/lib/challenge/wasm"
+	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/ast"
+	"io/fs"
+	"maps"
+	"slices"
+)
+
+func init() {
+	challenge.Runtimes["native"] = FillNativeRegistration
+}
+
+// Runtime A challenge runtime implemented in Go, following the same interface as WASM runtimes
+// It is served under the same routes as the js runtime, without WASM marshalling and instantiation costs
+type Runtime interface {
+	wasm.Backend
+
+	// Static Assets served under static/, must contain the js loader
+	Static() (fs.FS, error)
+}
+
+// Runtimes Registered native runtimes by name
+var Runtimes = make(map[string]Runtime)
+
+// Parameters Same as js runtime parameters, with Runtime selecting a native runtime by name
+// wasm-runtime and wasm-native-compiler are ignored
+type Parameters struct {
+	Runtime string `yaml:"native-runtime"`
+
+	wasm.Parameters `yaml:",inline"`
+}
+
+var DefaultParameters = Parameters{
+	Parameters: wasm.DefaultParameters,
+}
+
+func FillNativeRegistration(state challenge.StateInterface, reg *challenge.Registration, parameters ast.Node) error {
+	params := DefaultParameters
+
+	if parameters != nil {
+		ymlData, err := parameters.MarshalYAML()
+		if err != nil {
+			return err
+		}
+		err = yaml.Unmarshal(ymlData, &params)
+		if err != nil {
+			return err
+		}
+	}
+
+	if params.Runtime == "" {
+		params.Runtime = reg.Name
+	}
+
+	runtime, ok := Runtimes[params.Runtime]
+	if !ok {
+		return fmt.Errorf("unknown native runtime %s, available: %v", params.Runtime, slices.Sorted(maps.Keys(Runtimes)))
+	}
+
+	staticFs, err := runtime.Static()
+	if err != nil {
+		return fmt.Errorf("no static assets: %w", err)
+	}
+
+	return wasm.FillBackendRegistration(state, reg, params.Parameters, staticFs, runtime)
+}
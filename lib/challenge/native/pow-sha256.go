@@ -0,0 +1,119 @@
+package native
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"git.gammaspectra.live/git/go-away/embed"
+	_interface "git.gammaspectra.live/git/go-away/lib/challenge/wasm/interface"
+	"git.gammaspectra.live/git/go-away/utils/inline"
+	"io/fs"
+	"math/bits"
+	"strconv"
+)
+
+func init() {
+	Runtimes["js-pow-sha256"] = PowSha256{}
+}
+
+// PowSha256 Native implementation of the js-pow-sha256 WASM runtime
+// Results must match embed/challenge/js-pow-sha256/runtime/runtime.go, see test-wasm-runtime compare mode
+type PowSha256 struct {
+}
+
+func (PowSha256) getChallenge(key []byte, params map[string]string) ([]byte, uint64, error) {
+	difficulty := uint64(20)
+	var err error
+	if diffStr, ok := params["difficulty"]; ok {
+		difficulty, err = strconv.ParseUint(diffStr, 10, 64)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	hasher := sha256.New()
+	hasher.Write(binary.LittleEndian.AppendUint64(nil, difficulty))
+	hasher.Write(key)
+	return hasher.Sum(nil), difficulty, nil
+}
+
+func (p PowSha256) MakeChallenge(in _interface.MakeChallengeInput) (*_interface.MakeChallengeOutput, error) {
+	c, difficulty, err := p.getChallenge(in.Key, in.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	// create target
+	target := make([]byte, len(c))
+	nBits := difficulty
+	for i := 0; i < len(target); i++ {
+		var v uint8
+		for j := 0; j < 8; j++ {
+			v <<= 1
+			if nBits == 0 {
+				v |= 1
+			} else {
+				nBits--
+			}
+		}
+		target[i] = v
+	}
+
+	dst := make([]byte, inline.EncodedLen(len(c)))
+	dst = dst[:inline.Encode(dst, c)]
+
+	targetDst := make([]byte, inline.EncodedLen(len(target)))
+	targetDst = targetDst[:inline.Encode(targetDst, target)]
+
+	out := &_interface.MakeChallengeOutput{
+		Code:    200,
+		Headers: make(inline.MIMEHeader),
+	}
+	out.Data = []byte("{\"challenge\": \"" + string(dst) + "\", \"target\": \"" + string(targetDst) + "\", \"difficulty\": " + strconv.FormatUint(difficulty, 10) + "}")
+	out.Headers.Set("Content-Type", "application/json; charset=utf-8")
+	return out, nil
+}
+
+func (p PowSha256) VerifyChallenge(in _interface.VerifyChallengeInput) (_interface.VerifyChallengeOutput, error) {
+	c, difficulty, err := p.getChallenge(in.Key, in.Parameters)
+	if err != nil {
+		return _interface.VerifyChallengeOutputError, err
+	}
+
+	result := make([]byte, inline.DecodedLen(len(in.Result)))
+	n, err := inline.Decode(result, in.Result)
+	if err != nil {
+		return _interface.VerifyChallengeOutputError, nil
+	}
+	result = result[:n]
+
+	if len(result) < 8 {
+		return _interface.VerifyChallengeOutputError, nil
+	}
+
+	// verify we used same challenge
+	if subtle.ConstantTimeCompare(result[:len(result)-8], c) != 1 {
+		return _interface.VerifyChallengeOutputFailed, nil
+	}
+
+	hash := sha256.Sum256(result)
+
+	var leadingZeroesCount int
+	for i := 0; i < len(hash); i++ {
+		leadingZeroes := bits.LeadingZeros8(hash[i])
+		leadingZeroesCount += leadingZeroes
+		if leadingZeroes < 8 {
+			break
+		}
+	}
+
+	if leadingZeroesCount < int(difficulty) {
+		return _interface.VerifyChallengeOutputFailed, nil
+	}
+
+	return _interface.VerifyChallengeOutputOK, nil
+}
+
+func (PowSha256) Static() (fs.FS, error) {
+	return fs.Sub(embed.ChallengeFs, "js-pow-sha256/static")
+}
@@ -0,0 +1,301 @@
+package oidc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"git.gammaspectra.live/git/go-away/lib/challenge"
+	"git.gammaspectra.live/git/go-away/utils"
+	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/ast"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+func init() {
+	challenge.Runtimes[Key] = FillRegistration
+}
+
+const Key = "oidc"
+
+const CallbackUrlSuffix = "/callback"
+
+type Parameters struct {
+	// Issuer URL of the OpenID Connect provider, used for discovery
+	Issuer string `yaml:"issuer"`
+
+	ClientId     string `yaml:"client-id"`
+	ClientSecret string `yaml:"client-secret"`
+
+	Scopes []string `yaml:"scopes"`
+
+	// RedirectUrl Overrides the callback URL registered on the provider.
+	// Defaults to the challenge path plus /callback on the requested host
+	RedirectUrl string `yaml:"redirect-url"`
+
+	// GroupsClaim Claim that contains the list of groups of the user
+	GroupsClaim string `yaml:"groups-claim"`
+
+	// AllowedGroups If set, user must be in one of these groups
+	AllowedGroups []string `yaml:"allowed-groups"`
+
+	// Claims Claims exposed to conditions via challengeData
+	Claims []string `yaml:"claims"`
+
+	// BackendHeaders Request headers set towards the backend, from claim values
+	BackendHeaders map[string]string `yaml:"backend-headers"`
+
+	// MaxAge Maximum time the login flow can take
+	MaxAge time.Duration `yaml:"max-age"`
+
+	// CacheDuration How long provider configuration and keys are cached for
+	CacheDuration time.Duration `yaml:"provider-cache-duration"`
+}
+
+var DefaultParameters = Parameters{
+	Scopes:      []string{"openid", "email", "profile"},
+	GroupsClaim: "groups",
+	Claims:      []string{"sub", "email", "email_verified", "name", "preferred_username", "groups"},
+	BackendHeaders: map[string]string{
+		"X-Away-Oidc-Subject": "sub",
+		"X-Away-Oidc-Email":   "email",
+	},
+	MaxAge:        time.Minute * 10,
+	CacheDuration: time.Hour,
+}
+
+var ErrInvalidState = errors.New("invalid login state")
+var ErrStateExpired = errors.New("login state expired")
+
+const stateSize = 8 + sha256.Size
+
+// signState Creates a login state bound to the challenge key and verify query
+func signState(key challenge.Key, issued time.Time, verifyQuery string) []byte {
+	buf := make([]byte, 8, stateSize)
+	binary.BigEndian.PutUint64(buf, uint64(issued.UnixMilli()))
+
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte("oidc-state\x00"))
+	mac.Write(buf)
+	mac.Write([]byte(verifyQuery))
+	return mac.Sum(buf)
+}
+
+func verifyState(key challenge.Key, state []byte, verifyQuery string) (issued time.Time, err error) {
+	if len(state) != stateSize {
+		return time.Time{}, ErrInvalidState
+	}
+	issued = time.UnixMilli(int64(binary.BigEndian.Uint64(state)))
+	if !hmac.Equal(state, signState(key, issued, verifyQuery)) {
+		return time.Time{}, ErrInvalidState
+	}
+	return issued, nil
+}
+
+// deriveSecret Derives nonce and PKCE verifier from the login state, so these do not need to be stored
+func deriveSecret(key challenge.Key, purpose string, state []byte) string {
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte(purpose))
+	mac.Write([]byte{0})
+	mac.Write(state)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// callbackData Values passed from the callback handler to verification
+type callbackData struct {
+	code        string
+	verifyQuery string
+	claims      map[string]any
+}
+
+type callbackDataContextKey struct{}
+
+func FillRegistration(state challenge.StateInterface, reg *challenge.Registration, parameters ast.Node) error {
+	params := DefaultParameters
+	// do not modify defaults when decoding
+	params.BackendHeaders = maps.Clone(DefaultParameters.BackendHeaders)
+
+	if parameters != nil {
+		ymlData, err := parameters.MarshalYAML()
+		if err != nil {
+			return err
+		}
+		err = yaml.Unmarshal(ymlData, &params)
+		if err != nil {
+			return err
+		}
+	}
+
+	if params.Issuer == "" || params.ClientId == "" {
+		return errors.New("issuer and client-id are required")
+	}
+	if !slices.Contains(params.Scopes, "openid") {
+		params.Scopes = append([]string{"openid"}, params.Scopes...)
+	}
+
+	provider := NewProvider(params.Issuer, state.Client(), params.CacheDuration)
+
+	reg.Class = challenge.ClassBlocking
+
+	redirectUri := func(r *http.Request) string {
+		if params.RedirectUrl != "" {
+			return params.RedirectUrl
+		}
+		uri := url.URL{
+			Scheme: utils.GetRequestScheme(r),
+			Host:   r.Host,
+			Path:   reg.Path + CallbackUrlSuffix,
+		}
+		return uri.String()
+	}
+
+	// claims are forwarded from the token, see challenge.RequestData.RequestHeaders
+	reg.BackendHeaders = params.BackendHeaders
+
+	reg.IssueChallenge = func(w http.ResponseWriter, r *http.Request, key challenge.Key, expiry time.Time) challenge.VerifyResult {
+		configuration, err := provider.Configuration()
+		if err != nil {
+			state.Logger(r).Error("error fetching oidc provider configuration", "challenge", reg.Name, "error", err)
+			return challenge.VerifyResultFail
+		}
+
+		uri, err := challenge.VerifyUrl(r, reg, "")
+		if err != nil {
+			return challenge.VerifyResultFail
+		}
+
+		loginState := signState(key, time.Now(), uri.RawQuery)
+
+		authUri, err := url.Parse(configuration.AuthorizationEndpoint)
+		if err != nil {
+			return challenge.VerifyResultFail
+		}
+		q := authUri.Query()
+		q.Set("response_type", "code")
+		q.Set("client_id", params.ClientId)
+		q.Set("redirect_uri", redirectUri(r))
+		q.Set("scope", strings.Join(params.Scopes, " "))
+		q.Set("state", base64.RawURLEncoding.EncodeToString([]byte(uri.RawQuery))+"."+base64.RawURLEncoding.EncodeToString(loginState))
+		q.Set("nonce", deriveSecret(key, "oidc-nonce", loginState))
+		codeChallenge := sha256.Sum256([]byte(deriveSecret(key, "oidc-pkce", loginState)))
+		q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(codeChallenge[:]))
+		q.Set("code_challenge_method", "S256")
+		authUri.RawQuery = q.Encode()
+
+		data := challenge.RequestDataFromContext(r.Context())
+		data.ResponseHeaders(w)
+		http.Redirect(w, r, authUri.String(), http.StatusFound)
+		return challenge.VerifyResultNone
+	}
+
+	verifyHandler := challenge.VerifyHandlerFunc(state, reg, func(key challenge.Key, token []byte, r *http.Request) (challenge.VerifyResult, error) {
+		cb, ok := r.Context().Value(callbackDataContextKey{}).(*callbackData)
+		if !ok {
+			return challenge.VerifyResultFail, ErrInvalidState
+		}
+
+		loginState, err := base64.RawURLEncoding.DecodeString(string(token))
+		if err != nil {
+			return challenge.VerifyResultFail, ErrInvalidState
+		}
+		issued, err := verifyState(key, loginState, cb.verifyQuery)
+		if err != nil {
+			return challenge.VerifyResultFail, err
+		}
+		if issued.Add(params.MaxAge).Before(time.Now()) {
+			return challenge.VerifyResultFail, ErrStateExpired
+		}
+
+		rawIdToken, err := provider.Exchange(cb.code, redirectUri(r), params.ClientId, params.ClientSecret, deriveSecret(key, "oidc-pkce", loginState))
+		if err != nil {
+			return challenge.VerifyResultFail, err
+		}
+
+		claims, err := provider.VerifyIDToken(rawIdToken, params.ClientId, deriveSecret(key, "oidc-nonce", loginState))
+		if err != nil {
+			return challenge.VerifyResultFail, err
+		}
+
+		if len(params.AllowedGroups) > 0 {
+			groups, _ := claims[params.GroupsClaim].([]any)
+			if !slices.ContainsFunc(groups, func(g any) bool {
+				s, ok := g.(string)
+				return ok && slices.Contains(params.AllowedGroups, s)
+			}) {
+				return challenge.VerifyResultNotOK, nil
+			}
+		}
+
+		cb.claims = claims
+		return challenge.VerifyResultOK, nil
+	}, func(state challenge.StateInterface, data *challenge.RequestData, w http.ResponseWriter, r *http.Request, verifyResult challenge.VerifyResult, err error, redirect string) {
+		if cb, ok := r.Context().Value(callbackDataContextKey{}).(*callbackData); ok && verifyResult.Ok() && cb.claims != nil {
+			values := make(map[string]any, len(params.Claims))
+			for _, claim := range params.Claims {
+				if v, ok := cb.claims[claim]; ok {
+					values[claim] = v
+				}
+			}
+			// keep claims used for backend headers along the token
+			for _, claim := range params.BackendHeaders {
+				if v, ok := cb.claims[claim]; ok {
+					values[claim] = v
+				}
+			}
+			if err := data.SetChallengeData(reg, values); err != nil {
+				state.Logger(r).Error("error setting challenge data", "challenge", reg.Name, "error", err)
+			}
+		}
+		challenge.VerifyHandlerChallengeResponseFunc(state, data, w, r, verifyResult, err, redirect)
+	})
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET "+reg.Path+CallbackUrlSuffix, func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if e := q.Get("error"); e != "" {
+			state.ErrorPage(w, r, http.StatusForbidden, fmt.Errorf("login failed: %s %s", e, q.Get("error_description")), "")
+			return
+		}
+
+		encodedQuery, encodedState, ok := strings.Cut(q.Get("state"), ".")
+		if !ok || q.Get("code") == "" {
+			state.ErrorPage(w, r, http.StatusBadRequest, ErrInvalidState, "")
+			return
+		}
+		verifyQuery, err := base64.RawURLEncoding.DecodeString(encodedQuery)
+		if err != nil {
+			state.ErrorPage(w, r, http.StatusBadRequest, ErrInvalidState, "")
+			return
+		}
+
+		// restore verify query and pass login state as token, where VerifyHandlerFunc reads it
+		values, err := utils.ParseRawQuery(string(verifyQuery))
+		if err != nil {
+			state.ErrorPage(w, r, http.StatusBadRequest, ErrInvalidState, "")
+			return
+		}
+		values.Set(challenge.QueryArgToken, url.QueryEscape(encodedState))
+		uri := *r.URL
+		uri.RawQuery = utils.EncodeRawQuery(values)
+
+		r = r.Clone(context.WithValue(r.Context(), callbackDataContextKey{}, &callbackData{
+			code:        q.Get("code"),
+			verifyQuery: string(verifyQuery),
+		}))
+		r.URL = &uri
+		verifyHandler(w, r)
+	})
+
+	reg.Handler = mux
+
+	return nil
+}
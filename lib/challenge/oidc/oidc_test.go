@@ -0,0 +1,370 @@
+package oidc_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"git.gammaspectra.live/git/go-away/lib"
+	"git.gammaspectra.live/git/go-away/lib/challenge"
+	"git.gammaspectra.live/git/go-away/lib/challenge/oidc"
+	"git.gammaspectra.live/git/go-away/lib/policy"
+	"git.gammaspectra.live/git/go-away/lib/settings"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testClientId = "go-away"
+
+// authorization Login started on the test provider, redeemed once via the token endpoint
+type authorization struct {
+	nonce         string
+	codeChallenge string
+	redirectUri   string
+	claims        map[string]any
+}
+
+// testProvider OpenID Connect provider serving discovery, keys and token endpoints
+type testProvider struct {
+	server *httptest.Server
+	// issuer Issuer advertised on discovery and set on ID tokens
+	issuer string
+
+	lock   sync.Mutex
+	key    *rsa.PrivateKey
+	keyId  string
+	keyGen int
+	codes  map[string]authorization
+}
+
+func newTestProvider(t *testing.T, trailingSlash bool) *testProvider {
+	p := &testProvider{
+		codes: make(map[string]authorization),
+	}
+	p.Rotate(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(oidc.ProviderConfiguration{
+			Issuer:                p.issuer,
+			AuthorizationEndpoint: p.server.URL + "/authorize",
+			TokenEndpoint:         p.server.URL + "/token",
+			JWKSURI:               p.server.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("GET /keys", func(w http.ResponseWriter, r *http.Request) {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		// only the current key is published, as after a rotation
+		_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &p.key.PublicKey, KeyID: p.keyId, Algorithm: string(jose.RS256), Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("POST /token", p.token)
+
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+
+	p.issuer = p.server.URL
+	if trailingSlash {
+		p.issuer += "/"
+	}
+	return p
+}
+
+// Rotate Replaces the signing key with a new one under a new key id
+func (p *testProvider) Rotate(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.keyGen++
+	p.key, p.keyId = key, fmt.Sprintf("key-%d", p.keyGen)
+}
+
+// Authorize Logs in as the user would on the authorization endpoint, and returns the callback URL.
+// Claims are set on the ID token, and override the defaults
+func (p *testProvider) Authorize(t *testing.T, location string, claims map[string]any) string {
+	uri, err := url.Parse(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := uri.Scheme + "://" + uri.Host + uri.Path; got != p.server.URL+"/authorize" {
+		t.Fatalf("redirected to %s, expected authorization endpoint", got)
+	}
+	q := uri.Query()
+	if q.Get("client_id") != testClientId || q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("unexpected authorization request %s", uri.RawQuery)
+	}
+	if q.Get("nonce") == "" || q.Get("code_challenge") == "" || q.Get("state") == "" {
+		t.Fatalf("authorization request without nonce, code challenge or state: %s", uri.RawQuery)
+	}
+
+	code := rand.Text()
+	p.lock.Lock()
+	p.codes[code] = authorization{
+		nonce:         q.Get("nonce"),
+		codeChallenge: q.Get("code_challenge"),
+		redirectUri:   q.Get("redirect_uri"),
+		claims:        claims,
+	}
+	p.lock.Unlock()
+
+	callback, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback.RawQuery = url.Values{"code": {code}, "state": {q.Get("state")}}.Encode()
+	return callback.String()
+}
+
+func (p *testProvider) token(w http.ResponseWriter, r *http.Request) {
+	tokenError := func(e string) {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": e})
+	}
+	if err := r.ParseForm(); err != nil {
+		tokenError("invalid_request")
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	a, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	if !ok || r.PostForm.Get("redirect_uri") != a.redirectUri || r.PostForm.Get("client_id") != testClientId {
+		tokenError("invalid_grant")
+		return
+	}
+	verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(verifier[:]) != a.codeChallenge {
+		tokenError("invalid_grant")
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]any{
+		"iss":   p.issuer,
+		"aud":   testClientId,
+		"sub":   "user",
+		"email": "user@example.com",
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Minute * 5).Unix(),
+		"nonce": a.nonce,
+	}
+	maps.Copy(claims, a.claims)
+
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.RS256,
+		Key:       jose.JSONWebKey{Key: p.key, KeyID: p.keyId},
+	}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		tokenError("server_error")
+		return
+	}
+	idToken, err := jwt.Signed(signer).Claims(claims).Serialize()
+	if err != nil {
+		tokenError("server_error")
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"id_token":     idToken,
+	})
+}
+
+func newTestState(t *testing.T, issuer string, extraParameters string) *lib.State {
+	policyData := fmt.Sprintf(`
+challenges:
+  oidc:
+    runtime: oidc
+    parameters:
+      issuer: %q
+      client-id: %q
+%s
+rules:
+  - name: all
+    conditions: ['true']
+    action: challenge
+    settings:
+      challenges: [oidc]
+`, issuer, testClientId, extraParameters)
+
+	p, err := policy.NewPolicy(bytes.NewReader([]byte(policyData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := lib.NewState(*p, settings.DefaultSettings, policy.StateSettings{
+		Backends: map[string]http.Handler{
+			"*": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// as done by the director of settings.Backend
+				challenge.RequestDataFromContext(r.Context()).RequestHeaders(r.Header)
+				w.Header().Set("X-Backend", "1")
+				w.Header().Set("X-Subject", r.Header.Get("X-Away-Oidc-Subject"))
+				w.WriteHeader(http.StatusOK)
+			}),
+		},
+		// challenge handlers are routed under it
+		BasePath:       "/.well-known/.go-away",
+		PrivateKeySeed: make([]byte, 32),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = state.Close()
+	})
+	return state
+}
+
+func serve(state *lib.State, uri string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, uri, nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	state.ServeHTTP(w, r)
+	return w
+}
+
+// login Runs the login flow with claims set on the ID token, and returns the callback response
+func login(t *testing.T, state *lib.State, provider *testProvider, claims map[string]any) *httptest.ResponseRecorder {
+	w := serve(state, "http://example.com/page", nil)
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected redirect to provider, got status %d", w.Code)
+	}
+	return serve(state, provider.Authorize(t, w.Header().Get("Location"), claims), nil)
+}
+
+// passes Runs the login flow, and returns whether the following request reached the backend as the user
+func passes(t *testing.T, state *lib.State, provider *testProvider, claims map[string]any) bool {
+	w := login(t, state, provider, claims)
+	if w.Code != http.StatusTemporaryRedirect {
+		return false
+	}
+	w = serve(state, "http://example.com/page", w.Result().Cookies())
+	if w.Header().Get("X-Backend") == "" {
+		t.Fatalf("logged in request did not reach backend, got status %d", w.Code)
+	}
+	if subject := w.Header().Get("X-Subject"); subject != "user" {
+		t.Fatalf("expected subject header %q, got %q", "user", subject)
+	}
+	return true
+}
+
+func TestLogin(t *testing.T) {
+	provider := newTestProvider(t, false)
+	state := newTestState(t, provider.issuer, "")
+
+	tests := []struct {
+		name   string
+		claims map[string]any
+		pass   bool
+	}{
+		{name: "valid", pass: true},
+		{name: "audience list", claims: map[string]any{"aud": []string{"other", testClientId}}, pass: true},
+		{name: "wrong issuer", claims: map[string]any{"iss": "https://other.example.com"}},
+		{name: "wrong audience", claims: map[string]any{"aud": "other"}},
+		{name: "expired", claims: map[string]any{"exp": time.Now().Add(-time.Hour).Unix()}},
+		{name: "missing expiry", claims: map[string]any{"exp": nil}},
+		{name: "wrong nonce", claims: map[string]any{"nonce": "other"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if pass := passes(t, state, provider, tt.claims); pass != tt.pass {
+				t.Errorf("expected pass %v, got %v", tt.pass, pass)
+			}
+		})
+	}
+}
+
+func TestLoginState(t *testing.T) {
+	provider := newTestProvider(t, false)
+	state := newTestState(t, provider.issuer, "")
+
+	w := serve(state, "http://example.com/page", nil)
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected redirect to provider, got status %d", w.Code)
+	}
+	callback := provider.Authorize(t, w.Header().Get("Location"), nil)
+
+	// tampered state is rejected before the code is redeemed
+	uri, _ := url.Parse(callback)
+	q := uri.Query()
+	encodedQuery, encodedState, _ := strings.Cut(q.Get("state"), ".")
+	loginState, _ := base64.RawURLEncoding.DecodeString(encodedState)
+	loginState[0] ^= 1
+	q.Set("state", encodedQuery+"."+base64.RawURLEncoding.EncodeToString(loginState))
+	uri.RawQuery = q.Encode()
+	if w = serve(state, uri.String(), nil); w.Code == http.StatusTemporaryRedirect {
+		t.Fatal("tampered state was accepted")
+	}
+
+	if w = serve(state, callback, nil); w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("expected login to pass, got status %d", w.Code)
+	}
+	// codes can only be redeemed once
+	if w = serve(state, callback, nil); w.Code == http.StatusTemporaryRedirect {
+		t.Fatal("callback was accepted twice")
+	}
+}
+
+func TestIssuerTrailingSlash(t *testing.T) {
+	provider := newTestProvider(t, true)
+
+	if !passes(t, newTestState(t, provider.issuer, ""), provider, nil) {
+		t.Error("login with issuer configured verbatim failed")
+	}
+	// discovery fails, as the issuer advertised by the provider differs
+	if w := serve(newTestState(t, strings.TrimSuffix(provider.issuer, "/"), ""), "http://example.com/page", nil); w.Code == http.StatusFound {
+		t.Error("login with different issuer was started")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	interval := oidc.MinimumRefetchInterval
+	oidc.MinimumRefetchInterval = 0
+	t.Cleanup(func() {
+		oidc.MinimumRefetchInterval = interval
+	})
+
+	provider := newTestProvider(t, false)
+	state := newTestState(t, provider.issuer, "")
+
+	if !passes(t, state, provider, nil) {
+		t.Fatal("login before rotation failed")
+	}
+	provider.Rotate(t)
+	if !passes(t, state, provider, nil) {
+		t.Fatal("login after rotation failed")
+	}
+}
+
+func TestAllowedGroups(t *testing.T) {
+	provider := newTestProvider(t, false)
+	state := newTestState(t, provider.issuer, "      allowed-groups: [admins]")
+
+	if w := login(t, state, provider, map[string]any{"groups": []string{"users"}}); w.Code != http.StatusForbidden {
+		t.Errorf("expected status %d for user not in allowed groups, got %d", http.StatusForbidden, w.Code)
+	}
+	if w := login(t, state, provider, nil); w.Code != http.StatusForbidden {
+		t.Errorf("expected status %d for user without groups, got %d", http.StatusForbidden, w.Code)
+	}
+	if !passes(t, state, provider, map[string]any{"groups": []string{"users", "admins"}}) {
+		t.Error("login of user in allowed groups failed")
+	}
+}
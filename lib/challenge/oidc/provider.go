@@ -0,0 +1,257 @@
+package oidc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MinimumRefetchInterval Minimum time between fetches of provider keys when looking for unknown keys
+var MinimumRefetchInterval = time.Minute
+
+// MaxDocumentSize Maximum size of discovery, keys and token responses
+const MaxDocumentSize = 1024 * 1024
+
+// ClockSkew Allowed time difference on ID token times
+const ClockSkew = time.Minute
+
+var SupportedAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+type ProviderConfiguration struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider OpenID Connect provider, with configuration discovered and keys fetched on use
+type Provider struct {
+	Issuer string
+
+	client        *http.Client
+	cacheDuration time.Duration
+
+	lock          sync.RWMutex
+	configuration *ProviderConfiguration
+	keys          *jose.JSONWebKeySet
+	fetched       time.Time
+
+	fetchLock sync.Mutex
+	attempted time.Time
+}
+
+func NewProvider(issuer string, client *http.Client, cacheDuration time.Duration) *Provider {
+	return &Provider{
+		Issuer:        issuer,
+		client:        client,
+		cacheDuration: cacheDuration,
+	}
+}
+
+func (p *Provider) get(uri string, out any) error {
+	response, err := p.client.Get(uri)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d from %s", response.StatusCode, uri)
+	}
+	data, err := io.ReadAll(io.LimitReader(response.Body, MaxDocumentSize))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// fetch Discovers configuration and fetches keys from the provider
+func (p *Provider) fetch() error {
+	p.fetchLock.Lock()
+	defer p.fetchLock.Unlock()
+
+	p.lock.RLock()
+	fetched := p.fetched
+	p.lock.RUnlock()
+	if time.Since(fetched) < MinimumRefetchInterval || time.Since(p.attempted) < MinimumRefetchInterval {
+		// fetched concurrently, or too soon
+		return nil
+	}
+	p.attempted = time.Now()
+
+	var configuration ProviderConfiguration
+	// issuer is compared verbatim, only the discovery URL is built without a trailing slash
+	if err := p.get(strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", &configuration); err != nil {
+		return err
+	}
+	if configuration.Issuer != p.Issuer {
+		return fmt.Errorf("issuer mismatch: got %s, expected %s", configuration.Issuer, p.Issuer)
+	}
+	if configuration.AuthorizationEndpoint == "" || configuration.TokenEndpoint == "" || configuration.JWKSURI == "" {
+		return errors.New("incomplete provider configuration")
+	}
+
+	var keys jose.JSONWebKeySet
+	if err := p.get(configuration.JWKSURI, &keys); err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.configuration = &configuration
+	p.keys = &keys
+	p.fetched = time.Now()
+	return nil
+}
+
+// Configuration Returns the discovered provider configuration, fetching it if needed or expired
+func (p *Provider) Configuration() (*ProviderConfiguration, error) {
+	p.lock.RLock()
+	configuration, fetched := p.configuration, p.fetched
+	p.lock.RUnlock()
+
+	if configuration == nil || time.Since(fetched) > p.cacheDuration {
+		if err := p.fetch(); err != nil {
+			if configuration != nil {
+				// keep using stale configuration
+				return configuration, nil
+			}
+			return nil, err
+		}
+		p.lock.RLock()
+		configuration = p.configuration
+		p.lock.RUnlock()
+		if configuration == nil {
+			return nil, errors.New("provider configuration not available")
+		}
+	}
+	return configuration, nil
+}
+
+func (p *Provider) key(keyId string) (*jose.JSONWebKey, bool) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.keys == nil {
+		return nil, false
+	}
+	for _, k := range p.keys.Keys {
+		if k.KeyID == keyId && k.Use != "enc" {
+			return &k, true
+		}
+	}
+	return nil, false
+}
+
+// Exchange Redeems an authorization code, and returns the raw ID token
+func (p *Provider) Exchange(code, redirectUri, clientId, clientSecret, codeVerifier string) (string, error) {
+	configuration, err := p.Configuration()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectUri)
+	form.Set("client_id", clientId)
+	form.Set("code_verifier", codeVerifier)
+
+	request, err := http.NewRequest(http.MethodPost, configuration.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if clientSecret != "" {
+		request.SetBasicAuth(url.QueryEscape(clientId), url.QueryEscape(clientSecret))
+	}
+
+	response, err := p.client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(response.Body, MaxDocumentSize))
+	if err != nil {
+		return "", err
+	}
+
+	var result struct {
+		IdToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err = json.Unmarshal(data, &result); err != nil {
+		return "", fmt.Errorf("token endpoint: %w", err)
+	}
+	if result.Error != "" {
+		return "", fmt.Errorf("token endpoint: %s: %s", result.Error, result.ErrorDescription)
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint: unexpected status code %d", response.StatusCode)
+	}
+	if result.IdToken == "" {
+		return "", errors.New("token endpoint: missing id_token")
+	}
+	return result.IdToken, nil
+}
+
+// VerifyIDToken Verifies signature, issuer, audience, times and nonce of an ID token, and returns all its claims
+func (p *Provider) VerifyIDToken(raw, clientId, nonce string) (map[string]any, error) {
+	token, err := jwt.ParseSigned(raw, SupportedAlgorithms)
+	if err != nil {
+		return nil, err
+	}
+	if len(token.Headers) != 1 {
+		return nil, errors.New("unexpected number of signatures")
+	}
+
+	keyId := token.Headers[0].KeyID
+	key, ok := p.key(keyId)
+	if !ok {
+		// keys might have been rotated
+		if err = p.fetch(); err != nil {
+			return nil, err
+		}
+		if key, ok = p.key(keyId); !ok {
+			return nil, fmt.Errorf("unknown key %s", keyId)
+		}
+	}
+
+	var claims jwt.Claims
+	var all map[string]any
+	if err = token.Claims(key.Key, &claims, &all); err != nil {
+		return nil, err
+	}
+
+	err = claims.ValidateWithLeeway(jwt.Expected{
+		Issuer:      p.Issuer,
+		AnyAudience: jwt.Audience{clientId},
+		Time:        time.Now(),
+	}, ClockSkew)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Expiry == nil {
+		return nil, errors.New("missing exp claim")
+	}
+
+	if n, _ := all["nonce"].(string); n != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+
+	return all, nil
+}
@@ -47,7 +47,10 @@ func FillRegistration(state challenge.StateInterface, reg *challenge.Registratio
 	// some of regular headers are not sent in default headers
 	reg.KeyHeaders = challenge.MinimalKeyHeaders
 
-	ob := challenge.NewAwaiter[string]()
+	ob, err := challenge.NewSharedAwaiter[string](state.Settings().SharedState, "go-away:preload-link:"+reg.Name)
+	if err != nil {
+		return err
+	}
 
 	reg.Object = ob
 
@@ -0,0 +1,234 @@
+package privacy_pass
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"git.gammaspectra.live/git/go-away/lib/challenge"
+	"git.gammaspectra.live/git/go-away/utils"
+	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/ast"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	challenge.Runtimes[Key] = FillRegistration
+}
+
+const Key = "privacy-pass"
+
+type Parameters struct {
+	// IssuerName Name of the issuer tokens are requested from
+	IssuerName string `yaml:"issuer-name"`
+
+	// TokenKey Issuer public key, as base64 SubjectPublicKeyInfo from the issuer directory, or PEM
+	TokenKey string `yaml:"token-key"`
+
+	// BindOrigin Include the request host as origin_info, so tokens can only be redeemed on that host
+	BindOrigin bool `yaml:"bind-origin"`
+
+	// BindContext Use the challenge key as redemption_context, so tokens can only be redeemed by the same client network within challenge duration
+	BindContext bool `yaml:"bind-context"`
+
+	// MaxAge Sent to the client as max-age of the challenge, zero to not send it
+	MaxAge time.Duration `yaml:"max-age"`
+
+	// DoubleSpendWindow How long redeemed token nonces are remembered when BindContext is not set
+	// Defaults to challenge duration
+	DoubleSpendWindow time.Duration `yaml:"double-spend-window"`
+
+	VerifyProbability float64 `yaml:"verify-probability"`
+}
+
+var DefaultParameters = Parameters{
+	BindOrigin:        true,
+	BindContext:       true,
+	VerifyProbability: 0.1,
+}
+
+const authorizationScheme = "PrivateToken"
+
+var ErrDoubleSpend = errors.New("token already redeemed")
+
+func FillRegistration(state challenge.StateInterface, reg *challenge.Registration, parameters ast.Node) error {
+	params := DefaultParameters
+
+	if parameters != nil {
+		ymlData, err := parameters.MarshalYAML()
+		if err != nil {
+			return err
+		}
+		err = yaml.Unmarshal(ymlData, &params)
+		if err != nil {
+			return err
+		}
+	}
+
+	if params.IssuerName == "" {
+		return errors.New("empty issuer-name")
+	}
+
+	issuerKey, err := ParseIssuerKey(params.TokenKey)
+	if err != nil {
+		return fmt.Errorf("token-key: %w", err)
+	}
+
+	if params.DoubleSpendWindow <= 0 {
+		params.DoubleSpendWindow = reg.Duration
+	}
+
+	reg.Class = challenge.ClassTransparent
+
+	reg.VerifyProbability = params.VerifyProbability
+
+	getChallenge := func(key challenge.Key, r *http.Request) TokenChallenge {
+		c := TokenChallenge{
+			TokenType:  TokenTypeBlindRSA,
+			IssuerName: params.IssuerName,
+		}
+		if params.BindContext {
+			c.RedemptionContext = key[:]
+		}
+		if params.BindOrigin {
+			c.OriginInfo = r.Host
+			if host, _, err := net.SplitHostPort(r.Host); err == nil {
+				c.OriginInfo = host
+			}
+		}
+		return c
+	}
+
+	verifyToken := func(key challenge.Key, tokenData []byte, r *http.Request) (Token, error) {
+		token, err := UnmarshalToken(tokenData)
+		if err != nil {
+			return Token{}, err
+		}
+		if token.ChallengeDigest != sha256.Sum256(getChallenge(key, r).Marshal()) {
+			return Token{}, errors.New("token challenge mismatch")
+		}
+		if err = issuerKey.Verify(token); err != nil {
+			return Token{}, err
+		}
+		return token, nil
+	}
+
+	// nonces of redeemed tokens
+	redeemed := utils.NewStateCounter[[nonceSize]byte](state.Settings().SharedState, "go-away:privacy-pass:"+reg.Name+":")
+
+	ob := &decayObject{
+		close: make(chan struct{}),
+	}
+	go ob.run(redeemed)
+	reg.Object = ob
+
+	// Verify only checks the token itself, as it is spot checked again after redemption
+	reg.Verify = func(key challenge.Key, result []byte, r *http.Request) (challenge.VerifyResult, error) {
+		if _, err := verifyToken(key, result, r); err != nil {
+			return challenge.VerifyResultFail, err
+		}
+		return challenge.VerifyResultOK, nil
+	}
+
+	reg.IssueChallenge = func(w http.ResponseWriter, r *http.Request, key challenge.Key, expiry time.Time) challenge.VerifyResult {
+		tokenData, ok, err := getAuthorizationToken(r)
+		if err != nil {
+			state.Logger(r).Debug("invalid authorization", "challenge", reg.Name, "error", err)
+			return challenge.VerifyResultFail
+		} else if !ok {
+			// request a token from client, carried on whichever response is sent
+			w.Header().Add("WWW-Authenticate", challengeHeader(getChallenge(key, r), issuerKey, params.MaxAge))
+			return challenge.VerifyResultNone
+		}
+
+		token, err := verifyToken(key, tokenData, r)
+		if err != nil {
+			state.Logger(r).Debug("invalid token", "challenge", reg.Name, "error", err)
+			return challenge.VerifyResultFail
+		}
+
+		ttl := params.DoubleSpendWindow
+		if params.BindContext {
+			// tokens cannot be redeemed after key changes
+			ttl = time.Until(expiry) + time.Minute
+		}
+
+		// first redemption only, also fails if state is unavailable
+		if redeemed.Incr(token.Nonce, ttl) != 1 {
+			state.Logger(r).Debug("invalid token", "challenge", reg.Name, "error", ErrDoubleSpend)
+			return challenge.VerifyResultFail
+		}
+
+		// token is meant for us, not for backend
+		r.Header.Del("Authorization")
+
+		data := challenge.RequestDataFromContext(r.Context())
+		data.IssueChallengeToken(reg, key, tokenData, expiry, true)
+		return challenge.VerifyResultOK
+	}
+
+	return nil
+}
+
+func challengeHeader(c TokenChallenge, issuerKey *IssuerKey, maxAge time.Duration) string {
+	v := fmt.Sprintf("%s challenge=\"%s\", token-key=\"%s\"", authorizationScheme,
+		base64.RawURLEncoding.EncodeToString(c.Marshal()),
+		base64.RawURLEncoding.EncodeToString(issuerKey.Encoded),
+	)
+	if maxAge > 0 {
+		v += fmt.Sprintf(", max-age=\"%d\"", int64(maxAge.Seconds()))
+	}
+	return v
+}
+
+// getAuthorizationToken Returns the token from Authorization: PrivateToken token="..."
+func getAuthorizationToken(r *http.Request) (token []byte, ok bool, err error) {
+	for _, v := range r.Header.Values("Authorization") {
+		scheme, params, _ := strings.Cut(strings.TrimSpace(v), " ")
+		if !strings.EqualFold(scheme, authorizationScheme) {
+			continue
+		}
+		for _, param := range strings.Split(params, ",") {
+			k, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if !strings.EqualFold(k, "token") {
+				continue
+			}
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				value = unquoted
+			}
+			token, err = decodeBase64(value)
+			if err != nil {
+				return nil, false, err
+			}
+			return token, true, nil
+		}
+		return nil, false, errors.New("missing token parameter")
+	}
+	return nil, false, nil
+}
+
+type decayObject struct {
+	close chan struct{}
+}
+
+func (o *decayObject) run(m interface{ Decay() }) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.Decay()
+		case <-o.close:
+			return
+		}
+	}
+}
+
+func (o *decayObject) Close() error {
+	close(o.close)
+	return nil
+}
@@ -0,0 +1,214 @@
+package privacy_pass_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"git.gammaspectra.live/git/go-away/lib"
+	"git.gammaspectra.live/git/go-away/lib/policy"
+	"git.gammaspectra.live/git/go-away/lib/settings"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+const testIssuerName = "issuer.example.com"
+
+// testIssuer Signs tokens as a Blind RSA issuer would, the unblinded result is a RSASSA-PSS SHA-384 signature
+type testIssuer struct {
+	key     *rsa.PrivateKey
+	encoded []byte
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// SubjectPublicKeyInfo with RSASSA-PSS algorithm, as published on issuer directories
+	encoded, err := asn1.Marshal(struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 10}},
+		PublicKey: asn1.BitString{Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey), BitLength: len(x509.MarshalPKCS1PublicKey(&key.PublicKey)) * 8},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testIssuer{key: key, encoded: encoded}
+}
+
+type tokenOptions struct {
+	nonce      [32]byte
+	keyId      []byte
+	badSig     bool
+	issuerName string
+}
+
+// Token Creates a token for the challenge sent on WWW-Authenticate
+func (i *testIssuer) Token(t *testing.T, challenge []byte, opts tokenOptions) []byte {
+	if opts.issuerName != "" {
+		challenge = replaceIssuerName(t, challenge, opts.issuerName)
+	}
+	keyId := sha256.Sum256(i.encoded)
+	if opts.keyId != nil {
+		copy(keyId[:], opts.keyId)
+	}
+	challengeDigest := sha256.Sum256(challenge)
+
+	input := binary.BigEndian.AppendUint16(nil, 0x0002)
+	input = append(input, opts.nonce[:]...)
+	input = append(input, challengeDigest[:]...)
+	input = append(input, keyId[:]...)
+
+	digest := sha512.Sum384(input)
+	signature, err := rsa.SignPSS(rand.Reader, i.key, crypto.SHA384, digest[:], &rsa.PSSOptions{
+		SaltLength: sha512.Size384,
+		Hash:       crypto.SHA384,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.badSig {
+		signature[len(signature)/2] ^= 0xff
+	}
+	return append(input, signature...)
+}
+
+// replaceIssuerName Rewrites issuer_name of an encoded TokenChallenge
+func replaceIssuerName(t *testing.T, challenge []byte, name string) []byte {
+	if len(challenge) < 4 {
+		t.Fatal("short challenge")
+	}
+	n := int(binary.BigEndian.Uint16(challenge[2:]))
+	out := bytes.Clone(challenge[:2])
+	out = binary.BigEndian.AppendUint16(out, uint16(len(name)))
+	out = append(out, name...)
+	return append(out, challenge[4+n:]...)
+}
+
+func newTestState(t *testing.T, issuer *testIssuer) *lib.State {
+	policyData := fmt.Sprintf(`
+challenges:
+  privacy-pass:
+    runtime: privacy-pass
+    parameters:
+      issuer-name: %q
+      token-key: %q
+rules:
+  - name: all
+    conditions: ['true']
+    action: challenge
+    settings:
+      challenges: [privacy-pass]
+`, testIssuerName, base64.RawURLEncoding.EncodeToString(issuer.encoded))
+
+	p, err := policy.NewPolicy(bytes.NewReader([]byte(policyData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := lib.NewState(*p, settings.DefaultSettings, policy.StateSettings{
+		Backends: map[string]http.Handler{
+			"*": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Backend", "1")
+				w.WriteHeader(http.StatusOK)
+			}),
+		},
+		PrivateKeySeed: make([]byte, 32),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = state.Close()
+	})
+	return state
+}
+
+var challengeParameter = regexp.MustCompile(`challenge="([^"]+)"`)
+
+func getChallenge(t *testing.T, state *lib.State) []byte {
+	w := httptest.NewRecorder()
+	state.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	if w.Header().Get("X-Backend") != "" {
+		t.Fatal("request without token reached backend")
+	}
+	m := challengeParameter.FindStringSubmatch(w.Header().Get("WWW-Authenticate"))
+	if m == nil {
+		t.Fatalf("no PrivateToken challenge sent, got %q", w.Header().Get("WWW-Authenticate"))
+	}
+	challenge, err := base64.RawURLEncoding.DecodeString(m[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return challenge
+}
+
+// redeem Sends token and returns whether the request reached the backend
+func redeem(state *lib.State, token []byte) bool {
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	r.Header.Set("Authorization", fmt.Sprintf("PrivateToken token=%q", base64.RawURLEncoding.EncodeToString(token)))
+	w := httptest.NewRecorder()
+	state.ServeHTTP(w, r)
+	return w.Header().Get("X-Backend") != ""
+}
+
+func TestRedeem(t *testing.T) {
+	issuer := newTestIssuer(t)
+	state := newTestState(t, issuer)
+	challenge := getChallenge(t, state)
+
+	var nonce [32]byte
+	nonces := func() [32]byte {
+		nonce[0]++
+		return nonce
+	}
+
+	tests := []struct {
+		name string
+		opts tokenOptions
+		pass bool
+	}{
+		{name: "valid", opts: tokenOptions{nonce: nonces()}, pass: true},
+		{name: "wrong issuer name", opts: tokenOptions{nonce: nonces(), issuerName: "other.example.com"}},
+		{name: "wrong token key id", opts: tokenOptions{nonce: nonces(), keyId: bytes.Repeat([]byte{1}, 32)}},
+		{name: "bad signature", opts: tokenOptions{nonce: nonces(), badSig: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if pass := redeem(state, issuer.Token(t, challenge, tt.opts)); pass != tt.pass {
+				t.Errorf("expected pass %v, got %v", tt.pass, pass)
+			}
+		})
+	}
+}
+
+func TestDoubleSpend(t *testing.T) {
+	issuer := newTestIssuer(t)
+	state := newTestState(t, issuer)
+	challenge := getChallenge(t, state)
+
+	token := issuer.Token(t, challenge, tokenOptions{nonce: [32]byte{0xaa}})
+	if !redeem(state, token) {
+		t.Fatal("first redemption failed")
+	}
+	if redeem(state, token) {
+		t.Fatal("token with reused nonce was redeemed again")
+	}
+
+	// other nonces for the same challenge are still accepted
+	if !redeem(state, issuer.Token(t, challenge, tokenOptions{nonce: [32]byte{0xbb}})) {
+		t.Fatal("redemption with new nonce failed")
+	}
+}
@@ -0,0 +1,160 @@
+package privacy_pass
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TokenTypeBlindRSA Publicly verifiable Blind RSA (2048-bit) token type, RFC 9578
+const TokenTypeBlindRSA = 0x0002
+
+const (
+	nonceSize           = 32
+	challengeDigestSize = sha256.Size
+	tokenKeyIdSize      = sha256.Size
+)
+
+var (
+	oidRSAEncryption = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidRSASSAPSS     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 10}
+)
+
+var ErrInvalidToken = errors.New("invalid token")
+var ErrUnsupportedTokenType = errors.New("unsupported token type")
+
+// TokenChallenge As defined in RFC 9577 Section 2.1
+type TokenChallenge struct {
+	TokenType         uint16
+	IssuerName        string
+	RedemptionContext []byte
+	OriginInfo        string
+}
+
+func (c TokenChallenge) Marshal() []byte {
+	buf := binary.BigEndian.AppendUint16(nil, c.TokenType)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(c.IssuerName)))
+	buf = append(buf, c.IssuerName...)
+	buf = append(buf, uint8(len(c.RedemptionContext)))
+	buf = append(buf, c.RedemptionContext...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(c.OriginInfo)))
+	buf = append(buf, c.OriginInfo...)
+	return buf
+}
+
+// Token As defined in RFC 9577 Section 2.2
+type Token struct {
+	TokenType       uint16
+	Nonce           [nonceSize]byte
+	ChallengeDigest [challengeDigestSize]byte
+	TokenKeyId      [tokenKeyIdSize]byte
+	Authenticator   []byte
+}
+
+func UnmarshalToken(data []byte) (t Token, err error) {
+	const headerSize = 2 + nonceSize + challengeDigestSize + tokenKeyIdSize
+	if len(data) <= headerSize {
+		return Token{}, ErrInvalidToken
+	}
+	t.TokenType = binary.BigEndian.Uint16(data)
+	copy(t.Nonce[:], data[2:])
+	copy(t.ChallengeDigest[:], data[2+nonceSize:])
+	copy(t.TokenKeyId[:], data[2+nonceSize+challengeDigestSize:])
+	t.Authenticator = data[headerSize:]
+	return t, nil
+}
+
+// AuthenticatorInput Token fields covered by the authenticator
+func (t Token) AuthenticatorInput() []byte {
+	buf := binary.BigEndian.AppendUint16(nil, t.TokenType)
+	buf = append(buf, t.Nonce[:]...)
+	buf = append(buf, t.ChallengeDigest[:]...)
+	buf = append(buf, t.TokenKeyId[:]...)
+	return buf
+}
+
+// IssuerKey Public key of a Blind RSA issuer
+type IssuerKey struct {
+	PublicKey *rsa.PublicKey
+	// Encoded SubjectPublicKeyInfo, as sent on token-key
+	Encoded []byte
+	Id      [tokenKeyIdSize]byte
+}
+
+// ParseIssuerKey Parses a SubjectPublicKeyInfo with RSASSA-PSS or rsaEncryption algorithm
+// Accepts PEM, or base64 / base64url with or without padding as published on issuer directories
+func ParseIssuerKey(data string) (*IssuerKey, error) {
+	data = strings.TrimSpace(data)
+
+	var der []byte
+	if block, _ := pem.Decode([]byte(data)); block != nil {
+		der = block.Bytes
+	} else {
+		var err error
+		der, err = decodeBase64(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if rest, err := asn1.Unmarshal(der, &spki); err != nil {
+		return nil, err
+	} else if len(rest) > 0 {
+		return nil, errors.New("trailing data after public key")
+	}
+	if !spki.Algorithm.Algorithm.Equal(oidRSASSAPSS) && !spki.Algorithm.Algorithm.Equal(oidRSAEncryption) {
+		return nil, fmt.Errorf("unsupported public key algorithm %s", spki.Algorithm.Algorithm)
+	}
+
+	publicKey, err := x509.ParsePKCS1PublicKey(spki.PublicKey.RightAlign())
+	if err != nil {
+		return nil, err
+	}
+
+	return &IssuerKey{
+		PublicKey: publicKey,
+		Encoded:   der,
+		Id:        sha256.Sum256(der),
+	}, nil
+}
+
+// Verify Checks the token authenticator, as RSASSA-PSS with SHA-384 and 48 byte salt
+func (k *IssuerKey) Verify(t Token) error {
+	if t.TokenType != TokenTypeBlindRSA {
+		return ErrUnsupportedTokenType
+	}
+	if t.TokenKeyId != k.Id {
+		return errors.New("token key id mismatch")
+	}
+	if len(t.Authenticator) != k.PublicKey.Size() {
+		return ErrInvalidToken
+	}
+
+	digest := sha512.Sum384(t.AuthenticatorInput())
+	return rsa.VerifyPSS(k.PublicKey, crypto.SHA384, digest[:], t.Authenticator, &rsa.PSSOptions{
+		SaltLength: sha512.Size384,
+		Hash:       crypto.SHA384,
+	})
+}
+
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	if strings.ContainsAny(s, "+/") {
+		return base64.RawStdEncoding.DecodeString(s)
+	}
+	return base64.RawURLEncoding.DecodeString(s)
+}
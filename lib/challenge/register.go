@@ -9,6 +9,7 @@ import (
 	"io"
 	"net/http"
 	"path"
+	"slices"
 	"strings"
 	"time"
 )
@@ -53,6 +54,22 @@ var MinimalKeyHeaders = []string{
 	"User-Agent",
 }
 
+const (
+	DefaultKeyIPv4Prefix = 24
+	DefaultKeyIPv6Prefix = 64
+)
+
+// KeyPrefixes Loosest client network prefix lengths across all challenges
+// State shared across challenges must be bound to these so no challenge is bound more strictly than configured
+func (r Register) KeyPrefixes() (ipv4, ipv6 int) {
+	ipv4, ipv6 = DefaultKeyIPv4Prefix, DefaultKeyIPv6Prefix
+	for _, c := range r {
+		ipv4 = min(ipv4, c.KeyIPv4Prefix)
+		ipv6 = min(ipv6, c.KeyIPv6Prefix)
+	}
+	return ipv4, ipv6
+}
+
 func (r Register) Create(state StateInterface, name string, pol policy.Challenge, replacer *strings.Replacer) (*Registration, Id, error) {
 	runtime, ok := Runtimes[pol.Runtime]
 	if !ok {
@@ -64,6 +81,9 @@ func (r Register) Create(state StateInterface, name string, pol policy.Challenge
 		Path:       path.Join(state.UrlPath(), "challenge", name),
 		Duration:   pol.Duration,
 		KeyHeaders: DefaultKeyHeaders,
+
+		KeyIPv4Prefix: DefaultKeyIPv4Prefix,
+		KeyIPv6Prefix: DefaultKeyIPv6Prefix,
 	}
 
 	if reg.Duration == 0 {
@@ -98,10 +118,86 @@ func (r Register) Create(state StateInterface, name string, pol policy.Challenge
 	if err != nil {
 		return nil, 0, fmt.Errorf("error filling registration: %v", err)
 	}
+
+	// policy overrides runtime defaults
+	if pol.Key != nil {
+		if pol.Key.Headers != nil {
+			reg.KeyHeaders = pol.Key.Headers
+		}
+		if pol.Key.IPv4Prefix != nil {
+			if *pol.Key.IPv4Prefix < 0 || *pol.Key.IPv4Prefix > 32 {
+				return nil, 0, fmt.Errorf("invalid ipv4-prefix %d", *pol.Key.IPv4Prefix)
+			}
+			reg.KeyIPv4Prefix = *pol.Key.IPv4Prefix
+		}
+		if pol.Key.IPv6Prefix != nil {
+			if *pol.Key.IPv6Prefix < 0 || *pol.Key.IPv6Prefix > 128 {
+				return nil, 0, fmt.Errorf("invalid ipv6-prefix %d", *pol.Key.IPv6Prefix)
+			}
+			reg.KeyIPv6Prefix = *pol.Key.IPv6Prefix
+		}
+		if pol.Key.DisableIP {
+			reg.KeyIPv4Prefix, reg.KeyIPv6Prefix = 0, 0
+		}
+	}
+
+	if pol.Reuse != nil {
+		reg.Reuse, err = NewTokenReuse(state.Settings().SharedState, reg.Name, *pol.Reuse)
+		if err != nil {
+			return nil, 0, fmt.Errorf("error configuring reuse: %w", err)
+		}
+	}
+
+	if pol.Renewal != nil {
+		if pol.Renewal.Window <= 0 || pol.Renewal.Window >= 100 {
+			return nil, 0, fmt.Errorf("invalid renewal window %g", pol.Renewal.Window)
+		}
+		if pol.Renewal.MaxLifetime < 0 {
+			return nil, 0, fmt.Errorf("invalid renewal max-lifetime %s", pol.Renewal.MaxLifetime)
+		}
+		reg.RenewWindow = pol.Renewal.Window / 100
+		reg.MaxLifetime = pol.Renewal.MaxLifetime
+	}
 	r[reg.id] = reg
 	return reg, reg.id, nil
 }
 
+// Resolve Checks members of all challenges, then calls Registration.Resolve.
+// Must be called after all challenges are registered
+func (r Register) Resolve() error {
+	for _, reg := range r {
+		if err := r.checkMembers(reg, nil); err != nil {
+			return fmt.Errorf("challenge %s: %w", reg.Name, err)
+		}
+	}
+	for _, reg := range r {
+		if reg.Resolve != nil {
+			if err := reg.Resolve(); err != nil {
+				return fmt.Errorf("challenge %s: %w", reg.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkMembers Walks members of reg, failing on unknown names or on challenges that contain themselves
+func (r Register) checkMembers(reg *Registration, parents []string) error {
+	parents = append(parents, reg.Name)
+	for _, name := range reg.Members {
+		if slices.Contains(parents, name) {
+			return fmt.Errorf("challenge contains itself via %s", strings.Join(append(parents, name), " -> "))
+		}
+		m, _, ok := r.GetByName(name)
+		if !ok {
+			return fmt.Errorf("member challenge %s not found", name)
+		}
+		if err := r.checkMembers(m, parents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (r Register) Add(c *Registration) Id {
 	if _, oldId, ok := r.GetByName(c.Name); ok {
 		c.id = oldId
@@ -148,6 +244,35 @@ type Registration struct {
 	// KeyHeaders The client headers used in key generation, in this order
 	KeyHeaders []string
 
+	// KeyIPv4Prefix KeyIPv6Prefix Prefix lengths of the client address used in key generation.
+	// Zero disables binding keys to the client address
+	KeyIPv4Prefix int
+	KeyIPv6Prefix int
+
+	// Reuse If set, tokens presented by too many distinct clients are revoked
+	Reuse *TokenReuse
+
+	// RenewWindow Fraction of Duration before expiry within which valid tokens are reissued when used.
+	// Zero disables renewal
+	RenewWindow float64
+
+	// MaxLifetime Renewed tokens are not extended past this since first issued. Zero for unlimited
+	MaxLifetime time.Duration
+
+	// BackendHeaders Request headers set towards the backend from values exposed via challengeData, when this challenge passed.
+	// Client sent values of these are removed from every request
+	BackendHeaders map[string]string
+
+	// StripCredentials If set, removes credentials read by this challenge from requests towards the backend
+	StripCredentials func(r *http.Request)
+
+	// Members Names of other challenges this challenge issues or verifies.
+	// These must exist, and must not contain this challenge in turn
+	Members []string
+
+	// Resolve If set, called on policy load once all challenges are registered, to look up Members
+	Resolve func() error
+
 	// IssueChallenge Issues a challenge to a request.
 	// If Class is ClassTransparent and VerifyResult is !VerifyResult.Ok(), continue with other challenges
 	// TODO: have this return error as well
@@ -0,0 +1,127 @@
+package challenge
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"git.gammaspectra.live/git/go-away/lib/policy"
+	"git.gammaspectra.live/git/go-away/utils"
+	"time"
+)
+
+var ErrTokenReused = errors.New("token: shared across too many clients")
+
+const (
+	DefaultReuseWindow     = time.Hour
+	DefaultReuseIPv4Prefix = 32
+	DefaultReuseIPv6Prefix = 128
+)
+
+// TokenReuse Counts distinct clients presenting the same challenge token over a sliding window,
+// revoking tokens presented by more than Threshold clients
+// Clients are told apart by their network prefix and JA4 fingerprint
+type TokenReuse struct {
+	Window    time.Duration
+	Threshold int64
+
+	IPv4Prefix int
+	IPv6Prefix int
+
+	// seen Markers of clients that presented a token, per window bucket
+	seen *utils.StateCounter[string]
+	// clients Distinct clients that presented a token, per window bucket
+	clients *utils.StateCounter[string]
+	// revoked Tokens that went over Threshold, until they expire
+	revoked *utils.StateCounter[string]
+}
+
+func NewTokenReuse(shared utils.SharedState, name string, pol policy.ChallengeReuse) (*TokenReuse, error) {
+	t := &TokenReuse{
+		Window:     pol.Window,
+		Threshold:  int64(pol.Threshold),
+		IPv4Prefix: DefaultReuseIPv4Prefix,
+		IPv6Prefix: DefaultReuseIPv6Prefix,
+		seen:       utils.NewStateCounter[string](shared, "go-away:reuse:"+name+":seen:"),
+		clients:    utils.NewStateCounter[string](shared, "go-away:reuse:"+name+":clients:"),
+		revoked:    utils.NewStateCounter[string](shared, "go-away:reuse:"+name+":revoked:"),
+	}
+	if t.Window == 0 {
+		t.Window = DefaultReuseWindow
+	} else if t.Window < 0 {
+		return nil, fmt.Errorf("invalid window %s", t.Window)
+	}
+	if t.Threshold < 0 {
+		return nil, fmt.Errorf("invalid threshold %d", t.Threshold)
+	}
+	if pol.IPv4Prefix != nil {
+		if *pol.IPv4Prefix < 0 || *pol.IPv4Prefix > 32 {
+			return nil, fmt.Errorf("invalid ipv4-prefix %d", *pol.IPv4Prefix)
+		}
+		t.IPv4Prefix = *pol.IPv4Prefix
+	}
+	if pol.IPv6Prefix != nil {
+		if *pol.IPv6Prefix < 0 || *pol.IPv6Prefix > 128 {
+			return nil, fmt.Errorf("invalid ipv6-prefix %d", *pol.IPv6Prefix)
+		}
+		t.IPv6Prefix = *pol.IPv6Prefix
+	}
+	return t, nil
+}
+
+func tokenReuseId(token TokenChallenge) string {
+	hasher := sha256.New()
+	hasher.Write(token.Key)
+	hasher.Write([]byte{0})
+	hasher.Write(token.Result)
+	hasher.Write([]byte{0})
+	hasher.Write([]byte(token.Id))
+	return hex.EncodeToString(hasher.Sum(nil)[:16])
+}
+
+// Observe Records the request client as presenting token,
+// and returns the number of distinct clients that presented it within Window, and whether it has been revoked
+func (t *TokenReuse) Observe(d *RequestData, token TokenChallenge) (sharedCount int64, revoked bool) {
+	id := tokenReuseId(token)
+
+	prefix := d.networkPrefix(t.IPv4Prefix, t.IPv6Prefix).As16()
+	hasher := sha256.New()
+	hasher.Write(prefix[:])
+	hasher.Write([]byte{0})
+	hasher.Write([]byte(d.fp["ja4"]))
+	client := hex.EncodeToString(hasher.Sum(nil)[:8])
+
+	// sliding window over two fixed buckets
+	now := d.Time.UnixNano()
+	bucket := now / int64(t.Window)
+	elapsed := float64(now%int64(t.Window)) / float64(t.Window)
+
+	current := t.clients.Get(fmt.Sprintf("%s:%d", id, bucket))
+	if t.seen.Incr(fmt.Sprintf("%s:%d:%s", id, bucket, client), t.Window*2) == 1 {
+		current = t.clients.Incr(fmt.Sprintf("%s:%d", id, bucket), t.Window*2)
+	}
+	previous := t.clients.Get(fmt.Sprintf("%s:%d", id, bucket-1))
+
+	// clients are likely seen in both buckets, so do not add them
+	sharedCount = max(current, int64(float64(previous)*(1-elapsed)))
+
+	if t.revoked.Get(id) > 0 {
+		// the window may have moved on since revocation, report it as still over threshold
+		return max(sharedCount, t.Threshold+1), true
+	}
+
+	if t.Threshold > 0 && sharedCount > t.Threshold {
+		if ttl := token.Expiry.Time().Sub(d.Time); ttl > 0 {
+			t.revoked.Incr(id, ttl)
+		}
+		return sharedCount, true
+	}
+	return sharedCount, false
+}
+
+// Decay Removes expired entries, shared state expires them itself
+func (t *TokenReuse) Decay() {
+	t.seen.Decay()
+	t.clients.Decay()
+	t.revoked.Decay()
+}
@@ -0,0 +1,143 @@
+package signed_url
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"git.gammaspectra.live/git/go-away/lib/challenge"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	QueryArgExpires   = challenge.QueryArgPrefix + "_expires"
+	QueryArgNetwork   = challenge.QueryArgPrefix + "_network"
+	QueryArgSignature = challenge.QueryArgPrefix + "_signature"
+)
+
+// SigningKey Keys used to sign and verify URLs. Only one of HMAC or Ed25519 keys is used
+type SigningKey struct {
+	HMAC []byte
+
+	PublicKey  ed25519.PublicKey
+	PrivateKey ed25519.PrivateKey
+}
+
+var ErrInvalidSignature = errors.New("invalid signature")
+var ErrExpired = errors.New("signed url expired")
+var ErrNetworkMismatch = errors.New("signed url not valid for client network")
+var ErrNoHost = errors.New("signed url has no host")
+
+// message Builds the signed message covering host, path, expiry and optional client network prefix
+func message(host, path string, expires int64, network string) []byte {
+	var buf []byte
+	buf = append(buf, "signed-url\x00"...)
+	buf = append(buf, strings.ToLower(host)...)
+	buf = append(buf, 0)
+	buf = append(buf, path...)
+	buf = append(buf, 0)
+	buf = strconv.AppendInt(buf, expires, 10)
+	buf = append(buf, 0)
+	buf = append(buf, network...)
+	buf = append(buf, 0)
+	return buf
+}
+
+func (k SigningKey) sign(msg []byte) ([]byte, error) {
+	if len(k.HMAC) > 0 {
+		mac := hmac.New(sha256.New, k.HMAC)
+		mac.Write(msg)
+		return mac.Sum(nil), nil
+	}
+	if k.PrivateKey == nil {
+		return nil, errors.New("no private key")
+	}
+	return ed25519.Sign(k.PrivateKey, msg), nil
+}
+
+func (k SigningKey) verify(msg, signature []byte) bool {
+	if len(k.HMAC) > 0 {
+		mac := hmac.New(sha256.New, k.HMAC)
+		mac.Write(msg)
+		return hmac.Equal(mac.Sum(nil), signature)
+	}
+	return ed25519.Verify(k.PublicKey, msg, signature)
+}
+
+// Sign Adds signature query arguments to the URL, which must be absolute. If network is valid, the URL is only valid for clients within it
+func (k SigningKey) Sign(u *url.URL, expires time.Time, network netip.Prefix) error {
+	if u.Host == "" {
+		return ErrNoHost
+	}
+
+	q := u.Query()
+	q.Del(QueryArgExpires)
+	q.Del(QueryArgNetwork)
+	q.Del(QueryArgSignature)
+
+	var networkStr string
+	if network.IsValid() {
+		networkStr = network.Masked().String()
+		q.Set(QueryArgNetwork, networkStr)
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	signature, err := k.sign(message(u.Host, path, expires.Unix(), networkStr))
+	if err != nil {
+		return err
+	}
+
+	q.Set(QueryArgExpires, strconv.FormatInt(expires.Unix(), 10))
+	q.Set(QueryArgSignature, base64.RawURLEncoding.EncodeToString(signature))
+	u.RawQuery = q.Encode()
+	return nil
+}
+
+// Verify Checks the signature query arguments of the URL requested on host for a client address, and returns when the URL expires
+func (k SigningKey) Verify(host string, u *url.URL, addr netip.Addr) (expires time.Time, err error) {
+	q := u.Query()
+
+	expiresUnix, err := strconv.ParseInt(q.Get(QueryArgExpires), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	expires = time.Unix(expiresUnix, 0)
+	if expires.Before(time.Now()) {
+		return time.Time{}, ErrExpired
+	}
+
+	networkStr := q.Get(QueryArgNetwork)
+	if networkStr != "" {
+		network, err := netip.ParsePrefix(networkStr)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if !network.Contains(addr.Unmap()) {
+			return time.Time{}, ErrNetworkMismatch
+		}
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(q.Get(QueryArgSignature))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	if !k.verify(message(host, path, expiresUnix, networkStr), signature) {
+		return time.Time{}, ErrInvalidSignature
+	}
+	return expires, nil
+}
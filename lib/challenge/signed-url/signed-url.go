@@ -0,0 +1,114 @@
+package signed_url
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"git.gammaspectra.live/git/go-away/lib/challenge"
+	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/ast"
+	"net/http"
+	"time"
+)
+
+func init() {
+	challenge.Runtimes[Key] = FillRegistration
+}
+
+const Key = "signed-url"
+
+type Parameters struct {
+	// HMACKey Hex encoded secret to verify HMAC-SHA256 signatures
+	HMACKey string `yaml:"hmac-key"`
+
+	// PublicKey Hex encoded Ed25519 public key to verify signatures.
+	// If neither this nor hmac-key are set, the key of go-away's private key seed is used
+	PublicKey string `yaml:"public-key"`
+}
+
+var DefaultParameters = Parameters{}
+
+func ParseParameters(parameters ast.Node) (Parameters, error) {
+	params := DefaultParameters
+
+	if parameters != nil {
+		ymlData, err := parameters.MarshalYAML()
+		if err != nil {
+			return Parameters{}, err
+		}
+		err = yaml.Unmarshal(ymlData, &params)
+		if err != nil {
+			return Parameters{}, err
+		}
+	}
+	return params, nil
+}
+
+// SigningKey Returns the verification key for these parameters. fallback is used when no key is configured
+func (p Parameters) SigningKey(fallback ed25519.PublicKey) (SigningKey, error) {
+	if p.HMACKey != "" && p.PublicKey != "" {
+		return SigningKey{}, errors.New("only one of hmac-key or public-key can be set")
+	}
+
+	if p.HMACKey != "" {
+		secret, err := hex.DecodeString(p.HMACKey)
+		if err != nil {
+			return SigningKey{}, fmt.Errorf("hmac-key: %w", err)
+		}
+		if len(secret) < 16 {
+			return SigningKey{}, errors.New("hmac-key: too short, expected at least 16 bytes")
+		}
+		return SigningKey{HMAC: secret}, nil
+	}
+
+	if p.PublicKey != "" {
+		pub, err := hex.DecodeString(p.PublicKey)
+		if err != nil {
+			return SigningKey{}, fmt.Errorf("public-key: %w", err)
+		}
+		if len(pub) != ed25519.PublicKeySize {
+			return SigningKey{}, fmt.Errorf("public-key: invalid length %d, expected %d", len(pub), ed25519.PublicKeySize)
+		}
+		return SigningKey{PublicKey: pub}, nil
+	}
+
+	if fallback == nil {
+		return SigningKey{}, errors.New("one of hmac-key, public-key or a private key seed is required")
+	}
+	return SigningKey{PublicKey: fallback}, nil
+}
+
+func FillRegistration(state challenge.StateInterface, reg *challenge.Registration, parameters ast.Node) error {
+	params, err := ParseParameters(parameters)
+	if err != nil {
+		return err
+	}
+
+	signingKey, err := params.SigningKey(state.SeedPublicKey())
+	if err != nil {
+		return err
+	}
+
+	reg.Class = challenge.ClassTransparent
+
+	reg.IssueChallenge = func(w http.ResponseWriter, r *http.Request, key challenge.Key, expiry time.Time) challenge.VerifyResult {
+		if !r.URL.Query().Has(QueryArgSignature) {
+			// skip unsigned requests
+			return challenge.VerifyResultSkip
+		}
+
+		data := challenge.RequestDataFromContext(r.Context())
+
+		_, err := signingKey.Verify(r.Host, r.URL, data.RemoteAddress.Addr())
+		if err != nil {
+			state.Logger(r).Debug("invalid signed url", "challenge", reg.Name, "error", err)
+			return challenge.VerifyResultFail
+		}
+
+		// no token is issued, the signature only covers this url
+		return challenge.VerifyResultOK
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package tls_client_cert
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"git.gammaspectra.live/git/go-away/lib/challenge"
+	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/ast"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+func init() {
+	challenge.Runtimes[Key] = FillRegistration
+}
+
+const Key = "tls-client-cert"
+
+type Parameters struct {
+	// Subjects Regular expressions matched against the full certificate subject, for example "CN=client,O=Example"
+	Subjects []string `yaml:"subjects"`
+
+	// SANs Regular expressions matched against certificate DNS, email, URI and IP subject alternative names
+	SANs []string `yaml:"sans"`
+}
+
+var DefaultParameters = Parameters{}
+
+func compilePatterns(patterns []string) (result []*regexp.Regexp, err error) {
+	for _, p := range patterns {
+		// match full value
+		re, err := regexp.Compile("^(?:" + p + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("pattern %s: %w", p, err)
+		}
+		result = append(result, re)
+	}
+	return result, nil
+}
+
+func subjectAlternativeNames(cert *x509.Certificate) (sans []string) {
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		sans = append(sans, u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	return sans
+}
+
+// verifiedCertificate Returns the leaf certificate of the connection if it was verified against the client CAs
+func verifiedCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+func fingerprint(cert *x509.Certificate) []byte {
+	sum := sha256.Sum256(cert.Raw)
+	return sum[:]
+}
+
+func FillRegistration(state challenge.StateInterface, reg *challenge.Registration, parameters ast.Node) error {
+	params := DefaultParameters
+
+	if parameters != nil {
+		ymlData, err := parameters.MarshalYAML()
+		if err != nil {
+			return err
+		}
+		err = yaml.Unmarshal(ymlData, &params)
+		if err != nil {
+			return err
+		}
+	}
+
+	subjects, err := compilePatterns(params.Subjects)
+	if err != nil {
+		return err
+	}
+	sans, err := compilePatterns(params.SANs)
+	if err != nil {
+		return err
+	}
+
+	reg.Class = challenge.ClassTransparent
+
+	matches := func(cert *x509.Certificate) bool {
+		if len(subjects) == 0 && len(sans) == 0 {
+			// any verified certificate
+			return true
+		}
+		subject := cert.Subject.String()
+		for _, re := range subjects {
+			if re.MatchString(subject) {
+				return true
+			}
+		}
+		for _, name := range subjectAlternativeNames(cert) {
+			for _, re := range sans {
+				if re.MatchString(name) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	// client certificates are sent per connection, always check the token belongs to the current one
+	reg.VerifyProbability = 1
+	reg.Verify = func(key challenge.Key, token []byte, r *http.Request) (challenge.VerifyResult, error) {
+		cert := verifiedCertificate(r)
+		if cert == nil {
+			return challenge.VerifyResultFail, nil
+		}
+		if subtle.ConstantTimeCompare(token, fingerprint(cert)) != 1 {
+			return challenge.VerifyResultFail, nil
+		}
+		return challenge.VerifyResultOK, nil
+	}
+
+	reg.IssueChallenge = func(w http.ResponseWriter, r *http.Request, key challenge.Key, expiry time.Time) challenge.VerifyResult {
+		cert := verifiedCertificate(r)
+		if cert == nil {
+			// no certificate was presented, or TLS is not enabled
+			return challenge.VerifyResultSkip
+		}
+
+		if !matches(cert) {
+			state.Logger(r).Debug("client certificate did not match", "challenge", reg.Name, "subject", cert.Subject.String())
+			return challenge.VerifyResultFail
+		}
+
+		result := fingerprint(cert)
+
+		data := challenge.RequestDataFromContext(r.Context())
+		data.IssueChallengeToken(reg, key, result, expiry, true)
+		_ = data.SetChallengeData(reg, map[string]any{
+			"subject":     cert.Subject.String(),
+			"commonName":  cert.Subject.CommonName,
+			"issuer":      cert.Issuer.String(),
+			"fingerprint": hex.EncodeToString(result),
+			"sans":        subjectAlternativeNames(cert),
+		})
+		return challenge.VerifyResultOK
+	}
+
+	return nil
+}
@@ -86,6 +86,7 @@ func (r VerifyResult) String() string {
 }
 
 type StateInterface interface {
+	ProgramEnv() *cel.Env
 	RegisterCondition(operator string, conditions ...string) (cel.Program, error)
 
 	Client() *http.Client
@@ -93,6 +94,12 @@ type StateInterface interface {
 	PrivateKey() ed25519.PrivateKey
 	PublicKey() ed25519.PublicKey
 
+	// SeedPublicKey Public key of the private key seed, kept across key rotations. nil if no seed is used
+	SeedPublicKey() ed25519.PublicKey
+
+	// SigningKeys Active and verify-only keys for state, active key is the one returned by PrivateKey
+	SigningKeys() *utils.KeySet
+
 	UrlPath() string
 
 	ChallengeFailed(r *http.Request, reg *Registration, err error, redirect string, logger *slog.Logger)
@@ -115,6 +122,9 @@ type StateInterface interface {
 
 	Settings() policy.StateSettings
 
+	// RequestsInFlight Number of requests currently being processed
+	RequestsInFlight() int64
+
 	Strings() utils.Strings
 
 	GetBackend(host string) http.Handler
@@ -0,0 +1,42 @@
+package wasm
+
+import (
+	"context"
+	_interface "git.gammaspectra.live/git/go-away/lib/challenge/wasm/interface"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// Backend Makes and verifies challenges served under the js runtime routes
+// Implemented by WASM modules via RunnerBackend, or natively in Go
+type Backend interface {
+	MakeChallenge(in _interface.MakeChallengeInput) (*_interface.MakeChallengeOutput, error)
+	VerifyChallenge(in _interface.VerifyChallengeInput) (_interface.VerifyChallengeOutput, error)
+}
+
+// RunnerBackend Backend calling into a module compiled on Runner under Key
+type RunnerBackend struct {
+	Runner *Runner
+	Key    string
+}
+
+func (b RunnerBackend) MakeChallenge(in _interface.MakeChallengeInput) (out *_interface.MakeChallengeOutput, err error) {
+	err = b.Runner.Instantiate(b.Key, func(ctx context.Context, mod api.Module) (err error) {
+		out, err = MakeChallengeCall(ctx, mod, in)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (b RunnerBackend) VerifyChallenge(in _interface.VerifyChallengeInput) (out _interface.VerifyChallengeOutput, err error) {
+	err = b.Runner.Instantiate(b.Key, func(ctx context.Context, mod api.Module) (err error) {
+		out, err = VerifyChallengeCall(ctx, mod, in)
+		return err
+	})
+	if err != nil {
+		return _interface.VerifyChallengeOutputError, err
+	}
+	return out, nil
+}
@@ -0,0 +1,232 @@
+package wasm
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"git.gammaspectra.live/git/go-away/lib/challenge"
+	"git.gammaspectra.live/git/go-away/utils"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/interpreter"
+	"log/slog"
+	"maps"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// settingKind Kind of value a setting takes, inferred from its static value
+// Evaluated values must be of the same kind, as runtimes would fail parsing them otherwise
+type settingKind int
+
+const (
+	settingString = settingKind(iota)
+	settingUint
+	settingInt
+	settingBool
+)
+
+func newSettingKind(static string) settingKind {
+	if _, err := strconv.ParseUint(static, 10, 64); err == nil {
+		return settingUint
+	} else if _, err = strconv.ParseInt(static, 10, 64); err == nil {
+		return settingInt
+	} else if _, err = strconv.ParseBool(static); err == nil {
+		return settingBool
+	}
+	return settingString
+}
+
+// outputTypes Expression output types accepted for settings of this kind
+func (k settingKind) outputTypes() []*types.Type {
+	switch k {
+	case settingUint, settingInt:
+		return []*types.Type{types.IntType, types.UintType}
+	case settingBool:
+		return []*types.Type{types.BoolType}
+	default:
+		return []*types.Type{types.StringType, types.IntType, types.UintType}
+	}
+}
+
+// Valid Whether value can be passed to the runtime for a setting of this kind
+func (k settingKind) Valid(value string) bool {
+	var err error
+	switch k {
+	case settingUint:
+		_, err = strconv.ParseUint(value, 10, 64)
+	case settingInt:
+		_, err = strconv.ParseInt(value, 10, 64)
+	case settingBool:
+		_, err = strconv.ParseBool(value)
+	}
+	return err == nil
+}
+
+// settingsExpressions Evaluates per request runtime settings
+type settingsExpressions struct {
+	name     string
+	programs map[string]cel.Program
+	kinds    map[string]settingKind
+	window   time.Duration
+
+	// issued Number of times the challenge was issued per network prefix
+	issued *utils.StateCounter[netip.Addr]
+
+	state challenge.StateInterface
+}
+
+// newSettingsExpressions Compiles expressions for settings, each requires a static value in settings to fall back to
+func newSettingsExpressions(state challenge.StateInterface, name string, expressions, settings map[string]string, window time.Duration) (*settingsExpressions, error) {
+	env, err := state.ProgramEnv().Extend(
+		// number of times this challenge has been issued to the client network within window
+		cel.Variable("challengeIssued", cel.IntType),
+		// number of requests currently being processed
+		cel.Variable("requestsInFlight", cel.IntType),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &settingsExpressions{
+		name:     name,
+		programs: make(map[string]cel.Program, len(expressions)),
+		kinds:    make(map[string]settingKind, len(expressions)),
+		window:   window,
+		issued:   utils.NewStateCounter[netip.Addr](state.Settings().SharedState, "go-away:wasm:"+name+":"),
+		state:    state,
+	}
+
+	for k, expr := range expressions {
+		static, ok := settings[k]
+		if !ok {
+			return nil, fmt.Errorf("setting %s: a static value is required, used when evaluated values are invalid", k)
+		}
+		kind := newSettingKind(static)
+
+		ast, issues := env.Compile(expr)
+		if issues != nil && issues.Err() != nil {
+			return nil, fmt.Errorf("setting %s: %w", k, issues.Err())
+		}
+		if !slices.ContainsFunc(kind.outputTypes(), ast.OutputType().IsExactType) {
+			return nil, fmt.Errorf("setting %s: unsupported output type %s for static value %q", k, ast.OutputType(), static)
+		}
+		e.kinds[k] = kind
+		e.programs[k], err = env.Program(ast, cel.EvalOptions(cel.OptOptimize))
+		if err != nil {
+			return nil, fmt.Errorf("setting %s: %w", k, err)
+		}
+	}
+	return e, nil
+}
+
+// Issued Records a challenge issue towards the client network
+func (e *settingsExpressions) Issued(data *challenge.RequestData) {
+	e.issued.Incr(data.NetworkPrefix(), e.window)
+}
+
+// Evaluate Returns settings for this request
+func (e *settingsExpressions) Evaluate(data *challenge.RequestData) (map[string]string, error) {
+	issued := e.issued.Get(data.NetworkPrefix())
+
+	vars, err := interpreter.NewActivation(map[string]any{
+		"challengeIssued":  issued,
+		"requestsInFlight": e.state.RequestsInFlight(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	activation := interpreter.NewHierarchicalActivation(data, vars)
+
+	result := make(map[string]string, len(e.programs))
+	for k, program := range e.programs {
+		out, _, err := program.Eval(activation)
+		if err != nil {
+			return nil, fmt.Errorf("setting %s: %w", k, err)
+		}
+		str := out.ConvertToType(types.StringType)
+		if types.IsError(str) {
+			return nil, fmt.Errorf("setting %s: %v", k, str.Value())
+		}
+		value := str.Value().(string)
+		if !e.kinds[k].Valid(value) {
+			// such as negative values for unsigned settings, the static value is used instead
+			slog.Warn("invalid evaluated challenge setting, using static value", "challenge", e.name, "setting", k, "value", value)
+			continue
+		}
+		result[k] = value
+	}
+	return result, nil
+}
+
+// Validate Checks dynamic settings sent back by clients before they are passed to the runtime
+func (e *settingsExpressions) Validate(dynamic map[string]string) error {
+	for k, v := range dynamic {
+		if kind, ok := e.kinds[k]; ok && !kind.Valid(v) {
+			return fmt.Errorf("setting %s: invalid value %q", k, v)
+		}
+	}
+	return nil
+}
+
+func (e *settingsExpressions) Decay() {
+	e.issued.Decay()
+}
+
+// Merge Returns base settings with dynamic ones overriding them
+func (e *settingsExpressions) Merge(base, dynamic map[string]string) map[string]string {
+	settings := make(map[string]string, len(base)+len(dynamic))
+	maps.Copy(settings, base)
+	for k, v := range dynamic {
+		// only allow keys that have expressions
+		if _, ok := e.programs[k]; ok {
+			settings[k] = v
+		}
+	}
+	return settings
+}
+
+func encodeSettings(settings map[string]string) string {
+	values := make(url.Values, len(settings))
+	for k, v := range settings {
+		values.Set(k, v)
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(values.Encode()))
+}
+
+func decodeSettings(encoded string) (map[string]string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	values, err := url.ParseQuery(string(data))
+	if err != nil {
+		return nil, err
+	}
+	settings := make(map[string]string, len(values))
+	for k := range values {
+		settings[k] = values.Get(k)
+	}
+	return settings, nil
+}
+
+const settingsTokenSeparator = "."
+
+var errMissingSettings = errors.New("missing challenge settings")
+
+// splitSettingsToken Splits a token of the form <encoded settings>.<result>
+func splitSettingsToken(token []byte) (settings map[string]string, result []byte, err error) {
+	encoded, r, ok := strings.Cut(string(token), settingsTokenSeparator)
+	if !ok {
+		return nil, nil, errMissingSettings
+	}
+	settings, err = decodeSettings(encoded)
+	if err != nil {
+		return nil, nil, err
+	}
+	return settings, []byte(r), nil
+}
@@ -1,8 +1,8 @@
 package wasm
 
 import (
+	"bytes"
 	"codeberg.org/meta/gzipped/v2"
-	"context"
 	"errors"
 	"fmt"
 	"git.gammaspectra.live/git/go-away/embed"
@@ -12,12 +12,15 @@ import (
 	"git.gammaspectra.live/git/go-away/utils/inline"
 	"github.com/goccy/go-yaml"
 	"github.com/goccy/go-yaml/ast"
-	"github.com/tetratelabs/wazero/api"
 	"html/template"
 	"io"
 	"io/fs"
+	"log/slog"
 	"net/http"
+	"os"
 	"path"
+	"path/filepath"
+	"sync"
 	"time"
 )
 
@@ -35,14 +38,26 @@ type Parameters struct {
 
 	Settings map[string]string `yaml:"wasm-runtime-settings"`
 
+	// SettingsExpressions CEL expressions evaluated for each issued challenge, overriding entries in Settings
+	// Evaluated values are bound into the challenge key.
+	// Besides request properties, challengeIssued and requestsInFlight variables are available
+	SettingsExpressions map[string]string `yaml:"wasm-runtime-settings-expressions"`
+
+	// IssueCountWindow Period over which challenge issues are counted per client network prefix, for challengeIssued
+	IssueCountWindow time.Duration `yaml:"issue-count-window"`
+
 	NativeCompiler bool `yaml:"wasm-native-compiler"`
 
 	VerifyProbability float64 `yaml:"verify-probability"`
 }
 
+// ReloadInterval How often runtimes loaded from the challenge directory are checked for changes
+const ReloadInterval = time.Second * 5
+
 var DefaultParameters = Parameters{
 	VerifyProbability: 0.1,
 	NativeCompiler:    true,
+	IssueCountWindow:  time.Hour,
 }
 
 func FillJavaScriptRegistration(state challenge.StateInterface, reg *challenge.Registration, parameters ast.Node) error {
@@ -59,19 +74,80 @@ func FillJavaScriptRegistration(state challenge.StateInterface, reg *challenge.R
 		}
 	}
 
-	reg.Class = challenge.ClassBlocking
-
-	mux := http.NewServeMux()
-
 	if params.Path == "" {
 		params.Path = reg.Name
 	}
 
-	assetsFs, err := embed.GetFallbackFS(embed.ChallengeFs, params.Path)
+	assetsFs, assetsPath, err := GetChallengeFS(state.Settings().ChallengeDirectory, params.Path)
 	if err != nil {
 		return err
 	}
 
+	ob := NewRunner(params.NativeCompiler)
+
+	compileRuntime := func() error {
+		wasmData, err := assetsFs.ReadFile(path.Join("runtime", params.Runtime))
+		if err != nil {
+			return fmt.Errorf("could not load runtime: %w", err)
+		}
+
+		err = ob.Compile("runtime", wasmData)
+		if err != nil {
+			return fmt.Errorf("compiling runtime: %w", err)
+		}
+		return nil
+	}
+
+	if err = compileRuntime(); err != nil {
+		_ = ob.Close()
+		return err
+	}
+
+	// closed in order
+	closers := []io.Closer{ob}
+
+	if assetsPath != "" {
+		// hot reload runtime from challenge directory
+		watcher, err := utils.NewFileWatcher(ReloadInterval, func() {
+			if err := compileRuntime(); err != nil {
+				slog.Error("error reloading challenge runtime", "challenge", reg.Name, "path", assetsPath, "error", err)
+				return
+			}
+			slog.Warn("reloaded challenge runtime", "challenge", reg.Name, "path", assetsPath)
+		}, filepath.Join(assetsPath, "runtime", params.Runtime))
+		if err != nil {
+			_ = ob.Close()
+			return fmt.Errorf("watching runtime: %w", err)
+		}
+		// stop reloads before closing runtime
+		closers = append([]io.Closer{watcher}, closers...)
+	}
+
+	staticFs, err := fs.Sub(assetsFs, "static")
+	if err != nil {
+		_ = closeAll(closers...)
+		return fmt.Errorf("no static assets: %w", err)
+	}
+
+	err = FillBackendRegistration(state, reg, params, staticFs, RunnerBackend{
+		Runner: ob,
+		Key:    "runtime",
+	}, closers...)
+	if err != nil {
+		_ = closeAll(closers...)
+		return err
+	}
+	return nil
+}
+
+// FillBackendRegistration Fills reg to serve challenges made and verified by backend, with the same routes as the js runtime
+// Only settings, loader and verification parameters are used from params. staticFs is served under static/ and must contain the loader
+// closers are closed in order along reg.Object
+func FillBackendRegistration(state challenge.StateInterface, reg *challenge.Registration, params Parameters, staticFs fs.FS, backend Backend, closers ...io.Closer) (err error) {
+	reg.Class = challenge.ClassBlocking
+
+	mux := http.NewServeMux()
+
 	if params.VerifyProbability <= 0 {
 		//10% default
 		params.VerifyProbability = 0.1
@@ -81,18 +157,42 @@ func FillJavaScriptRegistration(state challenge.StateInterface, reg *challenge.R
 
 	reg.VerifyProbability = params.VerifyProbability
 
-	ob := NewRunner(params.NativeCompiler)
-	reg.Object = ob
-
-	wasmData, err := assetsFs.ReadFile(path.Join("runtime", params.Runtime))
-	if err != nil {
-		return fmt.Errorf("could not load runtime: %w", err)
+	var expressions *settingsExpressions
+	if len(params.SettingsExpressions) > 0 {
+		if params.IssueCountWindow <= 0 {
+			params.IssueCountWindow = DefaultParameters.IssueCountWindow
+		}
+		expressions, err = newSettingsExpressions(state, reg.Name, params.SettingsExpressions, params.Settings, params.IssueCountWindow)
+		if err != nil {
+			return fmt.Errorf("settings expressions: %w", err)
+		}
 	}
 
-	err = ob.Compile("runtime", wasmData)
-	if err != nil {
-		return fmt.Errorf("compiling runtime: %w", err)
+	object := &registrationObject{
+		closers: closers,
+		close:   make(chan struct{}),
 	}
+	reg.Object = object
+
+	if expressions != nil {
+		object.wg.Add(1)
+		go func() {
+			defer object.wg.Done()
+			ticker := time.NewTicker(time.Minute)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					expressions.Decay()
+				case <-object.close:
+					return
+				}
+			}
+		}()
+	}
+
+	// settingsCookieName Holds per request settings between make-challenge and verify-challenge
+	settingsCookieName := utils.DefaultCookiePrefix + reg.Name + "-settings"
 
 	reg.IssueChallenge = func(w http.ResponseWriter, r *http.Request, key challenge.Key, expiry time.Time) challenge.VerifyResult {
 		state.ChallengePage(w, r, state.Settings().ChallengeResponseCode, reg, map[string]any{
@@ -104,80 +204,114 @@ func FillJavaScriptRegistration(state challenge.StateInterface, reg *challenge.R
 	}
 
 	reg.Verify = func(key challenge.Key, token []byte, r *http.Request) (challenge.VerifyResult, error) {
-		var ok bool
-		err = ob.Instantiate("runtime", func(ctx context.Context, mod api.Module) (err error) {
-			in := _interface.VerifyChallengeInput{
-				Key:        key[:],
-				Parameters: params.Settings,
-				Result:     token,
-			}
-
-			out, err := VerifyChallengeCall(ctx, mod, in)
+		settings := params.Settings
+		if expressions != nil {
+			dynamicSettings, result, err := splitSettingsToken(token)
 			if err != nil {
-				return err
+				return challenge.VerifyResultFail, err
 			}
-
-			if out == _interface.VerifyChallengeOutputError {
-				return errors.New("error checking challenge")
+			if err = expressions.Validate(dynamicSettings); err != nil {
+				return challenge.VerifyResultFail, err
 			}
-			ok = out == _interface.VerifyChallengeOutputOK
-			return nil
+			settings = expressions.Merge(params.Settings, dynamicSettings)
+			key = challenge.BindKeyParameters(key, dynamicSettings)
+			token = result
+		}
+
+		out, err := backend.VerifyChallenge(_interface.VerifyChallengeInput{
+			Key:        key[:],
+			Parameters: settings,
+			Result:     token,
 		})
 		if err != nil {
 			return challenge.VerifyResultFail, err
 		}
-		if ok {
+
+		switch out {
+		case _interface.VerifyChallengeOutputOK:
 			return challenge.VerifyResultOK, nil
+		case _interface.VerifyChallengeOutputError:
+			return challenge.VerifyResultFail, errors.New("error checking challenge")
+		default:
+			return challenge.VerifyResultFail, nil
 		}
-		return challenge.VerifyResultFail, nil
 	}
 
-	// serve assets if existent
-	if staticFs, err := fs.Sub(assetsFs, "static"); err != nil {
-		return fmt.Errorf("no static assets: %w", err)
-	} else {
-		mux.Handle("GET "+reg.Path+"/static/", http.StripPrefix(reg.Path+"/static/", gzipped.FileServer(gzipped.FS(staticFs))))
-	}
+	// serve assets
+	mux.Handle("GET "+reg.Path+"/static/", http.StripPrefix(reg.Path+"/static/", gzipped.FileServer(gzipped.FS(staticFs))))
 
 	mux.HandleFunc(reg.Path+challenge.MakeChallengeUrlSuffix, func(w http.ResponseWriter, r *http.Request) {
 		data := challenge.RequestDataFromContext(r.Context())
-		err := ob.Instantiate("runtime", func(ctx context.Context, mod api.Module) (err error) {
-			key := challenge.GetChallengeKeyForRequest(state, reg, data.Expiration(reg.Duration), r)
+		expiration := data.Expiration(reg.Duration)
+		key := challenge.GetChallengeKeyForRequest(state, reg, expiration, r)
 
-			in := _interface.MakeChallengeInput{
-				Key:        key[:],
-				Parameters: params.Settings,
-				Headers:    inline.MIMEHeader(r.Header),
-			}
-			in.Data, err = io.ReadAll(r.Body)
+		settings := params.Settings
+		if expressions != nil {
+			dynamicSettings, err := expressions.Evaluate(data)
 			if err != nil {
-				return err
-			}
-
-			out, err := MakeChallengeCall(ctx, mod, in)
-			if err != nil {
-				return err
+				state.ErrorPage(w, r, http.StatusInternalServerError, fmt.Errorf("evaluating settings: %w", err), "")
+				return
 			}
+			// count where settings are handed out, so clients requesting challenges directly are counted too
+			expressions.Issued(data)
+			settings = expressions.Merge(params.Settings, dynamicSettings)
+			key = challenge.BindKeyParameters(key, dynamicSettings)
+			state.Settings().Cookie.Set(settingsCookieName, encodeSettings(dynamicSettings), expiration, w, r)
+		}
 
-			// set output headers
-			for k, v := range out.Headers {
-				w.Header()[k] = v
-			}
-			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(out.Data)))
-			w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			state.ErrorPage(w, r, http.StatusInternalServerError, err, "")
+			return
+		}
 
-			data.ResponseHeaders(w)
-			w.WriteHeader(out.Code)
-			_, _ = w.Write(out.Data)
-			return nil
+		out, err := backend.MakeChallenge(_interface.MakeChallengeInput{
+			Key:        key[:],
+			Parameters: settings,
+			Headers:    inline.MIMEHeader(r.Header),
+			Data:       body,
 		})
 		if err != nil {
 			state.ErrorPage(w, r, http.StatusInternalServerError, err, "")
 			return
 		}
+
+		// set output headers
+		for k, v := range out.Headers {
+			w.Header()[k] = v
+		}
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(out.Data)))
+		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+
+		data.ResponseHeaders(w)
+		w.WriteHeader(out.Code)
+		_, _ = w.Write(out.Data)
 	})
 
-	mux.HandleFunc(reg.Path+challenge.VerifyChallengeUrlSuffix, challenge.VerifyHandlerFunc(state, reg, nil, nil))
+	verifyHandler := challenge.VerifyHandlerFunc(state, reg, nil, nil)
+	if expressions != nil {
+		mux.HandleFunc(reg.Path+challenge.VerifyChallengeUrlSuffix, func(w http.ResponseWriter, r *http.Request) {
+			// prepend settings this challenge was made with to the token, so they are kept for later verification
+			var encodedSettings string
+			if cookie, err := r.Cookie(state.Settings().Cookie.Name(settingsCookieName)); err == nil {
+				encodedSettings = cookie.Value
+				state.Settings().Cookie.Clear(settingsCookieName, w, r)
+			}
+
+			q := r.URL.Query()
+			if token := q.Get(challenge.QueryArgToken); token != "" && encodedSettings != "" {
+				q.Set(challenge.QueryArgToken, encodedSettings+settingsTokenSeparator+token)
+			}
+			uri := *r.URL
+			uri.RawQuery = q.Encode()
+
+			r = r.Clone(r.Context())
+			r.URL = &uri
+			verifyHandler(w, r)
+		})
+	} else {
+		mux.HandleFunc(reg.Path+challenge.VerifyChallengeUrlSuffix, verifyHandler)
+	}
 
 	mux.HandleFunc("GET "+reg.Path+"/script.mjs", func(w http.ResponseWriter, r *http.Request) {
 		challenge.ServeChallengeScript(w, r, reg, params.Settings, path.Join(reg.Path, "static", params.Loader))
@@ -187,3 +321,102 @@ func FillJavaScriptRegistration(state challenge.StateInterface, reg *challenge.R
 
 	return nil
 }
+
+// GetChallengeFS Finds the assets for a challenge by name
+// If challengeDirectory is set and contains a subdirectory with a runtime folder it will be preferred, and its path returned
+// Otherwise, embedded challenges are used
+func GetChallengeFS(challengeDirectory, name string) (assetsFs embed.FSInterface, assetsPath string, err error) {
+	if challengeDirectory != "" && name != "" && filepath.IsLocal(name) {
+		assetsPath = filepath.Join(challengeDirectory, name)
+		if utils.IsDirectory(filepath.Join(assetsPath, "runtime")) {
+			if properFS, ok := os.DirFS(assetsPath).(embed.FSInterface); ok {
+				return properFS, assetsPath, nil
+			}
+			return nil, "", errors.New("unsupported FS")
+		}
+	}
+
+	assetsFs, err = embed.GetFallbackFS(embed.ChallengeFs, name)
+	if err != nil {
+		return nil, "", err
+	}
+	return assetsFs, "", nil
+}
+
+// ChallengeDirectoryEntry Subdirectory found within a challenge directory
+type ChallengeDirectoryEntry struct {
+	Name string
+	// Runtimes Names of WASM files within its runtime folder
+	Runtimes []string
+	// Err Why this subdirectory cannot be used as a runtime, if set
+	Err error
+}
+
+// wasmMagic Header all WASM binary modules start with
+var wasmMagic = []byte{0x00, 'a', 's', 'm'}
+
+// ListChallengeDirectory Lists subdirectories within a challenge directory
+// Each subdirectory with runtime/*.wasm files and a static folder is considered a runtime, others have Err set
+func ListChallengeDirectory(challengeDirectory string) (entries []ChallengeDirectoryEntry, err error) {
+	dirEntries, err := os.ReadDir(challengeDirectory)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range dirEntries {
+		if !e.IsDir() {
+			continue
+		}
+		entry := ChallengeDirectoryEntry{Name: e.Name()}
+		entry.Runtimes, entry.Err = listChallengeRuntimes(filepath.Join(challengeDirectory, e.Name()))
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func listChallengeRuntimes(assetsPath string) (runtimes []string, err error) {
+	if !utils.IsDirectory(filepath.Join(assetsPath, "static")) {
+		return nil, errors.New("no static folder")
+	}
+	matches, err := filepath.Glob(filepath.Join(assetsPath, "runtime", "*.wasm"))
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, errors.New("no runtime/*.wasm files")
+	}
+	for _, match := range matches {
+		f, err := os.Open(match)
+		if err != nil {
+			return nil, err
+		}
+		header := make([]byte, len(wasmMagic))
+		_, err = io.ReadFull(f, header)
+		_ = f.Close()
+		if err != nil || !bytes.Equal(header, wasmMagic) {
+			return nil, fmt.Errorf("%s is not a WASM module", filepath.Base(match))
+		}
+		runtimes = append(runtimes, filepath.Base(match))
+	}
+	return runtimes, nil
+}
+
+type registrationObject struct {
+	closers []io.Closer
+
+	close chan struct{}
+	wg    sync.WaitGroup
+}
+
+func (o *registrationObject) Close() error {
+	// stop background tasks before closing
+	close(o.close)
+	o.wg.Wait()
+	return closeAll(o.closers...)
+}
+
+func closeAll(closers ...io.Closer) (err error) {
+	for _, c := range closers {
+		err = errors.Join(err, c.Close())
+	}
+	return err
+}
@@ -8,13 +8,21 @@ import (
 	"github.com/tetratelabs/wazero/api"
 	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
 	"slices"
+	"sync"
 )
 
 type Runner struct {
 	context context.Context
 	runtime wazero.Runtime
 
-	modules map[string]wazero.CompiledModule
+	modulesLock sync.RWMutex
+	modules     map[string]*runnerModule
+}
+
+// runnerModule Tracks instances in use so a module can be swapped without closing it under them
+type runnerModule struct {
+	compiled wazero.CompiledModule
+	inUse    sync.WaitGroup
 }
 
 func NewRunner(useNativeCompiler bool) *Runner {
@@ -29,7 +37,7 @@ func NewRunner(useNativeCompiler bool) *Runner {
 	r.runtime = wazero.NewRuntimeWithConfig(r.context, runtimeConfig)
 	wasi_snapshot_preview1.MustInstantiate(r.context, r.runtime)
 
-	r.modules = make(map[string]wazero.CompiledModule)
+	r.modules = make(map[string]*runnerModule)
 
 	return &r
 }
@@ -90,29 +98,53 @@ func (r *Runner) Compile(key string, binary []byte) error {
 		return errors.New("no free exported")
 	}
 
-	r.modules[key] = module
+	r.modulesLock.Lock()
+	oldModule := r.modules[key]
+	r.modules[key] = &runnerModule{
+		compiled: module,
+	}
+	r.modulesLock.Unlock()
+
+	if oldModule != nil {
+		// close old module once all in-flight calls are done with it
+		go func() {
+			oldModule.inUse.Wait()
+			_ = oldModule.compiled.Close(r.context)
+		}()
+	}
 	return nil
 }
 
 func (r *Runner) Close() error {
+	r.modulesLock.Lock()
+	defer r.modulesLock.Unlock()
 	for _, module := range r.modules {
-		if err := module.Close(r.context); err != nil {
+		module.inUse.Wait()
+		if err := module.compiled.Close(r.context); err != nil {
 			return err
 		}
 	}
+	clear(r.modules)
 	return r.runtime.Close(r.context)
 }
 
 var ErrModuleNotFound = errors.New("module not found")
 
 func (r *Runner) Instantiate(key string, f func(ctx context.Context, mod api.Module) error) (err error) {
-	compiledModule, ok := r.modules[key]
+	r.modulesLock.RLock()
+	module, ok := r.modules[key]
+	if ok {
+		module.inUse.Add(1)
+	}
+	r.modulesLock.RUnlock()
 	if !ok {
 		return ErrModuleNotFound
 	}
+	defer module.inUse.Done()
+
 	mod, err := r.runtime.InstantiateModule(
 		r.context,
-		compiledModule,
+		module.compiled,
 		wazero.NewModuleConfig().WithName(key).WithStartFunctions("_initialize"),
 	)
 	if err != nil {
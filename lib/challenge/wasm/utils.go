@@ -1,6 +1,7 @@
 package wasm
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -9,15 +10,31 @@ import (
 )
 
 func MakeChallengeCall(ctx context.Context, mod api.Module, in _interface.MakeChallengeInput) (*_interface.MakeChallengeOutput, error) {
-	makeChallengeFunc := mod.ExportedFunction("MakeChallenge")
-	malloc := mod.ExportedFunction("malloc")
-	free := mod.ExportedFunction("free")
-
 	inData, err := json.Marshal(in)
 	if err != nil {
 		return nil, err
 	}
 
+	outData, err := MakeChallengeCallRaw(ctx, mod, inData)
+	if err != nil {
+		return nil, err
+	}
+
+	var out _interface.MakeChallengeOutput
+	err = json.Unmarshal(outData, &out)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// MakeChallengeCallRaw Calls MakeChallenge with already encoded input, and returns the encoded output as-is
+// Used for testing runtimes with malformed input
+func MakeChallengeCallRaw(ctx context.Context, mod api.Module, inData []byte) ([]byte, error) {
+	makeChallengeFunc := mod.ExportedFunction("MakeChallenge")
+	malloc := mod.ExportedFunction("malloc")
+	free := mod.ExportedFunction("free")
+
 	mallocResult, err := malloc.Call(ctx, uint64(len(inData)))
 	if err != nil {
 		return nil, err
@@ -37,24 +54,26 @@ func MakeChallengeCall(ctx context.Context, mod api.Module, in _interface.MakeCh
 	}
 	defer free.Call(ctx, uint64(resultPtr.Pointer()))
 
-	var out _interface.MakeChallengeOutput
-	err = json.Unmarshal(outData, &out)
-	if err != nil {
-		return nil, err
-	}
-	return &out, nil
+	// copy out of module memory before it gets freed
+	return bytes.Clone(outData), nil
 }
 
 func VerifyChallengeCall(ctx context.Context, mod api.Module, in _interface.VerifyChallengeInput) (_interface.VerifyChallengeOutput, error) {
-	verifyChallengeFunc := mod.ExportedFunction("VerifyChallenge")
-	malloc := mod.ExportedFunction("malloc")
-	free := mod.ExportedFunction("free")
-
 	inData, err := json.Marshal(in)
 	if err != nil {
 		return _interface.VerifyChallengeOutputError, err
 	}
 
+	return VerifyChallengeCallRaw(ctx, mod, inData)
+}
+
+// VerifyChallengeCallRaw Calls VerifyChallenge with already encoded input
+// Used for testing runtimes with malformed input
+func VerifyChallengeCallRaw(ctx context.Context, mod api.Module, inData []byte) (_interface.VerifyChallengeOutput, error) {
+	verifyChallengeFunc := mod.ExportedFunction("VerifyChallenge")
+	malloc := mod.ExportedFunction("malloc")
+	free := mod.ExportedFunction("free")
+
 	mallocResult, err := malloc.Call(ctx, uint64(len(inData)))
 	if err != nil {
 		return _interface.VerifyChallengeOutputError, err
@@ -0,0 +1,147 @@
+package web_bot_auth
+
+import (
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-jose/go-jose/v4"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MinimumRefetchInterval Minimum time between fetches of a remote directory when looking for unknown keys
+const MinimumRefetchInterval = time.Minute
+
+// MaxDirectorySize Maximum size of a key directory
+const MaxDirectorySize = 1024 * 1024
+
+const DirectoryContentType = "application/http-message-signatures-directory+json"
+
+// KeyDirectory Keys of an agent, from a local JWKS file or a fetched JWKS / http-message-signatures-directory
+type KeyDirectory struct {
+	Name   string
+	Source string
+
+	client        *http.Client
+	cacheDuration time.Duration
+
+	lock    sync.RWMutex
+	keys    map[string]*jose.JSONWebKey
+	fetched time.Time
+
+	fetchLock sync.Mutex
+	attempted time.Time
+}
+
+func (d *KeyDirectory) IsRemote() bool {
+	return strings.HasPrefix(d.Source, "https://") || strings.HasPrefix(d.Source, "http://")
+}
+
+func parseKeys(data []byte) (map[string]*jose.JSONWebKey, error) {
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*jose.JSONWebKey, len(set.Keys))
+	for _, raw := range set.Keys {
+		var key jose.JSONWebKey
+		if err := key.UnmarshalJSON(raw); err != nil {
+			// skip unsupported keys
+			slog.Debug("skipping key directory entry", "error", err)
+			continue
+		}
+		if !key.IsPublic() {
+			return nil, errors.New("private key found in key directory")
+		}
+		thumbprint, err := key.Thumbprint(crypto.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		keys[base64.RawURLEncoding.EncodeToString(thumbprint)] = &key
+		if key.KeyID != "" {
+			keys[key.KeyID] = &key
+		}
+	}
+	return keys, nil
+}
+
+// Load Reads or fetches the directory
+func (d *KeyDirectory) Load() error {
+	var data []byte
+	var err error
+	if d.IsRemote() {
+		data, err = d.fetch()
+	} else {
+		data, err = os.ReadFile(d.Source)
+	}
+	if err != nil {
+		return err
+	}
+
+	keys, err := parseKeys(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", d.Source, err)
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.keys = keys
+	d.fetched = time.Now()
+	return nil
+}
+
+func (d *KeyDirectory) fetch() ([]byte, error) {
+	request, err := http.NewRequest(http.MethodGet, d.Source, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", DirectoryContentType+", application/jwk-set+json, application/json")
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d fetching %s", response.StatusCode, d.Source)
+	}
+	return io.ReadAll(io.LimitReader(response.Body, MaxDirectorySize))
+}
+
+// Get Finds a key by keyid, refreshing remote directories when stale or when the key is unknown
+func (d *KeyDirectory) Get(keyId string) (*jose.JSONWebKey, bool) {
+	d.lock.RLock()
+	key, ok := d.keys[keyId]
+	fetched := d.fetched
+	d.lock.RUnlock()
+
+	if !d.IsRemote() || (ok && time.Since(fetched) < d.cacheDuration) {
+		return key, ok
+	}
+
+	d.fetchLock.Lock()
+	defer d.fetchLock.Unlock()
+
+	// rate limit fetches, including failed ones
+	if time.Since(d.attempted) >= MinimumRefetchInterval {
+		d.attempted = time.Now()
+		if err := d.Load(); err != nil {
+			slog.Error("error fetching key directory", "name", d.Name, "source", d.Source, "error", err)
+		}
+	}
+
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	key, ok = d.keys[keyId]
+	return key, ok
+}
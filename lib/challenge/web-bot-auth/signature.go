@@ -0,0 +1,250 @@
+package web_bot_auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Signature A single signature from Signature and Signature-Input headers, as per RFC 9421
+type Signature struct {
+	Label string
+
+	// Components Covered component identifiers, in order
+	Components []string
+
+	// Params Signature parameters, with strings unquoted
+	Params map[string]string
+
+	// rawParams Serialized inner list with parameters as sent, used as @signature-params
+	rawParams string
+
+	Signature []byte
+}
+
+func (s Signature) Created() (int64, bool) {
+	v, err := strconv.ParseInt(s.Params["created"], 10, 64)
+	return v, err == nil
+}
+
+func (s Signature) Expires() (int64, bool) {
+	v, err := strconv.ParseInt(s.Params["expires"], 10, 64)
+	return v, err == nil
+}
+
+// splitMembers Splits a structured field dictionary or list on top level commas
+func splitMembers(v string) (members []string) {
+	var inString, escaped bool
+	var depth int
+	start := 0
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		switch {
+		case escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			members = append(members, strings.TrimSpace(v[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(v[start:]); last != "" {
+		members = append(members, last)
+	}
+	return members
+}
+
+// parseString Parses a structured field string at start of v, returning the rest
+func parseString(v string) (s, rest string, err error) {
+	if len(v) == 0 || v[0] != '"' {
+		return "", v, errors.New("expected string")
+	}
+	var b strings.Builder
+	for i := 1; i < len(v); i++ {
+		switch v[i] {
+		case '\\':
+			i++
+			if i >= len(v) {
+				return "", v, errors.New("invalid string escape")
+			}
+			b.WriteByte(v[i])
+		case '"':
+			return b.String(), v[i+1:], nil
+		default:
+			b.WriteByte(v[i])
+		}
+	}
+	return "", v, errors.New("unterminated string")
+}
+
+// parseParams Parses ;key=value parameters
+func parseParams(v string) (map[string]string, error) {
+	params := make(map[string]string)
+	for len(v) > 0 {
+		if v[0] != ';' {
+			return nil, fmt.Errorf("unexpected parameter data %q", v)
+		}
+		v = strings.TrimLeft(v[1:], " ")
+		name := v
+		if i := strings.IndexAny(v, "=;"); i != -1 {
+			name = v[:i]
+		}
+		v = v[len(name):]
+		if len(v) == 0 || v[0] == ';' {
+			// boolean true
+			params[name] = "?1"
+			continue
+		}
+		v = v[1:]
+		if len(v) > 0 && v[0] == '"' {
+			s, rest, err := parseString(v)
+			if err != nil {
+				return nil, err
+			}
+			params[name] = s
+			v = rest
+		} else {
+			value := v
+			if i := strings.IndexByte(v, ';'); i != -1 {
+				value = v[:i]
+			}
+			params[name] = value
+			v = v[len(value):]
+		}
+	}
+	return params, nil
+}
+
+// ParseSignatures Parses all signatures present on request
+func ParseSignatures(header http.Header) (signatures []Signature, err error) {
+	values := make(map[string][]byte)
+	for _, member := range splitMembers(strings.Join(header.Values("Signature"), ",")) {
+		label, value, ok := strings.Cut(member, "=")
+		if !ok || len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+			return nil, fmt.Errorf("invalid signature %q", member)
+		}
+		values[label], err = base64.StdEncoding.DecodeString(value[1 : len(value)-1])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, member := range splitMembers(strings.Join(header.Values("Signature-Input"), ",")) {
+		label, value, ok := strings.Cut(member, "=")
+		if !ok || len(value) == 0 || value[0] != '(' {
+			return nil, fmt.Errorf("invalid signature input %q", member)
+		}
+		sig := Signature{
+			Label:     label,
+			rawParams: value,
+		}
+
+		end := strings.IndexByte(value, ')')
+		for {
+			// find closing parenthesis outside of strings
+			if end == -1 {
+				return nil, fmt.Errorf("invalid signature input %q", member)
+			}
+			if strings.Count(value[:end], "\"")%2 == 0 {
+				break
+			}
+			next := strings.IndexByte(value[end+1:], ')')
+			if next == -1 {
+				end = -1
+			} else {
+				end += next + 1
+			}
+		}
+
+		items := strings.TrimSpace(value[1:end])
+		for len(items) > 0 {
+			component, rest, err := parseString(items)
+			if err != nil {
+				return nil, err
+			}
+			if len(rest) > 0 && rest[0] == ';' {
+				return nil, fmt.Errorf("unsupported component parameters on %s", component)
+			}
+			sig.Components = append(sig.Components, component)
+			items = strings.TrimLeft(rest, " ")
+		}
+
+		sig.Params, err = parseParams(value[end+1:])
+		if err != nil {
+			return nil, err
+		}
+
+		if sig.Signature, ok = values[label]; !ok {
+			return nil, fmt.Errorf("missing signature for %s", label)
+		}
+		signatures = append(signatures, sig)
+	}
+
+	return signatures, nil
+}
+
+func componentValue(r *http.Request, component string) (string, error) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	switch component {
+	case "@method":
+		return r.Method, nil
+	case "@authority":
+		return strings.ToLower(r.Host), nil
+	case "@scheme":
+		return scheme, nil
+	case "@target-uri":
+		return scheme + "://" + strings.ToLower(r.Host) + r.URL.RequestURI(), nil
+	case "@request-target":
+		return r.URL.RequestURI(), nil
+	case "@path":
+		return r.URL.EscapedPath(), nil
+	case "@query":
+		return "?" + r.URL.RawQuery, nil
+	}
+	if strings.HasPrefix(component, "@") {
+		return "", fmt.Errorf("unsupported derived component %s", component)
+	}
+
+	// copy, as the request is forwarded to the backend as is
+	values := slices.Clone(r.Header.Values(component))
+	if len(values) == 0 {
+		return "", fmt.Errorf("missing covered header %s", component)
+	}
+	for i := range values {
+		values[i] = strings.TrimSpace(values[i])
+	}
+	return strings.Join(values, ", "), nil
+}
+
+// Base Creates the signature base to be verified for this signature
+func (s Signature) Base(r *http.Request) ([]byte, error) {
+	var b strings.Builder
+	for _, component := range s.Components {
+		value, err := componentValue(r, component)
+		if err != nil {
+			return nil, err
+		}
+		b.WriteString(strconv.Quote(component))
+		b.WriteString(": ")
+		b.WriteString(value)
+		b.WriteByte('\n')
+	}
+	b.WriteString("\"@signature-params\": ")
+	b.WriteString(s.rawParams)
+	return []byte(b.String()), nil
+}
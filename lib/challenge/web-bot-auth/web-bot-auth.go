@@ -0,0 +1,272 @@
+package web_bot_auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"git.gammaspectra.live/git/go-away/lib/challenge"
+	"git.gammaspectra.live/git/go-away/utils"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/ast"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+func init() {
+	challenge.Runtimes[Key] = FillRegistration
+}
+
+const Key = "web-bot-auth"
+
+type AgentParameters struct {
+	// Name Identity of the agent exposed to conditions
+	Name string `yaml:"name"`
+
+	// KeyDirectory Path to a local JWKS file, or URL of a JWKS or http-message-signatures-directory
+	KeyDirectory string `yaml:"key-directory"`
+
+	// SignatureAgent If set, Signature-Agent header must be present, covered and match this value
+	SignatureAgent string `yaml:"signature-agent"`
+}
+
+type Parameters struct {
+	Agents []AgentParameters `yaml:"agents"`
+
+	// Tag Required tag signature parameter, empty to accept any
+	Tag string `yaml:"tag"`
+
+	// RequiredComponents Components that must be covered by the signature
+	RequiredComponents []string `yaml:"required-components"`
+
+	// MaxAge Maximum age of signature created parameter
+	MaxAge time.Duration `yaml:"max-age"`
+
+	// CacheDuration How long fetched key directories are cached for
+	CacheDuration time.Duration `yaml:"directory-cache-duration"`
+}
+
+var DefaultParameters = Parameters{
+	Tag:                "web-bot-auth",
+	RequiredComponents: []string{"@authority"},
+	MaxAge:             time.Minute * 5,
+	CacheDuration:      time.Hour,
+}
+
+// ClockSkew Allowed time difference on signature created parameter
+const ClockSkew = time.Minute
+
+var ErrNoSignature = errors.New("no valid signature")
+
+func FillRegistration(state challenge.StateInterface, reg *challenge.Registration, parameters ast.Node) error {
+	params := DefaultParameters
+
+	if parameters != nil {
+		ymlData, err := parameters.MarshalYAML()
+		if err != nil {
+			return err
+		}
+		err = yaml.Unmarshal(ymlData, &params)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(params.Agents) == 0 {
+		return errors.New("no agents")
+	}
+
+	reg.Class = challenge.ClassTransparent
+
+	type agent struct {
+		AgentParameters
+		directory *KeyDirectory
+	}
+
+	var agents []agent
+	var watchedPaths []string
+	for _, p := range params.Agents {
+		if p.Name == "" || p.KeyDirectory == "" {
+			return errors.New("agent needs name and key-directory")
+		}
+		a := agent{
+			AgentParameters: p,
+			directory: &KeyDirectory{
+				Name:          p.Name,
+				Source:        p.KeyDirectory,
+				client:        state.Client(),
+				cacheDuration: params.CacheDuration,
+			},
+		}
+		if err := a.directory.Load(); err != nil {
+			if !a.directory.IsRemote() {
+				return fmt.Errorf("agent %s: %w", p.Name, err)
+			}
+			// remote directories will be fetched again on use
+			slog.Error("error fetching key directory", "name", p.Name, "source", p.KeyDirectory, "error", err)
+		} else if !a.directory.IsRemote() {
+			watchedPaths = append(watchedPaths, p.KeyDirectory)
+		}
+		agents = append(agents, a)
+	}
+
+	if len(watchedPaths) > 0 {
+		watcher, err := utils.NewFileWatcher(time.Second*5, func() {
+			for _, a := range agents {
+				if a.directory.IsRemote() {
+					continue
+				}
+				if err := a.directory.Load(); err != nil {
+					slog.Error("error reloading key directory", "name", a.Name, "source", a.KeyDirectory, "error", err)
+				}
+			}
+		}, watchedPaths...)
+		if err != nil {
+			return err
+		}
+		reg.Object = watcher
+	}
+
+	verify := func(r *http.Request) (a agent, keyId string, err error) {
+		signatures, err := ParseSignatures(r.Header)
+		if err != nil {
+			return agent{}, "", err
+		}
+
+		now := time.Now()
+		for _, sig := range signatures {
+			err = func() error {
+				if params.Tag != "" && sig.Params["tag"] != params.Tag {
+					return errors.New("tag mismatch")
+				}
+				created, ok := sig.Created()
+				if !ok {
+					return errors.New("missing created")
+				}
+				if createdTime := time.Unix(created, 0); createdTime.After(now.Add(ClockSkew)) || createdTime.Add(params.MaxAge).Before(now) {
+					return errors.New("signature too old or in future")
+				}
+				if expires, ok := sig.Expires(); ok && time.Unix(expires, 0).Before(now) {
+					return errors.New("signature expired")
+				}
+
+				for _, c := range params.RequiredComponents {
+					if !slices.Contains(sig.Components, c) {
+						return fmt.Errorf("required component %s not covered", c)
+					}
+				}
+				if r.Header.Get("Signature-Agent") != "" && !slices.Contains(sig.Components, "signature-agent") {
+					return errors.New("signature-agent not covered")
+				}
+
+				base, err := sig.Base(r)
+				if err != nil {
+					return err
+				}
+
+				keyId = sig.Params["keyid"]
+				for _, a = range agents {
+					if a.SignatureAgent != "" && strings.Trim(r.Header.Get("Signature-Agent"), "\"") != a.SignatureAgent {
+						continue
+					}
+					key, ok := a.directory.Get(keyId)
+					if !ok {
+						continue
+					}
+					return verifySignature(key, sig.Params["alg"], base, sig.Signature)
+				}
+				return fmt.Errorf("unknown key %s", keyId)
+			}()
+			if err == nil {
+				return a, keyId, nil
+			}
+		}
+		if err == nil {
+			err = ErrNoSignature
+		}
+		return agent{}, "", err
+	}
+
+	reg.IssueChallenge = func(w http.ResponseWriter, r *http.Request, key challenge.Key, expiry time.Time) challenge.VerifyResult {
+		if r.Header.Get("Signature") == "" || r.Header.Get("Signature-Input") == "" {
+			// skip unsigned requests
+			return challenge.VerifyResultSkip
+		}
+
+		a, keyId, err := verify(r)
+		if err != nil {
+			state.Logger(r).Debug("invalid http message signature", "challenge", reg.Name, "error", err)
+			return challenge.VerifyResultFail
+		}
+
+		data := challenge.RequestDataFromContext(r.Context())
+		data.IssueChallengeToken(reg, key, nil, expiry, true)
+		_ = data.SetChallengeData(reg, map[string]any{
+			"agent":          a.Name,
+			"keyid":          keyId,
+			"signatureAgent": strings.Trim(r.Header.Get("Signature-Agent"), "\""),
+		})
+		return challenge.VerifyResultOK
+	}
+
+	return nil
+}
+
+func verifySignature(key *jose.JSONWebKey, alg string, base, signature []byte) error {
+	switch pub := key.Key.(type) {
+	case ed25519.PublicKey:
+		if alg != "" && alg != "ed25519" {
+			return fmt.Errorf("unsupported alg %s for key", alg)
+		}
+		if !ed25519.Verify(pub, base, signature) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		var hash crypto.Hash
+		switch {
+		case pub.Curve == elliptic.P256() && (alg == "" || alg == "ecdsa-p256-sha256"):
+			hash = crypto.SHA256
+		case pub.Curve == elliptic.P384() && (alg == "" || alg == "ecdsa-p384-sha384"):
+			hash = crypto.SHA384
+		default:
+			return fmt.Errorf("unsupported alg %s for key", alg)
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != size*2 {
+			return errors.New("invalid signature")
+		}
+		h := hash.New()
+		h.Write(base)
+		if !ecdsa.Verify(pub, h.Sum(nil), new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		switch alg {
+		case "", "rsa-pss-sha512":
+			digest := sha512.Sum512(base)
+			return rsa.VerifyPSS(pub, crypto.SHA512, digest[:], signature, &rsa.PSSOptions{
+				SaltLength: 64,
+				Hash:       crypto.SHA512,
+			})
+		case "rsa-v1_5-sha256":
+			digest := sha256.Sum256(base)
+			return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature)
+		default:
+			return fmt.Errorf("unsupported alg %s for key", alg)
+		}
+	default:
+		return fmt.Errorf("unsupported key type %T", pub)
+	}
+}
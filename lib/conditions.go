@@ -15,6 +15,10 @@ func (state *State) initConditions() (err error) {
 	state.programEnv, err = http_cel.NewEnvironment(
 
 		cel.Variable("fp", cel.MapType(cel.StringType, cel.StringType)),
+		// values exposed by challenges that have been checked, by challenge name
+		cel.Variable("challengeData", cel.MapType(cel.StringType, cel.MapType(cel.StringType, cel.DynType))),
+		// properties of presented challenge tokens, such as sharedCount
+		cel.Variable("token", cel.MapType(cel.StringType, cel.IntType)),
 		cel.Function("inDNSBL",
 			cel.Overload("inDNSBL_ip",
 				[]*cel.Type{cel.AnyType},
@@ -114,15 +118,21 @@ func (state *State) initConditions() (err error) {
 }
 
 func (state *State) RegisterCondition(operator string, conditions ...string) (cel.Program, error) {
+	_, program, err := state.registerConditionAst(operator, conditions...)
+	return program, err
+}
+
+// registerConditionAst Same as RegisterCondition, also returning the compiled AST for analysis
+func (state *State) registerConditionAst(operator string, conditions ...string) (*cel.Ast, cel.Program, error) {
 	compiledAst, err := http_cel.NewAst(state.ProgramEnv(), operator, conditions...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if out := compiledAst.OutputType(); out == nil {
-		return nil, fmt.Errorf("no output")
+		return nil, nil, fmt.Errorf("no output")
 	} else if out != types.BoolType {
-		return nil, fmt.Errorf("output type is not bool")
+		return nil, nil, fmt.Errorf("output type is not bool")
 	}
 
 	walkExpr(compiledAst.NativeRep().Expr(), func(e ast.Expr) {
@@ -166,7 +176,11 @@ func (state *State) RegisterCondition(operator string, conditions ...string) (ce
 		}
 	})
 
-	return http_cel.ProgramAst(state.ProgramEnv(), compiledAst)
+	program, err := http_cel.ProgramAst(state.ProgramEnv(), compiledAst)
+	if err != nil {
+		return nil, nil, err
+	}
+	return compiledAst, program, nil
 }
 
 func walkExpr(e ast.Expr, fn func(ast.Expr)) {
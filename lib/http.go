@@ -264,11 +264,14 @@ func (state *State) handleRequest(w http.ResponseWriter, r *http.Request) {
 		data.ExtraHeaders.Set("X-Away-Rule", ruleName)
 		data.ExtraHeaders.Set("X-Away-Action", string(ruleAction))
 
+		// identity headers are forwarded even if no rule verified their challenges, state is read from cookies
+		data.EvaluateBackendChallenges()
+
 		// delete cookies set by go-away to prevent user tracking that way
 		cookies := r.Cookies()
 		r.Header.Del("Cookie")
 		for _, c := range cookies {
-			if !strings.HasPrefix(c.Name, utils.DefaultCookiePrefix) {
+			if !state.Settings().Cookie.IsOwn(c.Name) {
 				r.AddCookie(c)
 			}
 		}
@@ -277,7 +280,7 @@ func (state *State) handleRequest(w http.ResponseWriter, r *http.Request) {
 		data.ResponseHeaders(w)
 	}
 
-	for _, rule := range state.rules {
+	for rule := range state.ruleIndex.Rules(r.Host, r.URL.Path) {
 		next, err := rule.Evaluate(lg, w, r, func() http.Handler {
 			cleanupRequest(r, true, rule.Name, rule.Action)
 			return getBackend()
@@ -285,7 +288,6 @@ func (state *State) handleRequest(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			state.ErrorPage(w, r, http.StatusInternalServerError, err, "")
 			panic(err)
-			return
 		}
 
 		if !next {
@@ -323,9 +325,10 @@ func (state *State) setupRoutes() error {
 }
 
 func (state *State) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	r, data := challenge.CreateRequestData(r, state)
+	state.inFlight.Add(1)
+	defer state.inFlight.Add(-1)
 
-	data.EvaluateChallenges(w, r)
+	r, _ = challenge.CreateRequestData(r, state)
 
 	state.Mux.ServeHTTP(w, r)
 }
@@ -23,7 +23,7 @@ func (state *State) Client() *http.Client {
 }
 
 func (state *State) PrivateKey() ed25519.PrivateKey {
-	return state.privateKey
+	return state.keys.Load().Active().PrivateKey
 }
 
 func (state *State) PrivateKeyFingerprint() []byte {
@@ -31,7 +31,15 @@ func (state *State) PrivateKeyFingerprint() []byte {
 }
 
 func (state *State) PublicKey() ed25519.PublicKey {
-	return state.publicKey
+	return state.keys.Load().Active().PublicKey
+}
+
+func (state *State) SeedPublicKey() ed25519.PublicKey {
+	return state.seedPublicKey
+}
+
+func (state *State) SigningKeys() *utils.KeySet {
+	return state.keys.Load()
 }
 
 func (state *State) UrlPath() string {
@@ -102,6 +110,10 @@ func (state *State) Settings() policy.StateSettings {
 	return state.settings
 }
 
+func (state *State) RequestsInFlight() int64 {
+	return state.inFlight.Load()
+}
+
 func (state *State) Strings() utils.Strings {
 	return state.opt.Strings
 }
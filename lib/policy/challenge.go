@@ -11,5 +11,51 @@ type Challenge struct {
 
 	Duration time.Duration `yaml:"duration"`
 
+	// Key Overrides how challenge keys are bound to clients
+	Key *ChallengeKey `yaml:"key,omitempty"`
+
+	// Reuse Detects tokens shared across many clients
+	Reuse *ChallengeReuse `yaml:"reuse,omitempty"`
+
+	// Renewal Reissues tokens of active clients before they expire
+	Renewal *ChallengeRenewal `yaml:"renewal,omitempty"`
+
 	Parameters ast.Node `yaml:"parameters,omitempty"`
 }
+
+type ChallengeKey struct {
+	// Headers Client headers used in key generation, in this order. Overrides the runtime defaults
+	Headers []string `yaml:"headers,omitempty"`
+
+	// IPv4Prefix Prefix length of IPv4 client addresses used in key generation
+	IPv4Prefix *int `yaml:"ipv4-prefix,omitempty"`
+
+	// IPv6Prefix Prefix length of IPv6 client addresses used in key generation
+	IPv6Prefix *int `yaml:"ipv6-prefix,omitempty"`
+
+	// DisableIP Do not bind keys to the client address
+	DisableIP bool `yaml:"disable-ip,omitempty"`
+}
+
+type ChallengeReuse struct {
+	// Window Sliding window over which distinct clients presenting the same token are counted
+	Window time.Duration `yaml:"window"`
+
+	// Threshold Tokens presented by more distinct clients than this within Window are revoked
+	// Zero only counts them
+	Threshold int `yaml:"threshold"`
+
+	// IPv4Prefix Prefix length of IPv4 client addresses, which together with their JA4 fingerprint tell clients apart
+	IPv4Prefix *int `yaml:"ipv4-prefix,omitempty"`
+
+	// IPv6Prefix Prefix length of IPv6 client addresses, which together with their JA4 fingerprint tell clients apart
+	IPv6Prefix *int `yaml:"ipv6-prefix,omitempty"`
+}
+
+type ChallengeRenewal struct {
+	// Window Percentage of the challenge duration before expiry within which tokens are reissued when used
+	Window float64 `yaml:"window"`
+
+	// MaxLifetime Tokens are not reissued past this since first issued. Zero for unlimited
+	MaxLifetime time.Duration `yaml:"max-lifetime"`
+}
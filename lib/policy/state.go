@@ -3,17 +3,38 @@ package policy
 import (
 	"git.gammaspectra.live/git/go-away/utils"
 	"net/http"
+	"time"
 )
 
 type StateSettings struct {
-	Cache           utils.Cache
-	Backends        map[string]http.Handler
-	PrivateKeySeed  []byte
+	Cache          utils.Cache
+	Backends       map[string]http.Handler
+	PrivateKeySeed []byte
+
+	// PrivateKeyDirectory Directory of signing keys, reloaded on change. See utils.LoadKeySet
+	PrivateKeyDirectory string
+	// PrivateKeyGrace How long superseded keys are accepted for verification. Zero keeps them while present
+	PrivateKeyGrace time.Duration
+
 	MainName        string
 	MainVersion     string
 	BasePath        string
 	ClientIpHeader  string
 	BackendIpHeader string
 
+	// ChallengeDirectory External directory where challenge runtimes are loaded from, preferred over embedded ones
+	ChallengeDirectory string
+
 	ChallengeResponseCode int
+
+	Cookie utils.CookieSettings
+
+	// Sessions If set, challenge state is kept on this store, and the state cookie only holds a session id
+	Sessions utils.SessionStore
+
+	// SharedState If set, caches, counters and awaiters are shared via this across replicas
+	SharedState utils.SharedState
+
+	// DisableRuleIndex Evaluate every rule in order, instead of skipping rules that cannot match by host or path
+	DisableRuleIndex bool
 }
@@ -26,9 +26,12 @@ type RuleState struct {
 	Handler action.Handler
 
 	Children []RuleState
+
+	// guard Requests the condition cannot match, so it does not need to be evaluated
+	guard ruleGuard
 }
 
-func NewRuleState(state challenge.StateInterface, r policy.Rule, replacer *strings.Replacer, parent *RuleState) (RuleState, error) {
+func NewRuleState(state *State, r policy.Rule, replacer *strings.Replacer, parent *RuleState) (RuleState, error) {
 	hasher := sha256.New()
 	if parent != nil {
 		hasher.Write([]byte(parent.Name))
@@ -65,11 +68,12 @@ func NewRuleState(state challenge.StateInterface, r policy.Rule, replacer *strin
 			conditions = append(conditions, cond)
 		}
 
-		program, err := state.RegisterCondition(http_cel.OperatorOr, conditions...)
+		compiledAst, program, err := state.registerConditionAst(http_cel.OperatorOr, conditions...)
 		if err != nil {
 			return RuleState{}, fmt.Errorf("error compiling condition: %w", err)
 		}
 		rule.Condition = program
+		rule.guard = newRuleGuard(compiledAst.NativeRep().Expr())
 	}
 
 	if len(r.Children) > 0 {
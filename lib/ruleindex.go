@@ -0,0 +1,212 @@
+package lib
+
+import (
+	"github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/common/operators"
+	"github.com/google/cel-go/common/types"
+	"slices"
+	"strings"
+)
+
+// ruleGuard Necessary conditions for a rule condition to match, extracted from its AST
+// A nil set means any value can match
+type ruleGuard struct {
+	// hosts Request host must be one of these
+	hosts []string
+	// pathPrefixes Request path must start with one of these
+	pathPrefixes []string
+}
+
+// Match Whether the rule condition could match a request with the given host and path
+func (g ruleGuard) Match(host, path string) bool {
+	if g.hosts != nil && !slices.Contains(g.hosts, host) {
+		return false
+	}
+	if g.pathPrefixes != nil && !slices.ContainsFunc(g.pathPrefixes, func(prefix string) bool {
+		return strings.HasPrefix(path, prefix)
+	}) {
+		return false
+	}
+	return true
+}
+
+// newRuleGuard Finds host equality and path prefix checks every match of e must pass
+// Only these are understood:
+//   - host == "x", "x" == host, host in ["x", "y"]
+//   - path.startsWith("x"), path == "x", "x" == path
+//   - conjunctions and disjunctions of the above
+//
+// Anything else, including negations, allows any request
+func newRuleGuard(e ast.Expr) ruleGuard {
+	if e.Kind() != ast.CallKind {
+		return ruleGuard{}
+	}
+	call := e.AsCall()
+	args := call.Args()
+
+	switch call.FunctionName() {
+	case operators.LogicalAnd:
+		// all must match, any of their guards is valid
+		var g ruleGuard
+		for _, arg := range args {
+			other := newRuleGuard(arg)
+			g.hosts = intersectGuard(g.hosts, other.hosts)
+			if g.pathPrefixes == nil || (other.pathPrefixes != nil && len(other.pathPrefixes) < len(g.pathPrefixes)) {
+				g.pathPrefixes = other.pathPrefixes
+			}
+		}
+		return g
+	case operators.LogicalOr:
+		// any can match, only guards all of them have are valid
+		var g ruleGuard
+		for i, arg := range args {
+			other := newRuleGuard(arg)
+			if i == 0 {
+				g = other
+				continue
+			}
+			g.hosts = unionGuard(g.hosts, other.hosts)
+			g.pathPrefixes = unionGuard(g.pathPrefixes, other.pathPrefixes)
+		}
+		return g
+	case operators.Equals:
+		if len(args) != 2 {
+			return ruleGuard{}
+		}
+		for _, pair := range [][2]ast.Expr{{args[0], args[1]}, {args[1], args[0]}} {
+			lit, ok := stringLiteral(pair[1])
+			if !ok {
+				continue
+			}
+			switch identName(pair[0]) {
+			case "host":
+				return ruleGuard{hosts: []string{lit}}
+			case "path":
+				return ruleGuard{pathPrefixes: []string{lit}}
+			}
+		}
+	case operators.In:
+		if len(args) != 2 || identName(args[0]) != "host" || args[1].Kind() != ast.ListKind {
+			return ruleGuard{}
+		}
+		hosts := make([]string, 0, len(args[1].AsList().Elements()))
+		for _, element := range args[1].AsList().Elements() {
+			lit, ok := stringLiteral(element)
+			if !ok {
+				return ruleGuard{}
+			}
+			hosts = append(hosts, lit)
+		}
+		return ruleGuard{hosts: hosts}
+	case "startsWith":
+		if !call.IsMemberFunction() || len(args) != 1 || identName(call.Target()) != "path" {
+			return ruleGuard{}
+		}
+		if lit, ok := stringLiteral(args[0]); ok {
+			return ruleGuard{pathPrefixes: []string{lit}}
+		}
+	}
+	return ruleGuard{}
+}
+
+func identName(e ast.Expr) string {
+	if e.Kind() != ast.IdentKind {
+		return ""
+	}
+	return e.AsIdent()
+}
+
+func stringLiteral(e ast.Expr) (string, bool) {
+	if e.Kind() != ast.LiteralKind {
+		return "", false
+	}
+	lit := e.AsLiteral()
+	if lit.Type() != types.StringType {
+		return "", false
+	}
+	return lit.Value().(string), true
+}
+
+// intersectGuard Values allowed by both a and b
+func intersectGuard(a, b []string) []string {
+	if a == nil {
+		return b
+	} else if b == nil {
+		return a
+	}
+	result := make([]string, 0)
+	for _, v := range a {
+		if slices.Contains(b, v) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// unionGuard Values allowed by either a or b
+func unionGuard(a, b []string) []string {
+	if a == nil || b == nil {
+		return nil
+	}
+	result := slices.Clone(a)
+	for _, v := range b {
+		if !slices.Contains(result, v) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// ruleIndex Top level rules that could match each host, in policy order
+type ruleIndex struct {
+	// byHost Rules for requests to a host, including rules that match any host
+	byHost map[string][]*RuleState
+	// anyHost Rules that match any host, for hosts not in byHost
+	anyHost []*RuleState
+}
+
+func newRuleIndex(rules []RuleState) ruleIndex {
+	index := ruleIndex{
+		byHost: make(map[string][]*RuleState),
+	}
+	for i := range rules {
+		for _, host := range rules[i].guard.hosts {
+			index.byHost[host] = nil
+		}
+	}
+
+	for i := range rules {
+		rule := &rules[i]
+		if rule.guard.hosts == nil {
+			index.anyHost = append(index.anyHost, rule)
+			for host := range index.byHost {
+				index.byHost[host] = append(index.byHost[host], rule)
+			}
+		} else {
+			for _, host := range rule.guard.hosts {
+				if l := index.byHost[host]; len(l) == 0 || l[len(l)-1] != rule {
+					index.byHost[host] = append(l, rule)
+				}
+			}
+		}
+	}
+	return index
+}
+
+// Rules Rules that could match the request with host and path, in policy order
+func (index ruleIndex) Rules(host, path string) func(yield func(*RuleState) bool) {
+	rules, ok := index.byHost[host]
+	if !ok {
+		rules = index.anyHost
+	}
+	return func(yield func(*RuleState) bool) {
+		for _, rule := range rules {
+			if rule.guard.pathPrefixes != nil && !rule.guard.Match(host, path) {
+				continue
+			}
+			if !yield(rule) {
+				return
+			}
+		}
+	}
+}
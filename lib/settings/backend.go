@@ -109,6 +109,7 @@ func (b Backend) Create() (*httputil.ReverseProxy, error) {
 			if !b.Transparent {
 				if data := challenge.RequestDataFromContext(req.Context()); data != nil {
 					data.RequestHeaders(req.Header)
+					data.StripCredentials(req)
 				}
 			}
 
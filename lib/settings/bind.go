@@ -3,6 +3,8 @@ package settings
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"git.gammaspectra.live/git/go-away/utils"
 	"github.com/pires/go-proxyproto"
@@ -33,6 +35,10 @@ type Bind struct {
 	// TLSPrivateKey Alternate to TLSAcmeAutoCert
 	TLSPrivateKey string `yaml:"tls-key"`
 
+	// TLSClientCA Path to PEM bundle of CAs that client certificates are verified against
+	// Client certificates are requested but not required, see tls-client-cert challenge
+	TLSClientCA string `yaml:"tls-client-ca"`
+
 	// ReadTimeout is the maximum duration for reading the entire
 	// request, including the body. A zero or negative value means
 	// there will be no timeout.
@@ -106,6 +112,26 @@ func (b *Bind) Server(backends map[string]http.Handler, acmeCachePath string) (*
 		)
 	}
 
+	if b.TLSClientCA != "" {
+		if tlsConfig == nil {
+			return nil, nil, errors.New("tls-client-ca requires TLS to be enabled")
+		}
+		caData, err := os.ReadFile(b.TLSClientCA)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read client CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, nil, fmt.Errorf("no certificates found in client CA bundle %s", b.TLSClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		slog.Warn(
+			"TLS client certificates enabled",
+			"ca", b.TLSClientCA,
+		)
+	}
+
 	var serverHandler atomic.Pointer[http.Handler]
 	server := utils.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if handler := serverHandler.Load(); handler == nil {
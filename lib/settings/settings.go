@@ -17,6 +17,9 @@ type Settings struct {
 
 	Strings utils.Strings `yaml:"strings"`
 
+	// Cookie Attributes of cookies set by go-away, and domains they are shared across
+	Cookie utils.CookieSettings `yaml:"cookie"`
+
 	// Links to add to challenge/error pages like privacy/impressum.
 	Links []Link `yaml:"links"`
 
@@ -24,6 +27,9 @@ type Settings struct {
 
 	ChallengeTemplate string `yaml:"challenge-template"`
 
+	// ChallengeDirectory Directory containing custom challenge runtimes, as subdirectories with runtime and static folders
+	ChallengeDirectory string `yaml:"challenge-directory"`
+
 	// ChallengeTemplateOverrides Key/Value overrides for the current chosen template
 	ChallengeTemplateOverrides map[string]string `yaml:"challenge-template-overrides"`
 }
@@ -27,6 +27,7 @@ var DefaultStrings = utils.NewStrings(map[string]string{
 	"details_contact_admin_with_request_id": "If you have any issues contact the site administrator and provide the following Request Id",
 
 	"button_refresh_page": "Refresh page",
+	"button_continue":     "Continue",
 
 	"status_loading_challenge":   "Loading challenge",
 	"status_starting_challenge":  "Starting challenge",
@@ -35,4 +36,6 @@ var DefaultStrings = utils.NewStrings(map[string]string{
 	"status_challenge_success":   "Challenge success!",
 	"status_challenge_done_took": "Done! Took",
 	"status_error":               "Error:",
+
+	"status_interactive_challenge": "Press the button below to continue",
 })
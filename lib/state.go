@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"log/slog"
@@ -18,10 +19,12 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	http_cel "codeberg.org/gone/http-cel"
 	"git.gammaspectra.live/git/go-away/lib/challenge"
+	"git.gammaspectra.live/git/go-away/lib/challenge/wasm"
 	"git.gammaspectra.live/git/go-away/lib/policy"
 	"git.gammaspectra.live/git/go-away/lib/settings"
 	"git.gammaspectra.live/git/go-away/utils"
@@ -38,9 +41,10 @@ type State struct {
 
 	programEnv *cel.Env
 
-	publicKey             ed25519.PublicKey
-	privateKey            ed25519.PrivateKey
+	keys                  atomic.Pointer[utils.KeySet]
+	keysWatcher           *utils.FileWatcher
 	privateKeyFingerprint []byte
+	seedPublicKey         ed25519.PublicKey
 
 	opt      settings.Settings
 	settings policy.StateSettings
@@ -50,10 +54,14 @@ type State struct {
 	challenges challenge.Register
 
 	rules []RuleState
+	// ruleIndex Skips rules that cannot match a request
+	ruleIndex ruleIndex
+
+	inFlight atomic.Int64
 
 	close chan struct{}
 
-	tagCache *utils.DecayMap[string, []html.Node]
+	tagCache *utils.StateMap[string, []html.Node]
 
 	templates map[string]*template.Template
 
@@ -90,25 +98,64 @@ func NewState(p policy.Policy, opt settings.Settings, settings policy.StateSetti
 		}
 	}
 
+	if err = state.Settings().Cookie.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid cookie settings: %w", err)
+	}
+
+	var seedKey *utils.SigningKey
 	if len(state.Settings().PrivateKeySeed) > 0 {
 		if len(state.Settings().PrivateKeySeed) != ed25519.SeedSize {
 			return nil, fmt.Errorf("invalid private key seed length: %d", len(state.Settings().PrivateKeySeed))
 		}
 
-		state.privateKey = ed25519.NewKeyFromSeed(state.Settings().PrivateKeySeed)
-		state.publicKey = state.privateKey.Public().(ed25519.PublicKey)
+		seedKey = utils.NewSigningKey(ed25519.NewKeyFromSeed(state.Settings().PrivateKeySeed))
+		state.seedPublicKey = seedKey.PublicKey
 
 		clear(state.settings.PrivateKeySeed)
+	}
 
-	} else {
-		state.publicKey, state.privateKey, err = ed25519.GenerateKey(rand.Reader)
+	if state.Settings().PrivateKeyDirectory != "" {
+		if seedKey == nil {
+			// rule hashes and challenge keys are derived from it, and must not change as key files are added or pruned
+			return nil, errors.New("a private key seed is required when using a private key directory")
+		}
+
+		loadKeys := func() (*utils.KeySet, error) {
+			// copy, as expiry is set on load
+			return utils.LoadKeySet(state.Settings().PrivateKeyDirectory, state.Settings().PrivateKeyGrace, utils.NewSigningKey(seedKey.PrivateKey))
+		}
+
+		keys, err := loadKeys()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load private keys: %w", err)
+		}
+		state.keys.Store(keys)
+
+		state.keysWatcher, err = utils.NewFileWatcher(time.Second*5, func() {
+			keys, err := loadKeys()
+			if err != nil {
+				slog.Error("error reloading private keys", "path", state.Settings().PrivateKeyDirectory, "error", err)
+				return
+			}
+			state.keys.Store(keys)
+			slog.Warn("reloaded private keys", "path", state.Settings().PrivateKeyDirectory, "active", keys.Active().Id, "keys", len(keys.Keys))
+		}, state.Settings().PrivateKeyDirectory)
 		if err != nil {
 			return nil, err
 		}
+	} else {
+		if seedKey == nil {
+			_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+			if err != nil {
+				return nil, err
+			}
+			seedKey = utils.NewSigningKey(privateKey)
+		}
+		state.keys.Store(&utils.KeySet{Keys: []*utils.SigningKey{seedKey}})
 	}
 
-	fp := sha256.Sum256(state.privateKey)
-	state.privateKeyFingerprint = fp[:]
+	// fingerprint is kept across key rotations, as it is taken from the seed
+	state.privateKeyFingerprint = seedKey.Fingerprint()
 
 	state.templates = make(map[string]*template.Template)
 	maps.Copy(state.templates, globalTemplates)
@@ -244,6 +291,20 @@ func NewState(p policy.Policy, opt settings.Settings, settings policy.StateSetti
 
 	state.challenges = make(challenge.Register)
 
+	if dir := state.Settings().ChallengeDirectory; dir != "" {
+		entries, err := wasm.ListChallengeDirectory(dir)
+		if err != nil {
+			return nil, fmt.Errorf("challenge directory %s: %w", dir, err)
+		}
+		for _, e := range entries {
+			if e.Err != nil {
+				slog.Error("invalid challenge runtime", "path", dir, "name", e.Name, "error", e.Err)
+				continue
+			}
+			slog.Info("found challenge runtime", "path", dir, "name", e.Name, "runtimes", e.Runtimes)
+		}
+	}
+
 	//TODO: move this to self-contained challenge files
 	for challengeName, pol := range p.Challenges {
 		_, _, err := state.challenges.Create(state, challengeName, pol, conditionReplacer)
@@ -251,6 +312,9 @@ func NewState(p policy.Policy, opt settings.Settings, settings policy.StateSetti
 			return nil, fmt.Errorf("challenge %s: %w", challengeName, err)
 		}
 	}
+	if err = state.challenges.Resolve(); err != nil {
+		return nil, err
+	}
 
 	for _, r := range p.Rules {
 		rule, err := NewRuleState(state, r, conditionReplacer, nil)
@@ -262,6 +326,12 @@ func NewState(p policy.Policy, opt settings.Settings, settings policy.StateSetti
 
 		state.rules = append(state.rules, rule)
 	}
+	if state.Settings().DisableRuleIndex {
+		for i := range state.rules {
+			state.rules[i].guard = ruleGuard{}
+		}
+	}
+	state.ruleIndex = newRuleIndex(state.rules)
 
 	state.Mux = http.NewServeMux()
 
@@ -269,7 +339,7 @@ func NewState(p policy.Policy, opt settings.Settings, settings policy.StateSetti
 		return nil, err
 	}
 
-	state.tagCache = utils.NewDecayMap[string, []html.Node]()
+	state.tagCache = utils.NewStateMap[string, []html.Node](state.Settings().SharedState, "go-away:tags:")
 
 	go func() {
 		ticker := time.NewTicker(time.Minute * 37)
@@ -278,6 +348,11 @@ func NewState(p policy.Policy, opt settings.Settings, settings policy.StateSetti
 			select {
 			case <-ticker.C:
 				state.tagCache.Decay()
+				for _, c := range state.challenges {
+					if c.Reuse != nil {
+						c.Reuse.Decay()
+					}
+				}
 			case <-state.close:
 				return
 			}
@@ -292,6 +367,9 @@ func (state *State) Close() error {
 	case <-state.close:
 	default:
 		close(state.close)
+		if state.keysWatcher != nil {
+			_ = state.keysWatcher.Close()
+		}
 		for _, c := range state.challenges {
 			if c.Object != nil {
 				err := c.Object.Close()
@@ -2,8 +2,17 @@ package utils
 
 import (
 	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"io/fs"
+	"log/slog"
+	"net/url"
 	"os"
-	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -11,6 +20,52 @@ type Cache interface {
 	Get(key string, maxAge time.Duration) ([]byte, error)
 
 	Set(key string, value []byte) error
+
+	Delete(key string) error
+
+	// Stat Returns information about the entry at key without reading it
+	Stat(key string) (CacheInfo, error)
+
+	// Range Calls f for each entry, until f returns false
+	Range(f func(key string, info CacheInfo) bool) error
+}
+
+type CacheInfo struct {
+	Size     int64
+	Modified time.Time
+}
+
+var ErrExpired = errors.New("key expired")
+var ErrInvalidKey = errors.New("invalid key")
+
+var cacheMetrics = struct {
+	results   *prometheus.CounterVec
+	evictions *prometheus.CounterVec
+	size      *prometheus.GaugeVec
+}{
+	results: promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "go-away_cache_results",
+		Help: "The number of cache hits, misses or expired entries per tier",
+	}, []string{"tier", "result"}),
+	evictions: promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "go-away_cache_evictions",
+		Help: "The number of entries evicted per tier",
+	}, []string{"tier"}),
+	size: promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "go-away_cache_size_bytes",
+		Help: "The size of cached entries per tier",
+	}, []string{"tier"}),
+}
+
+func cacheResult(tier string, err error) {
+	switch {
+	case err == nil:
+		cacheMetrics.results.With(prometheus.Labels{"tier": tier, "result": "hit"}).Inc()
+	case errors.Is(err, ErrExpired):
+		cacheMetrics.results.With(prometheus.Labels{"tier": tier, "result": "expired"}).Inc()
+	default:
+		cacheMetrics.results.With(prometheus.Labels{"tier": tier, "result": "miss"}).Inc()
+	}
 }
 
 func CachePrefix(c Cache, prefix string) Cache {
@@ -23,15 +78,6 @@ func CachePrefix(c Cache, prefix string) Cache {
 	}
 }
 
-func CacheDirectory(directory string) (Cache, error) {
-	if stat, err := os.Stat(directory); err != nil {
-		return nil, err
-	} else if !stat.IsDir() {
-		return nil, errors.New("not a directory")
-	}
-	return dirCache(directory), nil
-}
-
 type prefixCache struct {
 	c      Cache
 	prefix string
@@ -45,12 +91,134 @@ func (c prefixCache) Set(key string, value []byte) error {
 	return c.c.Set(c.prefix+key, value)
 }
 
-type dirCache string
+func (c prefixCache) Delete(key string) error {
+	return c.c.Delete(c.prefix + key)
+}
 
-var ErrExpired = errors.New("key expired")
+func (c prefixCache) Stat(key string) (CacheInfo, error) {
+	return c.c.Stat(c.prefix + key)
+}
+
+func (c prefixCache) Range(f func(key string, info CacheInfo) bool) error {
+	return c.c.Range(func(key string, info CacheInfo) bool {
+		if k, ok := strings.CutPrefix(key, c.prefix); ok {
+			return f(k, info)
+		}
+		return true
+	})
+}
+
+// cacheFileSuffix Marks files as cache entries, other files within the directory are left alone
+const cacheFileSuffix = ".cache"
 
-func (d dirCache) Get(key string, maxAge time.Duration) ([]byte, error) {
-	fname := path.Join(string(d), key)
+// cacheTempPrefix Temporary files being written. Escaped keys never start with a dot
+const cacheTempPrefix = ".tmp-"
+
+// cacheKeyPath Escapes key into a relative file path
+// Slashes separate subdirectories, other characters outside [A-Za-z0-9._-] and leading dots are percent-encoded
+func cacheKeyPath(key string) (string, error) {
+	if key == "" {
+		return "", ErrInvalidKey
+	}
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		if segment == "" {
+			return "", ErrInvalidKey
+		}
+		var b strings.Builder
+		for j := 0; j < len(segment); j++ {
+			c := segment[j]
+			if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || (c == '.' && j > 0) {
+				b.WriteByte(c)
+			} else {
+				_, _ = fmt.Fprintf(&b, "%%%02X", c)
+			}
+		}
+		segments[i] = b.String()
+	}
+	return filepath.Join(segments...) + cacheFileSuffix, nil
+}
+
+// cachePathKey Reverses cacheKeyPath
+func cachePathKey(p string) (string, error) {
+	p, ok := strings.CutSuffix(filepath.ToSlash(p), cacheFileSuffix)
+	if !ok {
+		return "", ErrInvalidKey
+	}
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		var err error
+		if segments[i], err = url.PathUnescape(segment); err != nil {
+			return "", err
+		}
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// CacheDirectory Keeps entries as files within directory
+// If maxSize or maxAge are not zero, entries are evicted in background to stay within these bounds, oldest first
+func CacheDirectory(directory string, maxSize int64, maxAge time.Duration) (Cache, error) {
+	if stat, err := os.Stat(directory); err != nil {
+		return nil, err
+	} else if !stat.IsDir() {
+		return nil, errors.New("not a directory")
+	}
+	d := &dirCache{
+		directory: directory,
+		maxSize:   maxSize,
+		maxAge:    maxAge,
+		evict:     make(chan struct{}, 1),
+	}
+
+	// calculate initial size, and evict if necessary
+	d.evictEntries()
+
+	if maxSize > 0 || maxAge > 0 {
+		interval := time.Hour
+		if maxAge > 0 {
+			interval = min(interval, max(time.Minute, maxAge/4))
+		}
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+				case <-d.evict:
+				}
+				d.evictEntries()
+			}
+		}()
+	}
+	return d, nil
+}
+
+type dirCache struct {
+	directory string
+	maxSize   int64
+	maxAge    time.Duration
+
+	size  atomic.Int64
+	evict chan struct{}
+}
+
+func (d *dirCache) path(key string) (string, error) {
+	p, err := cacheKeyPath(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(d.directory, p), nil
+}
+
+func (d *dirCache) Get(key string, maxAge time.Duration) (data []byte, err error) {
+	defer func() {
+		cacheResult("directory", err)
+	}()
+
+	fname, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
 	stat, err := os.Stat(fname)
 	if err != nil {
 		return nil, err
@@ -58,7 +226,7 @@ func (d dirCache) Get(key string, maxAge time.Duration) ([]byte, error) {
 	if stat.IsDir() {
 		return nil, errors.New("key is directory")
 	}
-	data, err := os.ReadFile(fname)
+	data, err = os.ReadFile(fname)
 	if err != nil {
 		return nil, err
 	}
@@ -70,17 +238,179 @@ func (d dirCache) Get(key string, maxAge time.Duration) ([]byte, error) {
 	}
 }
 
-func (d dirCache) Set(key string, value []byte) error {
-	fname := path.Join(string(d), key)
-	fs, err := os.Create(fname)
+func (d *dirCache) Set(key string, value []byte) error {
+	fname, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(fname)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// write to a temporary file then rename it, so readers never see partial entries
+	f, err := os.CreateTemp(dir, cacheTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	// temporary files are created private
+	_ = f.Chmod(0644)
+	_, err = f.Write(value)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	var previousSize int64
+	if stat, err := os.Stat(fname); err == nil {
+		previousSize = stat.Size()
+	}
+	if err = os.Rename(f.Name(), fname); err != nil {
+		return err
+	}
+
+	size := d.size.Add(int64(len(value)) - previousSize)
+	cacheMetrics.size.With(prometheus.Labels{"tier": "directory"}).Set(float64(size))
+	if d.maxSize > 0 && size > d.maxSize {
+		select {
+		case d.evict <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (d *dirCache) Delete(key string) error {
+	fname, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	stat, err := os.Stat(fname)
 	if err != nil {
 		return err
 	}
-	defer fs.Close()
-	_, err = fs.Write(value)
-	fs.Sync()
-	fs.Close()
+	if err = os.Remove(fname); err != nil {
+		return err
+	}
+	size := d.size.Add(-stat.Size())
+	cacheMetrics.size.With(prometheus.Labels{"tier": "directory"}).Set(float64(size))
+	return nil
+}
+
+func (d *dirCache) Stat(key string) (CacheInfo, error) {
+	fname, err := d.path(key)
+	if err != nil {
+		return CacheInfo{}, err
+	}
+	stat, err := os.Stat(fname)
+	if err != nil {
+		return CacheInfo{}, err
+	}
+	return CacheInfo{
+		Size:     stat.Size(),
+		Modified: stat.ModTime(),
+	}, nil
+}
 
-	_ = os.Chtimes(fname, time.Time{}, time.Now())
+func (d *dirCache) Range(f func(key string, info CacheInfo) bool) error {
+	err := filepath.WalkDir(d.directory, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// entries might be removed concurrently
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), cacheFileSuffix) {
+			return nil
+		}
+		rel, err := filepath.Rel(d.directory, p)
+		if err != nil {
+			return err
+		}
+		key, err := cachePathKey(rel)
+		if err != nil {
+			// not ours
+			return nil
+		}
+		stat, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		if !f(key, CacheInfo{Size: stat.Size(), Modified: stat.ModTime()}) {
+			return fs.SkipAll
+		}
+		return nil
+	})
 	return err
 }
+
+// evictEntries Removes entries older than maxAge, then oldest entries until within maxSize
+// Leftover temporary files from interrupted writes are removed as well
+func (d *dirCache) evictEntries() {
+	type entry struct {
+		key  string
+		info CacheInfo
+	}
+	var entries []entry
+	var size int64
+
+	now := time.Now()
+	_ = filepath.WalkDir(d.directory, func(p string, e fs.DirEntry, err error) error {
+		if err != nil || e.IsDir() || !strings.HasPrefix(e.Name(), cacheTempPrefix) {
+			return nil
+		}
+		if stat, err := e.Info(); err == nil && stat.ModTime().Before(now.Add(-time.Hour)) {
+			_ = os.Remove(p)
+		}
+		return nil
+	})
+
+	err := d.Range(func(key string, info CacheInfo) bool {
+		if d.maxAge > 0 && info.Modified.Before(now.Add(-d.maxAge)) {
+			if err := d.remove(key); err == nil {
+				cacheMetrics.evictions.With(prometheus.Labels{"tier": "directory"}).Inc()
+			}
+			return true
+		}
+		entries = append(entries, entry{key: key, info: info})
+		size += info.Size
+		return true
+	})
+	if err != nil {
+		slog.Error("error evicting cache entries", "directory", d.directory, "error", err)
+	}
+
+	if d.maxSize > 0 && size > d.maxSize {
+		slices.SortFunc(entries, func(a, b entry) int {
+			return a.info.Modified.Compare(b.info.Modified)
+		})
+		for _, e := range entries {
+			if size <= d.maxSize {
+				break
+			}
+			if err := d.remove(e.key); err == nil {
+				cacheMetrics.evictions.With(prometheus.Labels{"tier": "directory"}).Inc()
+				size -= e.info.Size
+			}
+		}
+	}
+
+	d.size.Store(size)
+	cacheMetrics.size.With(prometheus.Labels{"tier": "directory"}).Set(float64(size))
+}
+
+// remove Deletes the entry without accounting for size
+func (d *dirCache) remove(key string) error {
+	fname, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	return os.Remove(fname)
+}
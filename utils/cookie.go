@@ -1,13 +1,123 @@
 package utils
 
 import (
+	"fmt"
+	"golang.org/x/net/publicsuffix"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 )
 
 var DefaultCookiePrefix = ".go-away-"
 
+const (
+	CookieNamePrefixHost   = "__Host-"
+	CookieNamePrefixSecure = "__Secure-"
+)
+
+// CookieSettings Attributes of cookies set by go-away
+type CookieSettings struct {
+	// Domains Parent domains whose subdomains share cookies, instead of scoping them to the exact request host
+	Domains []string `yaml:"domains"`
+
+	// SameSite One of lax, strict or none. Defaults to lax
+	SameSite string `yaml:"same-site"`
+
+	// Secure Only send cookies over HTTPS. Implied by none SameSite and cookie name prefixes
+	Secure bool `yaml:"secure"`
+
+	// NamePrefix Cookie name prefix, either __Host- or __Secure-
+	NamePrefix string `yaml:"name-prefix"`
+}
+
+func (s CookieSettings) Validate() error {
+	switch strings.ToLower(s.SameSite) {
+	case "", "lax", "strict", "none":
+	default:
+		return fmt.Errorf("invalid same-site value %s", s.SameSite)
+	}
+
+	switch s.NamePrefix {
+	case "", CookieNamePrefixSecure:
+	case CookieNamePrefixHost:
+		if len(s.Domains) > 0 {
+			return fmt.Errorf("%s cookies cannot be shared across domains", CookieNamePrefixHost)
+		}
+	default:
+		return fmt.Errorf("invalid cookie name prefix %s", s.NamePrefix)
+	}
+
+	for _, domain := range s.Domains {
+		if domain == "" || strings.HasPrefix(domain, ".") {
+			return fmt.Errorf("invalid domain %s", domain)
+		}
+		// refuse public suffixes, cookies would be rejected by clients
+		if _, err := publicsuffix.EffectiveTLDPlusOne(domain); err != nil {
+			return fmt.Errorf("invalid domain %s: %w", domain, err)
+		}
+	}
+	return nil
+}
+
+// Name Returns the cookie name with configured prefix
+func (s CookieSettings) Name(name string) string {
+	return s.NamePrefix + name
+}
+
+// IsOwn Whether the cookie name is one of the cookies set by go-away
+func (s CookieSettings) IsOwn(name string) bool {
+	return strings.HasPrefix(strings.TrimPrefix(name, s.NamePrefix), DefaultCookiePrefix)
+}
+
+// Domain Returns the domain cookies are scoped to for the request host.
+// This is the matching configured parent domain, otherwise the host itself
+func (s CookieSettings) Domain(host string) string {
+	host = strings.ToLower(getValidHost(host))
+	for _, domain := range s.Domains {
+		domain = strings.ToLower(domain)
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return domain
+		}
+	}
+	return host
+}
+
+func (s CookieSettings) cookie(name, value string, r *http.Request) *http.Cookie {
+	c := &http.Cookie{
+		Name:     s.Name(name),
+		Value:    value,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   s.Secure || s.NamePrefix != "",
+		Path:     "/",
+	}
+	switch strings.ToLower(s.SameSite) {
+	case "strict":
+		c.SameSite = http.SameSiteStrictMode
+	case "none":
+		c.SameSite = http.SameSiteNoneMode
+		c.Secure = true
+	}
+	// __Host- cookies must not set domain
+	if s.NamePrefix != CookieNamePrefixHost {
+		c.Domain = s.Domain(r.Host)
+	}
+	return c
+}
+
+func (s CookieSettings) Set(name, value string, expiry time.Time, w http.ResponseWriter, r *http.Request) {
+	c := s.cookie(name, value, r)
+	c.Expires = expiry
+	http.SetCookie(w, c)
+}
+
+func (s CookieSettings) Clear(name string, w http.ResponseWriter, r *http.Request) {
+	c := s.cookie(name, "", r)
+	c.Expires = time.Now().Add(-1 * time.Hour)
+	c.MaxAge = -1
+	http.SetCookie(w, c)
+}
+
 // getValidHost Gets a valid host for an http.Cookie Domain field
 // TODO: bug: does not work with IPv6, see https://github.com/golang/go/issues/65521
 func getValidHost(host string) string {
@@ -19,23 +129,9 @@ func getValidHost(host string) string {
 }
 
 func SetCookie(name, value string, expiry time.Time, w http.ResponseWriter, r *http.Request) {
-	http.SetCookie(w, &http.Cookie{
-		Name:     name,
-		Value:    value,
-		Expires:  expiry,
-		SameSite: http.SameSiteLaxMode,
-		Path:     "/",
-		Domain:   getValidHost(r.Host),
-	})
+	CookieSettings{}.Set(name, value, expiry, w, r)
 }
 
 func ClearCookie(name string, w http.ResponseWriter, r *http.Request) {
-	http.SetCookie(w, &http.Cookie{
-		Name:     name,
-		Value:    "",
-		Expires:  time.Now().Add(-1 * time.Hour),
-		MaxAge:   -1,
-		SameSite: http.SameSiteLaxMode,
-		Domain:   getValidHost(r.Host),
-	})
+	CookieSettings{}.Clear(name, w, r)
 }
@@ -71,3 +71,30 @@ func (m *DecayMap[K, V]) Decay() {
 		}
 	}
 }
+
+func (m *DecayMap[K, V]) Delete(key K) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.data, key)
+}
+
+// GetEntry Returns the entry with its expiry, if not expired
+func (m *DecayMap[K, V]) GetEntry(key K) (DecayMapEntry[V], bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	value, ok := m.data[key]
+	if !ok || time.Now().After(value.expiry) {
+		return DecayMapEntry[V]{}, false
+	}
+	return value, true
+}
+
+// SetEntry Sets the entry keeping its expiry
+func (m *DecayMap[K, V]) SetEntry(key K, entry DecayMapEntry[V]) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.data[key] = entry
+}
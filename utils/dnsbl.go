@@ -40,6 +40,15 @@ const (
 )
 
 func (bl DNSBL) Lookup(ctx context.Context, ip net.IP) (DNSBLResponse, error) {
+	responses, err := bl.LookupAll(ctx, ip)
+	if err != nil || len(responses) == 0 {
+		return ResponseUnknown, err
+	}
+	return responses[0], nil
+}
+
+// LookupAll Returns all response codes for the ip, as some lists return one code per matching sub-list
+func (bl DNSBL) LookupAll(ctx context.Context, ip net.IP) ([]DNSBLResponse, error) {
 	var target []byte
 	if ip4 := ip.To4(); ip4 != nil {
 		// max length preallocate
@@ -63,13 +72,14 @@ func (bl DNSBL) Lookup(ctx context.Context, ip net.IP) (DNSBLResponse, error) {
 
 	ips, err := bl.resolver.LookupIP(ctx, "ip4", string(target))
 	if err != nil {
-		return ResponseUnknown, err
+		return nil, err
 	}
 
+	responses := make([]DNSBLResponse, 0, len(ips))
 	for _, ip := range ips {
 		ip4 := ip.To4()
-		return DNSBLResponse(ip4[len(ip4)-1]), nil
+		responses = append(responses, DNSBLResponse(ip4[len(ip4)-1]))
 	}
 
-	return ResponseUnknown, nil
+	return responses, nil
 }
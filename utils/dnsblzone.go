@@ -0,0 +1,314 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/yl2chen/cidranger"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// DNSBLZone Blocklist loaded from a local rbldnsd ip4set or ip6trie zone file, served without DNS queries
+// Entries are matched by longest prefix, and excluded entries (prefixed by !) are not listed
+type DNSBLZone struct {
+	Path string
+
+	ranger atomic.Pointer[cidranger.Ranger]
+}
+
+type dnsblZoneEntry struct {
+	network  net.IPNet
+	response DNSBLResponse
+	text     string
+	excluded bool
+}
+
+func (e *dnsblZoneEntry) Network() net.IPNet {
+	return e.network
+}
+
+func NewDNSBLZone(path string) (*DNSBLZone, error) {
+	z := &DNSBLZone{
+		Path: path,
+	}
+	if err := z.Load(); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// Load Reads the zone file, replacing entries atomically
+func (z *DNSBLZone) Load() error {
+	f, err := os.Open(z.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ranger, err := parseDNSBLZone(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", z.Path, err)
+	}
+	z.ranger.Store(&ranger)
+	return nil
+}
+
+// LookupEntry Returns the response code and TXT message for the ip, if listed
+func (z *DNSBLZone) LookupEntry(ip net.IP) (response DNSBLResponse, text string, ok bool) {
+	ranger := *z.ranger.Load()
+	entries, err := ranger.ContainingNetworks(ip)
+	if err != nil || len(entries) == 0 {
+		return ResponseUnknown, "", false
+	}
+
+	// most specific match
+	var match *dnsblZoneEntry
+	var matchBits int
+	for _, e := range entries {
+		entry := e.(*dnsblZoneEntry)
+		if bits, _ := entry.network.Mask.Size(); match == nil || bits > matchBits || (bits == matchBits && entry.excluded) {
+			match, matchBits = entry, bits
+		}
+	}
+
+	if match.excluded {
+		return ResponseUnknown, "", false
+	}
+
+	return match.response, strings.ReplaceAll(match.text, "$", ip.String()), true
+}
+
+// Lookup Same semantics as DNSBL.Lookup, ResponseUnknown is returned when not listed
+func (z *DNSBLZone) Lookup(ctx context.Context, ip net.IP) (DNSBLResponse, error) {
+	response, _, _ := z.LookupEntry(ip)
+	return response, nil
+}
+
+// LookupAll Same semantics as DNSBL.LookupAll, no responses are returned when not listed
+func (z *DNSBLZone) LookupAll(ctx context.Context, ip net.IP) ([]DNSBLResponse, error) {
+	response, _, ok := z.LookupEntry(ip)
+	if !ok {
+		return nil, nil
+	}
+	return []DNSBLResponse{response}, nil
+}
+
+// parseDNSBLValue Parses the A part of a value, either a full 127.0.0.x address or only the last octet
+func parseDNSBLValue(s string) (DNSBLResponse, error) {
+	if strings.Contains(s, ".") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil || !addr.Is4() {
+			return 0, fmt.Errorf("invalid value %s", s)
+		}
+		a := addr.As4()
+		return DNSBLResponse(a[3]), nil
+	}
+	v, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %s", s)
+	}
+	return DNSBLResponse(v), nil
+}
+
+// parseDNSBLZoneValue Parses a :A:TXT, :A or TXT value
+func parseDNSBLZoneValue(s string, defaultResponse DNSBLResponse, defaultText string) (DNSBLResponse, string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return defaultResponse, defaultText, nil
+	}
+	if !strings.HasPrefix(s, ":") {
+		return defaultResponse, s, nil
+	}
+	a, text, hasText := strings.Cut(s[1:], ":")
+	if !hasText {
+		text = defaultText
+	}
+	response := defaultResponse
+	if a = strings.TrimSpace(a); a != "" {
+		var err error
+		response, err = parseDNSBLValue(a)
+		if err != nil {
+			return 0, "", err
+		}
+	}
+	return response, text, nil
+}
+
+// parseDNSBLZoneNetworks Parses rbldnsd address formats: full or partial IPv4 addresses, CIDR prefixes, IPv4 ranges and IPv6 prefixes
+func parseDNSBLZoneNetworks(s string) ([]netip.Prefix, error) {
+	if strings.Contains(s, ":") {
+		// IPv6
+		if strings.Contains(s, "/") {
+			prefix, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, err
+			}
+			return []netip.Prefix{prefix.Masked()}, nil
+		}
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, err
+		}
+		return []netip.Prefix{netip.PrefixFrom(addr, addr.BitLen())}, nil
+	}
+
+	if from, to, ok := strings.Cut(s, "-"); ok {
+		start, err := netip.ParseAddr(from)
+		if err != nil || !start.Is4() {
+			return nil, fmt.Errorf("invalid range %s", s)
+		}
+		var end netip.Addr
+		if !strings.Contains(to, ".") {
+			// only last octet
+			last, err := strconv.ParseUint(to, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid range %s", s)
+			}
+			a := start.As4()
+			a[3] = byte(last)
+			end = netip.AddrFrom4(a)
+		} else if end, err = netip.ParseAddr(to); err != nil || !end.Is4() {
+			return nil, fmt.Errorf("invalid range %s", s)
+		}
+		if end.Less(start) {
+			return nil, fmt.Errorf("invalid range %s", s)
+		}
+		return rangeToPrefixes(start, end), nil
+	}
+
+	addrPart, bitsPart, hasBits := strings.Cut(s, "/")
+	octets := strings.Split(addrPart, ".")
+	if len(octets) > 4 {
+		return nil, fmt.Errorf("invalid address %s", s)
+	}
+	var a [4]byte
+	for i, o := range octets {
+		v, err := strconv.ParseUint(o, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %s", s)
+		}
+		a[i] = byte(v)
+	}
+	// partial addresses cover the whole range below them
+	bits := len(octets) * 8
+	if hasBits {
+		v, err := strconv.ParseUint(bitsPart, 10, 8)
+		if err != nil || v > 32 {
+			return nil, fmt.Errorf("invalid prefix %s", s)
+		}
+		bits = int(v)
+	}
+	return []netip.Prefix{netip.PrefixFrom(netip.AddrFrom4(a), bits).Masked()}, nil
+}
+
+// rangeToPrefixes Returns the minimal set of prefixes covering the inclusive range
+func rangeToPrefixes(start, end netip.Addr) (prefixes []netip.Prefix) {
+	for {
+		bits := start.BitLen()
+		// widen prefix while aligned and within range
+		for bits > 0 {
+			p := netip.PrefixFrom(start, bits-1).Masked()
+			if p.Addr() != start || lastAddr(p).Compare(end) > 0 {
+				break
+			}
+			bits--
+		}
+		p := netip.PrefixFrom(start, bits)
+		prefixes = append(prefixes, p)
+		last := lastAddr(p)
+		if last.Compare(end) >= 0 {
+			return prefixes
+		}
+		start = last.Next()
+	}
+}
+
+func lastAddr(p netip.Prefix) netip.Addr {
+	a := p.Addr().As16()
+	offset := 0
+	if p.Addr().Is4() {
+		offset = 96
+	}
+	for i := p.Bits() + offset; i < 128; i++ {
+		a[i/8] |= 1 << (7 - i%8)
+	}
+	if p.Addr().Is4() {
+		return netip.AddrFrom16(a).Unmap()
+	}
+	return netip.AddrFrom16(a)
+}
+
+func parseDNSBLZone(r io.Reader) (cidranger.Ranger, error) {
+	ranger := cidranger.NewPCTrieRanger()
+
+	defaultResponse := DNSBLResponse(2)
+	var defaultText string
+
+	scanner := bufio.NewScanner(r)
+	var lineNumber int
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' || line[0] == '$' {
+			// comments and directives
+			continue
+		}
+
+		if line[0] == ':' {
+			// default value
+			var err error
+			defaultResponse, defaultText, err = parseDNSBLZoneValue(line, defaultResponse, defaultText)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+			}
+			continue
+		}
+
+		entry, value, _ := strings.Cut(line, " ")
+		if i := strings.IndexByte(entry, '\t'); i != -1 {
+			entry, value = entry[:i], entry[i+1:]+" "+value
+		}
+
+		excluded := strings.HasPrefix(entry, "!")
+		entry = strings.TrimPrefix(entry, "!")
+
+		prefixes, err := parseDNSBLZoneNetworks(entry)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+
+		response, text, err := parseDNSBLZoneValue(value, defaultResponse, defaultText)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		if !excluded && !response.Bad() {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, errors.New("value must be a listed code"))
+		}
+
+		for _, prefix := range prefixes {
+			err = ranger.Insert(&dnsblZoneEntry{
+				network: net.IPNet{
+					IP:   prefix.Addr().AsSlice(),
+					Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+				},
+				response: response,
+				text:     text,
+				excluded: excluded,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ranger, nil
+}
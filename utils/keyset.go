@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// SigningKey Ed25519 key used to sign and encrypt state, identified via JWS/JWE kid header
+type SigningKey struct {
+	Id         string
+	PrivateKey ed25519.PrivateKey
+	PublicKey  ed25519.PublicKey
+
+	// NotAfter Time after which the key is not accepted for verification anymore. Zero if unbounded
+	NotAfter time.Time
+}
+
+func NewSigningKey(privateKey ed25519.PrivateKey) *SigningKey {
+	publicKey := privateKey.Public().(ed25519.PublicKey)
+	sum := sha256.Sum256(publicKey)
+	return &SigningKey{
+		Id:         hex.EncodeToString(sum[:8]),
+		PrivateKey: privateKey,
+		PublicKey:  publicKey,
+	}
+}
+
+func (k *SigningKey) Fingerprint() []byte {
+	fp := sha256.Sum256(k.PrivateKey)
+	return fp[:]
+}
+
+// Valid Whether the key is accepted for verification at the given time
+func (k *SigningKey) Valid(now time.Time) bool {
+	return k.NotAfter.IsZero() || now.Before(k.NotAfter)
+}
+
+// ParseSigningKey Parses a PKCS #8 PEM encoded Ed25519 private key, a hex encoded seed or a raw seed
+func ParseSigningKey(data []byte) (ed25519.PrivateKey, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "PRIVATE KEY" {
+			return nil, fmt.Errorf("unsupported PEM block type %s", block.Type)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		privateKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("not an Ed25519 private key")
+		}
+		return privateKey, nil
+	}
+
+	if len(data) == ed25519.SeedSize {
+		return ed25519.NewKeyFromSeed(data), nil
+	}
+
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode seed: %w", err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid seed length: %d, expected %d", len(seed), ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// KeySet Ordered set of signing keys, newest first
+// The first key is the active one used to sign new state, the others are only used for verification
+type KeySet struct {
+	Keys []*SigningKey
+}
+
+// Active Key used to sign new state
+func (s *KeySet) Active() *SigningKey {
+	return s.Keys[0]
+}
+
+// Get Returns the key with matching id
+func (s *KeySet) Get(id string) *SigningKey {
+	for _, k := range s.Keys {
+		if k.Id == id {
+			return k
+		}
+	}
+	return nil
+}
+
+// LoadKeySet Loads keys from files in directory, sorted by file name with the last one being active.
+// Files can contain PEM encoded private keys or seeds, see ParseSigningKey. Hidden files are ignored.
+// Keys that have been superseded are accepted for verification for grace duration after the modification time of the newer key file, or while present if grace is zero.
+// initial if set is taken as the oldest key, superseded by any key in directory.
+func LoadKeySet(directory string, grace time.Duration, initial *SigningKey) (*KeySet, error) {
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	type keyEntry struct {
+		key     *SigningKey
+		modTime time.Time
+	}
+
+	var keys []keyEntry
+	if initial != nil {
+		keys = append(keys, keyEntry{key: initial})
+	}
+
+	// ReadDir returns entries sorted by file name
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") || !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(path.Join(directory, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		privateKey, err := ParseSigningKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		keys = append(keys, keyEntry{
+			key:     NewSigningKey(privateKey),
+			modTime: info.ModTime(),
+		})
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys found in %s", directory)
+	}
+
+	set := &KeySet{}
+	for i, e := range keys {
+		if set.Get(e.key.Id) != nil {
+			// duplicate key, keep newest
+			set.Keys = slices.DeleteFunc(set.Keys, func(k *SigningKey) bool {
+				return k.Id == e.key.Id
+			})
+		}
+		if grace > 0 && i < len(keys)-1 {
+			e.key.NotAfter = keys[i+1].modTime.Add(grace)
+		} else {
+			e.key.NotAfter = time.Time{}
+		}
+		set.Keys = append(set.Keys, e.key)
+	}
+	slices.Reverse(set.Keys)
+
+	return set, nil
+}
@@ -0,0 +1,174 @@
+package utils
+
+import (
+	"container/list"
+	"github.com/prometheus/client_golang/prometheus"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// CacheMemory Keeps up to maxSize bytes of recently used entries in memory, in front of c
+// If c is nil, entries are only kept in memory
+func CacheMemory(c Cache, maxSize int64) Cache {
+	return &memoryCache{
+		c:       c,
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+type memoryCacheEntry struct {
+	key   string
+	value []byte
+	info  CacheInfo
+}
+
+type memoryCache struct {
+	c       Cache
+	maxSize int64
+
+	lock    sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	// lru Most recently used entries first
+	lru *list.List
+}
+
+func (m *memoryCache) Get(key string, maxAge time.Duration) ([]byte, error) {
+	m.lock.Lock()
+	if e, ok := m.entries[key]; ok {
+		m.lru.MoveToFront(e)
+		entry := e.Value.(*memoryCacheEntry)
+		m.lock.Unlock()
+
+		var err error
+		if entry.info.Modified.Before(time.Now().Add(-maxAge)) {
+			err = ErrExpired
+		}
+		cacheResult("memory", err)
+		return slices.Clone(entry.value), err
+	}
+	m.lock.Unlock()
+	cacheResult("memory", os.ErrNotExist)
+
+	if m.c == nil {
+		return nil, os.ErrNotExist
+	}
+
+	data, err := m.c.Get(key, maxAge)
+	if err == nil {
+		if info, err := m.c.Stat(key); err == nil {
+			m.add(key, slices.Clone(data), info)
+		}
+	}
+	return data, err
+}
+
+func (m *memoryCache) Set(key string, value []byte) error {
+	if m.c != nil {
+		if err := m.c.Set(key, value); err != nil {
+			m.remove(key)
+			return err
+		}
+	}
+	m.add(key, slices.Clone(value), CacheInfo{
+		Size:     int64(len(value)),
+		Modified: time.Now(),
+	})
+	return nil
+}
+
+func (m *memoryCache) Delete(key string) error {
+	ok := m.remove(key)
+	if m.c != nil {
+		return m.c.Delete(key)
+	} else if !ok {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+func (m *memoryCache) Stat(key string) (CacheInfo, error) {
+	m.lock.Lock()
+	e, ok := m.entries[key]
+	m.lock.Unlock()
+	if ok {
+		return e.Value.(*memoryCacheEntry).info, nil
+	}
+	if m.c == nil {
+		return CacheInfo{}, os.ErrNotExist
+	}
+	return m.c.Stat(key)
+}
+
+func (m *memoryCache) Range(f func(key string, info CacheInfo) bool) error {
+	if m.c != nil {
+		// memory entries are a subset of these
+		return m.c.Range(f)
+	}
+
+	m.lock.Lock()
+	entries := make([]memoryCacheEntry, 0, len(m.entries))
+	for e := m.lru.Front(); e != nil; e = e.Next() {
+		entries = append(entries, *e.Value.(*memoryCacheEntry))
+	}
+	m.lock.Unlock()
+
+	for _, entry := range entries {
+		if !f(entry.key, entry.info) {
+			break
+		}
+	}
+	return nil
+}
+
+func (m *memoryCache) add(key string, value []byte, info CacheInfo) {
+	size := int64(len(value))
+	if size > m.maxSize {
+		m.remove(key)
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if e, ok := m.entries[key]; ok {
+		m.size -= int64(len(e.Value.(*memoryCacheEntry).value))
+		m.lru.Remove(e)
+	}
+	m.entries[key] = m.lru.PushFront(&memoryCacheEntry{
+		key:   key,
+		value: value,
+		info:  info,
+	})
+	m.size += size
+
+	// evict least recently used
+	for m.size > m.maxSize {
+		e := m.lru.Back()
+		entry := e.Value.(*memoryCacheEntry)
+		m.lru.Remove(e)
+		delete(m.entries, entry.key)
+		m.size -= int64(len(entry.value))
+		cacheMetrics.evictions.With(prometheus.Labels{"tier": "memory"}).Inc()
+	}
+	cacheMetrics.size.With(prometheus.Labels{"tier": "memory"}).Set(float64(m.size))
+}
+
+func (m *memoryCache) remove(key string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	e, ok := m.entries[key]
+	if !ok {
+		return false
+	}
+	m.lru.Remove(e)
+	delete(m.entries, key)
+	m.size -= int64(len(e.Value.(*memoryCacheEntry).value))
+	cacheMetrics.size.With(prometheus.Labels{"tier": "memory"}).Set(float64(m.size))
+	return true
+}
@@ -0,0 +1,447 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const redisDialTimeout = time.Second * 5
+const redisMaxIdleConnections = 16
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// buffer Encodes a command without sending it
+func (c *redisConn) buffer(args ...[]byte) {
+	_, _ = fmt.Fprintf(c.writer, "*%d\r\n", len(args))
+	for _, arg := range args {
+		_, _ = fmt.Fprintf(c.writer, "$%d\r\n", len(arg))
+		_, _ = c.writer.Write(arg)
+		_, _ = c.writer.WriteString("\r\n")
+	}
+}
+
+func (c *redisConn) write(args ...[]byte) error {
+	c.buffer(args...)
+	return c.writer.Flush()
+}
+
+func (c *redisConn) readLine() (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", errors.New("redis: invalid reply")
+	}
+	return line[:len(line)-2], nil
+}
+
+// read Reads a RESP2 reply: string, []byte, int64, []any, nil or redisError
+func (c *redisConn) read() (any, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return redisError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(c.reader, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		values := make([]any, n)
+		for i := range values {
+			if values[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	default:
+		return nil, errors.New("redis: invalid reply")
+	}
+}
+
+type redisSharedState struct {
+	address  string
+	password string
+	db       int
+
+	idle chan *redisConn
+
+	subscriberLock sync.Mutex
+	subscriberConn *redisConn
+	subscribers    map[string][]*memorySubscriber
+
+	close chan struct{}
+}
+
+// NewRedisSharedState Keeps state on a server speaking the Redis protocol, such as Redis or Valkey
+func NewRedisSharedState(uri *url.URL) (SharedState, error) {
+	s := &redisSharedState{
+		address:     uri.Host,
+		idle:        make(chan *redisConn, redisMaxIdleConnections),
+		subscribers: make(map[string][]*memorySubscriber),
+		close:       make(chan struct{}),
+	}
+	if _, _, err := net.SplitHostPort(s.address); err != nil {
+		s.address = net.JoinHostPort(s.address, "6379")
+	}
+	if uri.User != nil {
+		s.password, _ = uri.User.Password()
+	}
+	if db := strings.Trim(uri.Path, "/"); db != "" {
+		var err error
+		if s.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis db %s", db)
+		}
+	}
+
+	// check connectivity
+	conn, err := s.dial(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	s.put(conn)
+
+	go s.subscriberLoop()
+
+	return s, nil
+}
+
+func (s *redisSharedState) dial(ctx context.Context) (*redisConn, error) {
+	ctx, cancel := context.WithTimeout(ctx, redisDialTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.address)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if s.password != "" {
+		if _, err = c.do([]byte("AUTH"), []byte(s.password)); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	if s.db != 0 {
+		if _, err = c.do([]byte("SELECT"), []byte(strconv.Itoa(s.db))); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// do Sends a command and reads its reply, returning server errors as error
+func (c *redisConn) do(args ...[]byte) (any, error) {
+	if err := c.write(args...); err != nil {
+		return nil, err
+	}
+	reply, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := reply.(redisError); ok {
+		return nil, e
+	}
+	return reply, nil
+}
+
+func (s *redisSharedState) get(ctx context.Context) (*redisConn, error) {
+	select {
+	case c := <-s.idle:
+		return c, nil
+	default:
+		return s.dial(ctx)
+	}
+}
+
+func (s *redisSharedState) put(c *redisConn) {
+	select {
+	case s.idle <- c:
+	default:
+		_ = c.conn.Close()
+	}
+}
+
+// pipeline Sends commands on one connection and returns all replies
+func (s *redisSharedState) pipeline(ctx context.Context, commands ...[][]byte) ([]any, error) {
+	c, err := s.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.conn.SetDeadline(deadline)
+	} else {
+		_ = c.conn.SetDeadline(time.Now().Add(redisDialTimeout))
+	}
+
+	replies := make([]any, len(commands))
+	for _, args := range commands {
+		c.buffer(args...)
+	}
+	if err = c.writer.Flush(); err != nil {
+		_ = c.conn.Close()
+		return nil, err
+	}
+	for i := range replies {
+		if replies[i], err = c.read(); err != nil {
+			_ = c.conn.Close()
+			return nil, err
+		}
+	}
+	_ = c.conn.SetDeadline(time.Time{})
+	s.put(c)
+
+	for _, reply := range replies {
+		if e, ok := reply.(redisError); ok {
+			return replies, e
+		}
+	}
+	return replies, nil
+}
+
+func (s *redisSharedState) Get(ctx context.Context, key string) ([]byte, error) {
+	replies, err := s.pipeline(ctx, [][]byte{[]byte("GET"), []byte(key)})
+	if err != nil {
+		return nil, err
+	}
+	switch v := replies[0].(type) {
+	case nil:
+		return nil, ErrStateNotFound
+	case []byte:
+		return v, nil
+	default:
+		return nil, errors.New("redis: unexpected reply")
+	}
+}
+
+func (s *redisSharedState) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	_, err := s.pipeline(ctx, [][]byte{[]byte("SET"), []byte(key), value, []byte("PX"), []byte(strconv.FormatInt(max(1, ttl.Milliseconds()), 10))})
+	return err
+}
+
+func (s *redisSharedState) Delete(ctx context.Context, key string) error {
+	_, err := s.pipeline(ctx, [][]byte{[]byte("DEL"), []byte(key)})
+	return err
+}
+
+func (s *redisSharedState) Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	ttlMs := []byte(strconv.FormatInt(max(1, ttl.Milliseconds()), 10))
+
+	// create counter with expiry if missing, then increment keeping expiry, within a transaction
+	replies, err := s.pipeline(ctx,
+		[][]byte{[]byte("MULTI")},
+		[][]byte{[]byte("SET"), []byte(key), []byte("0"), []byte("PX"), ttlMs, []byte("NX")},
+		[][]byte{[]byte("INCRBY"), []byte(key), []byte(strconv.FormatInt(delta, 10))},
+		[][]byte{[]byte("PTTL"), []byte(key)},
+		[][]byte{[]byte("EXEC")},
+	)
+	if err != nil {
+		return 0, err
+	}
+	results, ok := replies[4].([]any)
+	if !ok || len(results) != 3 {
+		return 0, errors.New("redis: transaction aborted")
+	}
+	for _, result := range results {
+		if e, ok := result.(redisError); ok {
+			return 0, e
+		}
+	}
+	n, ok := results[1].(int64)
+	if !ok {
+		return 0, errors.New("redis: unexpected reply")
+	}
+	if pttl, ok := results[2].(int64); ok && pttl == -1 {
+		// servers that do not freeze time within transactions can expire the counter between commands
+		if _, err = s.pipeline(ctx, [][]byte{[]byte("PEXPIRE"), []byte(key), ttlMs}); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (s *redisSharedState) Publish(ctx context.Context, channel string, message []byte) error {
+	_, err := s.pipeline(ctx, [][]byte{[]byte("PUBLISH"), []byte(channel), message})
+	return err
+}
+
+func (s *redisSharedState) Subscribe(channel string, callback func(message []byte)) (func(), error) {
+	sub := &memorySubscriber{callback: callback}
+
+	s.subscriberLock.Lock()
+	defer s.subscriberLock.Unlock()
+	s.subscribers[channel] = append(s.subscribers[channel], sub)
+	if len(s.subscribers[channel]) == 1 && s.subscriberConn != nil {
+		// on failure, subscription is retried on reconnection
+		_ = s.subscriberConn.write([]byte("SUBSCRIBE"), []byte(channel))
+	}
+
+	return func() {
+		s.subscriberLock.Lock()
+		defer s.subscriberLock.Unlock()
+		subscribers := s.subscribers[channel]
+		for i, other := range subscribers {
+			if other == sub {
+				s.subscribers[channel] = append(subscribers[:i:i], subscribers[i+1:]...)
+				break
+			}
+		}
+		if len(s.subscribers[channel]) == 0 {
+			delete(s.subscribers, channel)
+			if s.subscriberConn != nil {
+				_ = s.subscriberConn.write([]byte("UNSUBSCRIBE"), []byte(channel))
+			}
+		}
+	}, nil
+}
+
+// subscriberLoop Keeps a dedicated connection for subscriptions, reconnecting on failure
+func (s *redisSharedState) subscriberLoop() {
+	for {
+		err := s.subscribe()
+		select {
+		case <-s.close:
+			return
+		default:
+		}
+		slog.Error("redis subscriber disconnected, reconnecting", "address", s.address, "error", err)
+
+		select {
+		case <-s.close:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (s *redisSharedState) subscribe() error {
+	c, err := s.dial(context.Background())
+	if err != nil {
+		return err
+	}
+	defer c.conn.Close()
+
+	s.subscriberLock.Lock()
+	s.subscriberConn = c
+	args := [][]byte{[]byte("SUBSCRIBE")}
+	for channel := range s.subscribers {
+		args = append(args, []byte(channel))
+	}
+	if len(args) > 1 {
+		err = c.write(args...)
+	}
+	s.subscriberLock.Unlock()
+
+	defer func() {
+		s.subscriberLock.Lock()
+		s.subscriberConn = nil
+		s.subscriberLock.Unlock()
+	}()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// unblock reader on close
+		select {
+		case <-s.close:
+			_ = c.conn.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		reply, err := c.read()
+		if err != nil {
+			return err
+		}
+		values, ok := reply.([]any)
+		if !ok || len(values) != 3 {
+			continue
+		}
+		kind, _ := values[0].([]byte)
+		channel, _ := values[1].([]byte)
+		message, _ := values[2].([]byte)
+		if string(kind) != "message" {
+			continue
+		}
+
+		s.subscriberLock.Lock()
+		subscribers := s.subscribers[string(channel)]
+		s.subscriberLock.Unlock()
+		for _, sub := range subscribers {
+			sub.callback(message)
+		}
+	}
+}
+
+func (s *redisSharedState) Close() error {
+	select {
+	case <-s.close:
+	default:
+		close(s.close)
+		for {
+			select {
+			case c := <-s.idle:
+				_ = c.conn.Close()
+			default:
+				return nil
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"time"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+const SessionIdSize = 16
+
+// SessionStore Holds challenge state server-side, keyed by a random session id
+type SessionStore interface {
+	Get(id string) ([]byte, error)
+	Set(id string, value []byte, expiry time.Time) error
+	// Delete Revokes a session
+	Delete(id string) error
+	Close() error
+}
+
+func NewSessionId() string {
+	var id [SessionIdSize]byte
+	_, _ = rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// ValidSessionId Whether id has the format of ids returned by NewSessionId
+func ValidSessionId(id string) bool {
+	b, err := hex.DecodeString(id)
+	return err == nil && len(b) == SessionIdSize && hex.EncodeToString(b) == id
+}
+
+type memorySessionStore struct {
+	m     *DecayMap[string, []byte]
+	close chan struct{}
+}
+
+// NewMemorySessionStore Sessions are kept in memory until expiry, and lost on restart
+func NewMemorySessionStore() SessionStore {
+	s := memorySessionStore{
+		m:     NewDecayMap[string, []byte](),
+		close: make(chan struct{}),
+	}
+	go func() {
+		ticker := time.NewTicker(time.Minute * 5)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.m.Decay()
+			case <-s.close:
+				return
+			}
+		}
+	}()
+	return s
+}
+
+func (s memorySessionStore) Get(id string) ([]byte, error) {
+	if v, ok := s.m.Get(id); ok {
+		return v, nil
+	}
+	return nil, ErrSessionNotFound
+}
+
+func (s memorySessionStore) Set(id string, value []byte, expiry time.Time) error {
+	s.m.Set(id, value, time.Until(expiry))
+	return nil
+}
+
+func (s memorySessionStore) Delete(id string) error {
+	if _, ok := s.m.Get(id); !ok {
+		return ErrSessionNotFound
+	}
+	s.m.Delete(id)
+	return nil
+}
+
+func (s memorySessionStore) Close() error {
+	select {
+	case <-s.close:
+	default:
+		close(s.close)
+	}
+	return nil
+}
+
+type directorySessionStore struct {
+	directory string
+	close     chan struct{}
+}
+
+// NewDirectorySessionStore Sessions are kept on disk as one file per session, and survive restarts
+// Expired sessions are removed periodically
+func NewDirectorySessionStore(directory string) (SessionStore, error) {
+	if stat, err := os.Stat(directory); err != nil {
+		return nil, err
+	} else if !stat.IsDir() {
+		return nil, errors.New("not a directory")
+	}
+
+	s := directorySessionStore{
+		directory: directory,
+		close:     make(chan struct{}),
+	}
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.decay()
+			case <-s.close:
+				return
+			}
+		}
+	}()
+	return s, nil
+}
+
+func (s directorySessionStore) path(id string) (string, error) {
+	if !ValidSessionId(id) {
+		return "", ErrSessionNotFound
+	}
+	return path.Join(s.directory, id), nil
+}
+
+// read Returns the value and expiry of a session file, stored as expiry unix time followed by value
+func (s directorySessionStore) read(fname string) ([]byte, time.Time, error) {
+	data, err := os.ReadFile(fname)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, time.Time{}, ErrSessionNotFound
+	} else if err != nil {
+		return nil, time.Time{}, err
+	}
+	if len(data) < 8 {
+		return nil, time.Time{}, errors.New("invalid session file")
+	}
+	return data[8:], time.Unix(int64(binary.LittleEndian.Uint64(data)), 0), nil
+}
+
+func (s directorySessionStore) Get(id string) ([]byte, error) {
+	fname, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+	value, expiry, err := s.read(fname)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(expiry) {
+		_ = os.Remove(fname)
+		return nil, ErrSessionNotFound
+	}
+	return value, nil
+}
+
+func (s directorySessionStore) Set(id string, value []byte, expiry time.Time) error {
+	fname, err := s.path(id)
+	if err != nil {
+		return err
+	}
+
+	data := binary.LittleEndian.AppendUint64(make([]byte, 0, 8+len(value)), uint64(expiry.Unix()))
+	data = append(data, value...)
+
+	// write and rename, so readers never see partial sessions
+	tmp, err := os.CreateTemp(s.directory, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fname)
+}
+
+func (s directorySessionStore) Delete(id string) error {
+	fname, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(fname)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrSessionNotFound
+	}
+	return err
+}
+
+func (s directorySessionStore) decay() {
+	entries, err := os.ReadDir(s.directory)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		if !ValidSessionId(entry.Name()) {
+			continue
+		}
+		fname := path.Join(s.directory, entry.Name())
+		if _, expiry, err := s.read(fname); err == nil && now.After(expiry) {
+			_ = os.Remove(fname)
+		}
+	}
+}
+
+func (s directorySessionStore) Close() error {
+	select {
+	case <-s.close:
+	default:
+		close(s.close)
+	}
+	return nil
+}
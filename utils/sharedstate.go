@@ -0,0 +1,167 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrStateNotFound = errors.New("state: key not found")
+
+// SharedState Key-value state with expiry, counters and publish/subscribe, shared across replicas
+type SharedState interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, key string) error
+
+	// Incr Atomically increments the counter at key by delta and returns the new value
+	// If the counter did not exist, it is created with ttl. Increments do not extend its expiry
+	Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error)
+
+	// Publish Sends message to all subscribers of channel, across all replicas
+	Publish(ctx context.Context, channel string, message []byte) error
+
+	// Subscribe Calls callback for each message published on channel, until unsubscribe is called
+	// Messages published on this replica are received as well
+	Subscribe(channel string, callback func(message []byte)) (unsubscribe func(), err error)
+
+	Close() error
+}
+
+// NewSharedState Connects to the shared state at the given url
+// Supported: memory:// (process local), redis://[:password@]host:port[/db]
+func NewSharedState(u string) (SharedState, error) {
+	uri, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	switch uri.Scheme {
+	case "memory":
+		return NewMemorySharedState(), nil
+	case "redis":
+		return NewRedisSharedState(uri)
+	default:
+		return nil, fmt.Errorf("unsupported shared state scheme %s", uri.Scheme)
+	}
+}
+
+type memorySubscriber struct {
+	callback func(message []byte)
+}
+
+type memorySharedState struct {
+	m *DecayMap[string, []byte]
+
+	// lock Held during increments, so they are atomic
+	lock sync.Mutex
+
+	subscribersLock sync.RWMutex
+	subscribers     map[string][]*memorySubscriber
+
+	close chan struct{}
+}
+
+// NewMemorySharedState State is only shared within this process
+func NewMemorySharedState() SharedState {
+	s := &memorySharedState{
+		m:           NewDecayMap[string, []byte](),
+		subscribers: make(map[string][]*memorySubscriber),
+		close:       make(chan struct{}),
+	}
+	go func() {
+		ticker := time.NewTicker(time.Minute * 5)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.m.Decay()
+			case <-s.close:
+				return
+			}
+		}
+	}()
+	return s
+}
+
+func (s *memorySharedState) Get(ctx context.Context, key string) ([]byte, error) {
+	if v, ok := s.m.Get(key); ok {
+		return v, nil
+	}
+	return nil, ErrStateNotFound
+}
+
+func (s *memorySharedState) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	s.m.Set(key, value, ttl)
+	return nil
+}
+
+func (s *memorySharedState) Delete(ctx context.Context, key string) error {
+	s.m.Delete(key)
+	return nil
+}
+
+func (s *memorySharedState) Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entry, ok := s.m.GetEntry(key)
+	if !ok {
+		s.m.Set(key, []byte(strconv.FormatInt(delta, 10)), ttl)
+		return delta, nil
+	}
+	n, err := strconv.ParseInt(string(entry.Value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("state: value at %s is not a counter", key)
+	}
+	n += delta
+	s.m.SetEntry(key, DecayMapEntry[[]byte]{Value: []byte(strconv.FormatInt(n, 10)), expiry: entry.expiry})
+	return n, nil
+}
+
+func (s *memorySharedState) Publish(ctx context.Context, channel string, message []byte) error {
+	s.subscribersLock.RLock()
+	subscribers := s.subscribers[channel]
+	s.subscribersLock.RUnlock()
+
+	for _, sub := range subscribers {
+		sub.callback(message)
+	}
+	return nil
+}
+
+func (s *memorySharedState) Subscribe(channel string, callback func(message []byte)) (func(), error) {
+	sub := &memorySubscriber{callback: callback}
+
+	s.subscribersLock.Lock()
+	defer s.subscribersLock.Unlock()
+	s.subscribers[channel] = append(s.subscribers[channel], sub)
+
+	return func() {
+		s.subscribersLock.Lock()
+		defer s.subscribersLock.Unlock()
+		subscribers := s.subscribers[channel]
+		for i, other := range subscribers {
+			if other == sub {
+				// copy, as publishers might be iterating the old slice
+				s.subscribers[channel] = append(subscribers[:i:i], subscribers[i+1:]...)
+				break
+			}
+		}
+		if len(s.subscribers[channel]) == 0 {
+			delete(s.subscribers, channel)
+		}
+	}, nil
+}
+
+func (s *memorySharedState) Close() error {
+	select {
+	case <-s.close:
+	default:
+		close(s.close)
+	}
+	return nil
+}
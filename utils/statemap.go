@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"context"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultSharedStateTimeout Operations on shared state taking longer than this are treated as misses
+const DefaultSharedStateTimeout = time.Second * 2
+
+// stateKey Encodes key as a string for shared state
+func stateKey(prefix string, key any) string {
+	switch k := key.(type) {
+	case string:
+		return prefix + k
+	case encoding.TextMarshaler:
+		if text, err := k.MarshalText(); err == nil {
+			return prefix + string(text)
+		}
+	}
+	// byte arrays and others
+	return prefix + fmt.Sprintf("%x", key)
+}
+
+// StateMap Key-value map with expiry, kept on shared state if set, or in process memory otherwise
+// Values are JSON encoded on shared state
+type StateMap[K comparable, V any] struct {
+	local  *DecayMap[K, V]
+	shared SharedState
+	prefix string
+}
+
+func NewStateMap[K comparable, V any](shared SharedState, prefix string) *StateMap[K, V] {
+	m := &StateMap[K, V]{
+		shared: shared,
+		prefix: prefix,
+	}
+	if shared == nil {
+		m.local = NewDecayMap[K, V]()
+	}
+	return m
+}
+
+func (m *StateMap[K, V]) Get(key K) (V, bool) {
+	if m.local != nil {
+		return m.local.Get(key)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultSharedStateTimeout)
+	defer cancel()
+
+	data, err := m.shared.Get(ctx, stateKey(m.prefix, key))
+	if err != nil {
+		if !errors.Is(err, ErrStateNotFound) {
+			slog.Debug("error getting shared state", "prefix", m.prefix, "error", err)
+		}
+		return zilch[V](), false
+	}
+	var value V
+	if err = json.Unmarshal(data, &value); err != nil {
+		slog.Debug("error decoding shared state", "prefix", m.prefix, "error", err)
+		return zilch[V](), false
+	}
+	return value, true
+}
+
+func (m *StateMap[K, V]) Set(key K, value V, ttl time.Duration) {
+	if m.local != nil {
+		m.local.Set(key, value, ttl)
+		return
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		slog.Debug("error encoding shared state", "prefix", m.prefix, "error", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultSharedStateTimeout)
+	defer cancel()
+
+	if err = m.shared.Set(ctx, stateKey(m.prefix, key), data, ttl); err != nil {
+		slog.Debug("error setting shared state", "prefix", m.prefix, "error", err)
+	}
+}
+
+// Decay Removes expired entries, shared state expires them itself
+func (m *StateMap[K, V]) Decay() {
+	if m.local != nil {
+		m.local.Decay()
+	}
+}
+
+// StateCounter Counters with expiry, kept on shared state if set, or in process memory otherwise
+type StateCounter[K comparable] struct {
+	local *DecayMap[K, *atomic.Int64]
+	// localLock Held while looking up or creating local counters, so concurrent first increments share one
+	localLock sync.Mutex
+
+	shared SharedState
+	prefix string
+}
+
+func NewStateCounter[K comparable](shared SharedState, prefix string) *StateCounter[K] {
+	c := &StateCounter[K]{
+		shared: shared,
+		prefix: prefix,
+	}
+	if shared == nil {
+		c.local = NewDecayMap[K, *atomic.Int64]()
+	}
+	return c
+}
+
+// Incr Increments the counter at key, creating it with ttl if it does not exist, and returns its new value
+// On shared state errors, zero is returned
+func (c *StateCounter[K]) Incr(key K, ttl time.Duration) int64 {
+	if c.local != nil {
+		c.localLock.Lock()
+		counter, ok := c.local.Get(key)
+		if !ok {
+			counter = new(atomic.Int64)
+			c.local.Set(key, counter, ttl)
+		}
+		c.localLock.Unlock()
+		return counter.Add(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultSharedStateTimeout)
+	defer cancel()
+
+	n, err := c.shared.Incr(ctx, stateKey(c.prefix, key), 1, ttl)
+	if err != nil {
+		slog.Debug("error incrementing shared state", "prefix", c.prefix, "error", err)
+		return 0
+	}
+	return n
+}
+
+// Get Returns the current value of the counter at key, or zero if it does not exist
+func (c *StateCounter[K]) Get(key K) int64 {
+	if c.local != nil {
+		if counter, ok := c.local.Get(key); ok {
+			return counter.Load()
+		}
+		return 0
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultSharedStateTimeout)
+	defer cancel()
+
+	data, err := c.shared.Get(ctx, stateKey(c.prefix, key))
+	if err != nil {
+		return 0
+	}
+	var n int64
+	_, _ = fmt.Sscan(string(data), &n)
+	return n
+}
+
+// Decay Removes expired entries, shared state expires them itself
+func (c *StateCounter[K]) Decay() {
+	if c.local != nil {
+		c.local.Decay()
+	}
+}
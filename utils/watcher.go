@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type watchedFile struct {
+	modTime time.Time
+	size    int64
+	mode    fs.FileMode
+}
+
+// FileWatcher polls the given paths and calls back when any file under them is changed, created or removed
+// Directories are walked recursively
+type FileWatcher struct {
+	paths    []string
+	interval time.Duration
+	callback func()
+
+	state map[string]watchedFile
+
+	close chan struct{}
+	wg    sync.WaitGroup
+}
+
+func NewFileWatcher(interval time.Duration, callback func(), paths ...string) (*FileWatcher, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("no paths to watch")
+	}
+	if interval <= 0 {
+		return nil, errors.New("invalid watch interval")
+	}
+
+	w := &FileWatcher{
+		paths:    paths,
+		interval: interval,
+		callback: callback,
+		close:    make(chan struct{}),
+	}
+
+	var err error
+	w.state, err = w.scan()
+	if err != nil {
+		return nil, err
+	}
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				state, err := w.scan()
+				if err != nil {
+					// keep previous state, try again later
+					continue
+				}
+				if w.changed(state) {
+					w.state = state
+					w.callback()
+				}
+			case <-w.close:
+				return
+			}
+		}
+	}()
+
+	return w, nil
+}
+
+func (w *FileWatcher) scan() (map[string]watchedFile, error) {
+	state := make(map[string]watchedFile)
+	for _, p := range w.paths {
+		err := filepath.WalkDir(p, func(fpath string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					// removed files are a change, not an error
+					return nil
+				}
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			state[fpath] = watchedFile{
+				modTime: info.ModTime(),
+				size:    info.Size(),
+				mode:    info.Mode(),
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return state, nil
+}
+
+func (w *FileWatcher) changed(state map[string]watchedFile) bool {
+	if len(state) != len(w.state) {
+		return true
+	}
+	for k, v := range state {
+		if old, ok := w.state[k]; !ok || old != v {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *FileWatcher) Close() error {
+	select {
+	case <-w.close:
+	default:
+		close(w.close)
+		w.wg.Wait()
+	}
+	return nil
+}
+
+// IsDirectory returns true if the path exists and is a directory
+func IsDirectory(p string) bool {
+	stat, err := os.Stat(p)
+	return err == nil && stat.IsDir()
+}